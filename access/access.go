@@ -1,10 +1,11 @@
 package access
 
 import (
-	"container/list"
+	"bufio"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"io"
+	"os"
 	"security-json-import/auth"
 	"security-json-import/helpers"
 	"strconv"
@@ -37,7 +38,7 @@ type GroupImport struct {
 type UserImport struct {
 	Name                     string   `json:"name"`
 	Email                    string   `json:"email"`
-	Password                 string   `json:"password"`
+	Password                 string   `json:"password,omitempty"`
 	Admin                    bool     `json:"admin"`
 	ProfileUpdatable         bool     `json:"profileUpdatable"`
 	DisableUIAccess          bool     `json:"disableUIAccess"`
@@ -143,11 +144,20 @@ type ListTypes struct {
 	Permission      PermissionImport
 	PermissionV2    PermissionV2Import
 	User            UserImport
+	Project         ProjectImport
 	GroupIndex      int
 	PermissionIndex int
 	UserIndex       int
 	Name            string
+	//Backend legacy or access, the API groups and users are written through
+	Backend string
 }
+
+//Queue receives each item as it is read
+type Queue interface {
+	Add(item ListTypes)
+}
+
 type ArtifactoryVersion struct {
 	Version  string   `json:"version"`
 	Revision string   `json:"revision"`
@@ -164,300 +174,524 @@ type ArtifactoryErrorDetail struct {
 	Message string `json:"message"`
 }
 
-func ReadSecurityJSON(workQueue *list.List, flags helpers.Flags) error {
+//TargetQueue the queue of one target instance and its Artifactory version, which decides the permission API and the
+//backend its items are written through
+type TargetQueue struct {
+	Queue   Queue
+	Version string
+}
 
-	//get art version
+//TargetVersion the Artifactory version of the instance at creds.URL
+func TargetVersion(creds auth.Creds, flags helpers.Flags) (ArtifactoryVersion, error) {
 	var artVer ArtifactoryVersion
-	data, _, _, getErr := auth.GetRestAPI("GET", true, flags.URLVar+"/api/system/version", flags.UsernameVar, flags.ApikeyVar, "", nil, nil, 0, flags, nil)
+	data, _, _, getErr := auth.GetRestAPI("GET", true, creds.URL+"/api/system/version", creds.Username, creds.Apikey, "", nil, nil, 0, flags, nil)
 	if getErr != nil {
-		return getErr
+		return artVer, getErr
 	}
 	err := json.Unmarshal(data, &artVer)
+	return artVer, err
+}
+
+//ReadSecurityJSON queue everything to import into the instance at -url
+func ReadSecurityJSON(workQueue Queue, flags helpers.Flags) error {
+	artVer, err := TargetVersion(auth.Creds{URL: flags.URLVar, Username: flags.UsernameVar, Apikey: flags.ApikeyVar}, flags)
 	if err != nil {
 		return err
 	}
+	return ReadSecurityJSONTargets([]TargetQueue{{Queue: workQueue, Version: artVer.Version}}, flags)
+}
 
-	//TODO: this reads whole file into memory, be wary of OOM
-	log.Info("reading security json")
-	data, err = ioutil.ReadFile(flags.SecurityJSONFileVar)
-	if err != nil {
-		log.Error("Error reading security json" + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-		return errors.New("Error reading security json" + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-	}
+//targetState a target while security json is read, its items adapted to its version
+type targetState struct {
+	queue    Queue
+	useV2    bool
+	projects *projectQueue
+}
 
-	//groups
-	if !flags.SkipGroupImportVar {
-		ReadGroups(workQueue, data)
+//fanOut passes every item on to each target
+type fanOut []Queue
+
+func (f fanOut) Add(item ListTypes) {
+	for _, queue := range f {
+		queue.Add(item)
 	}
+}
 
-	//users
-	if !flags.SkipUserImportVar {
-		if !strings.Contains(flags.UserEmailDomainVar, "@") {
-			log.Warn("missing @ for email field, preppending @")
-			flags.UserEmailDomainVar = "@" + flags.UserEmailDomainVar
+//ReadSecurityJSONTargets read security json and the user group association file once, queuing everything into each target.
+//Permission targets go through v1 on targets before 6.6.0, which have no build permission targets
+func ReadSecurityJSONTargets(targetQueues []TargetQueue, flags helpers.Flags) error {
+	var mapping *ProjectMapping
+	if flags.ProjectMappingFileVar != "" && !flags.SkipPermissionImportVar {
+		var err error
+		mapping, err = ReadProjectMapping(flags.ProjectMappingFileVar)
+		if err != nil {
+			return err
 		}
-		data2, err := ioutil.ReadFile(flags.UserGroupAssocationFileVar)
+	}
+	v2Constraint, err := semver.NewConstraint(">= 6.6.0")
+	if err != nil {
+		return err
+	}
+
+	var targets []*targetState
+	var all fanOut
+	var versions []string
+	anyV2 := false
+	for _, target := range targetQueues {
+		backend, err := BackendFor(flags.BackendVar, target.Version)
 		if err != nil {
-			log.Error("Error reading groups with users list json: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-			return errors.New("Error reading groups with users list json: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+			return err
 		}
-		if flags.UsersFromGroupsVar {
-			//check if art > 6.13.0 or not
-			c, err := semver.NewConstraint(">= 6.13.0")
-			if err != nil {
-				return err
-			}
-			v, err := semver.NewVersion(artVer.Version)
+		if !flags.SkipGroupImportVar || !flags.SkipUserImportVar {
+			log.Info(target.Version, " detected, writing groups and users through the ", backend, " API")
+		}
+		state := &targetState{queue: backendQueue{queue: target.Queue, backend: backend}}
+		if mapping != nil {
+			state.projects = newProjectQueue(state.queue, mapping)
+		}
+		if !flags.SkipPermissionImportVar {
+			v, err := semver.NewVersion(target.Version)
 			if err != nil {
 				return err
 			}
-			a := c.Check(v)
-			if !a {
-				log.Warn("The source must be atleast 6.13.0 to get Users from Groups. You're importing into ", artVer.Version, " which does not match this. Proceed with caution")
+			state.useV2 = v2Constraint.Check(v)
+			if !state.useV2 {
+				log.Info(target.Version, " detected, using v1")
+			} else {
+				log.Info(target.Version, " detected, using v2")
 			}
-			CreateUsersFromGroups(workQueue, data2, flags.UserEmailDomainVar)
-		} else if flags.UsersWithGroupsVar {
-			CreateUsersWithGroups(workQueue, data2)
 		}
+		anyV2 = anyV2 || state.useV2
+		targets = append(targets, state)
+		all = append(all, state.queue)
+		versions = append(versions, target.Version)
 	}
 
-	//permission targets
-	if !flags.SkipPermissionImportVar {
+	//users come from a separate file, queue them once groups are in but before any permission target
+	usersRead := false
+	readUsers := func() error {
+		if usersRead || flags.SkipUserImportVar {
+			return nil
+		}
+		usersRead = true
+		return ReadUserAssociations(all, flags, versions)
+	}
 
-		c, err := semver.NewConstraint(">= 6.6.0")
-		if err != nil {
-			return err
+	log.Info("reading security json")
+	file, err := os.Open(flags.SecurityJSONFileVar)
+	if err != nil {
+		log.Error("Error reading security json" + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return errors.New("Error reading security json" + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	defer file.Close()
+
+	var groupCount, repoCount, buildCount, projectCount, permissionIndex int
+	var handlers SecurityJSONHandlers
+	handlers.BeforeAcls = readUsers
+	if !flags.SkipGroupImportVar {
+		handlers.Group = func(i int, group GroupData) error {
+			CreateGroupQueueObject(all, group, i)
+			groupCount++
+			return nil
 		}
-		v, err := semver.NewVersion(artVer.Version)
-		if err != nil {
-			return err
+	}
+	if !flags.SkipPermissionImportVar {
+		handlers.RepoAcl = func(i int, acl PermissionsAcls) error {
+			if mapping != nil {
+				if key, ok := mapping.ProjectFor(acl.PermissionTarget.RepoKeys); ok {
+					log.Debug("permission target ", acl.PermissionTarget.Name, " moves into project ", key)
+					for _, target := range targets {
+						target.projects.members(target.queue, acl, key)
+					}
+					projectCount++
+					return nil
+				}
+			}
+			for _, target := range targets {
+				if target.useV2 {
+					CreatePermissionV2QueueObject(target.queue, acl, "repository", permissionIndex)
+				} else {
+					CreatePermissionQueueObject(target.queue, acl, permissionIndex)
+				}
+			}
+			permissionIndex++
+			repoCount++
+			return nil
 		}
-		a := c.Check(v)
-		if !a {
-			log.Info(artVer.Version, " detected, using v1")
-			ReadPermissionAcls(workQueue, data)
-		} else {
-			log.Info(artVer.Version, " detected, using v2")
-			length, _ := ReadRepoPermissionV2Acls(workQueue, data)
-			ReadBuildPermissionV2Acls(workQueue, data, length)
+		//v1 has no notion of build permission targets
+		if anyV2 {
+			handlers.BuildAcl = func(i int, acl PermissionsAcls) error {
+				for _, target := range targets {
+					if target.useV2 {
+						CreatePermissionV2QueueObject(target.queue, acl, "build", permissionIndex)
+					}
+				}
+				permissionIndex++
+				buildCount++
+				return nil
+			}
 		}
 	}
-	var endTask ListTypes
-	endTask.AccessType = "end"
-	workQueue.PushBack(endTask)
-	return nil
-}
-
-func ReadGroups(workQueue *list.List, data []byte) error {
-	var result Groups
-	err := json.Unmarshal(data, &result)
+	err = StreamSecurityJSON(bufio.NewReader(file), handlers)
 	if err != nil {
-		log.Error("Error reading groups: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		log.Error("Error reading security json: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return errors.New("Error reading security json: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	//no acls in the file, users still need queuing
+	if err := readUsers(); err != nil {
 		return err
 	}
-	log.Info("Reading groups")
-	log.Info("Number of groups:", len(result.Groups))
-
-	for i := range result.Groups {
-		var data ListTypes
-		data.AccessType = "group"
-		var groupData GroupImport
-		groupData.Name = result.Groups[i].GroupName
-		groupData.Description = result.Groups[i].Description
-		groupData.AutoJoin = result.Groups[i].NewUserDefault
-		groupData.Realm = result.Groups[i].Realm
-		groupData.AdminPrivileges = result.Groups[i].AdminPrivileges
-		data.GroupIndex = i
-		data.Name = result.Groups[i].GroupName
-		data.Group = groupData
-		workQueue.PushBack(data)
+	log.Info("Number of groups:", groupCount)
+	log.Info("Number of repo permissions:", repoCount)
+	log.Info("Number of build permissions:", buildCount)
+	if mapping != nil {
+		log.Info("Number of repo permissions moved into projects:", projectCount)
 	}
-	return nil
-}
 
-func ReadPermissionAcls(workQueue *list.List, data []byte) error {
-	var repoPermissionData RepoPermissions
-	err := json.Unmarshal(data, &repoPermissionData)
-	if err != nil {
-		log.Error("Error reading repo permissions: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-		return err
-	}
-	log.Info("Number of repo permissions:", len(repoPermissionData.RepoAcls))
-	CreatePermissionQueueObject(workQueue, repoPermissionData.RepoAcls)
 	return nil
 }
 
-func ReadRepoPermissionV2Acls(workQueue *list.List, data []byte) (int, error) {
-	var repoPermissionData RepoPermissions
-	err := json.Unmarshal(data, &repoPermissionData)
-	if err != nil {
-		log.Error("Error reading repo permissions v2: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-		return 0, err
+//ReadUserAssociations stream the user group association file into the work queue
+func ReadUserAssociations(workQueue Queue, flags helpers.Flags, versions []string) error {
+	if !strings.Contains(flags.UserEmailDomainVar, "@") {
+		log.Warn("missing @ for email field, preppending @")
+		flags.UserEmailDomainVar = "@" + flags.UserEmailDomainVar
 	}
-	log.Info("Number of repo permissions v2:", len(repoPermissionData.RepoAcls))
-	CreatePermissionV2QueueObject(workQueue, repoPermissionData.RepoAcls, "repository", 0)
-	return len(repoPermissionData.RepoAcls), nil
-}
-
-func ReadBuildPermissionV2Acls(workQueue *list.List, data []byte, length int) error {
-	var result BuildPermissions
-	err := json.Unmarshal(data, &result)
+	file, err := os.Open(flags.UserGroupAssocationFileVar)
 	if err != nil {
-		log.Error("Error reading build permissions v2: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-		return err
+		log.Error("Error reading groups with users list json: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return errors.New("Error reading groups with users list json: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
 	}
-	log.Info("Number of build permissions v2:", len(result.BuildAcls))
-	//need to check if permission target already exists, and if so ammend to it.
-	CreatePermissionV2QueueObject(workQueue, result.BuildAcls, "build", length)
-	return nil
-}
-
-func CreatePermissionQueueObject(workQueue *list.List, acls []PermissionsAcls) error {
-	for i := range acls {
-		var permissionImport PermissionImport
-		var data ListTypes
-		data.AccessType = "permission"
-		//noSpaceName := strings.ReplaceAll(acls[i].PermissionTarget.Name, " ", "%20")
-		permissionImport.IncludePatterns = acls[i].PermissionTarget.Includes
-		permissionImport.ExcludePatterns = acls[i].PermissionTarget.Excludes
-		permissionImport.Repositories = acls[i].PermissionTarget.RepoKeys
-		permissionImport.Name = acls[i].PermissionTarget.Name
-		//need check for "" repo list, ANY *
-		for j := range acls[i].Aces {
-			//TODO verify that aces and mutableAces are the same
-			if acls[i].Aces[j].Group {
-				if permissionImport.Principals.Groups == nil {
-					permissionImport.Principals.Groups = make(map[string][]string)
-				}
-				permissionImport.Principals.Groups[acls[i].Aces[j].Principal] = acls[i].Aces[j].PermissionsAsString
-			} else {
-				if permissionImport.Principals.Users == nil {
-					permissionImport.Principals.Users = make(map[string][]string)
-				}
-				permissionImport.Principals.Users[acls[i].Aces[j].Principal] = acls[i].Aces[j].PermissionsAsString
+	defer file.Close()
+	if flags.UsersFromGroupsVar {
+		//check if art > 6.13.0 or not
+		c, err := semver.NewConstraint(">= 6.13.0")
+		if err != nil {
+			return err
+		}
+		for _, version := range versions {
+			v, err := semver.NewVersion(version)
+			if err != nil {
+				return err
+			}
+			a := c.Check(v)
+			if !a {
+				log.Warn("The source must be atleast 6.13.0 to get Users from Groups. You're importing into ", version, " which does not match this. Proceed with caution")
 			}
 		}
-		data.PermissionIndex = i
-		data.Name = acls[i].PermissionTarget.Name
-
-		data.Permission = permissionImport
-		workQueue.PushBack(data)
+		return CreateUsersFromGroups(workQueue, bufio.NewReader(file), flags.UserEmailDomainVar)
+	} else if flags.UsersWithGroupsVar {
+		return CreateUsersWithGroups(workQueue, bufio.NewReader(file))
 	}
 	return nil
 }
 
-func CreatePermissionV2QueueObject(workQueue *list.List, acls []PermissionsAcls, PermissionType string, length int) error {
+func CreateGroupQueueObject(workQueue Queue, group GroupData, index int) {
+	var data ListTypes
+	data.AccessType = "group"
+	var groupData GroupImport
+	groupData.Name = group.GroupName
+	groupData.Description = group.Description
+	groupData.AutoJoin = group.NewUserDefault
+	groupData.Realm = group.Realm
+	groupData.AdminPrivileges = group.AdminPrivileges
+	data.GroupIndex = index
+	data.Name = group.GroupName
+	data.Group = groupData
+	workQueue.Add(data)
+}
 
-	for i := range acls {
-		//check if v2 if > 6.6?
-		var permissionImport PermissionV2Import
-		var permissionData PermissionDataV2Import
-		var data ListTypes
-		data.AccessType = "permissionV2"
-		noSpaceName := strings.ReplaceAll(acls[i].PermissionTarget.Name, " ", "%20")
-		permissionImport.Name = acls[i].PermissionTarget.Name
-		if PermissionType == "repository" {
-			if permissionImport.Repo == nil {
-				permissionImport.Repo = &PermissionDataV2Import{}
+func CreatePermissionQueueObject(workQueue Queue, acl PermissionsAcls, index int) {
+	var permissionImport PermissionImport
+	var data ListTypes
+	data.AccessType = "permission"
+	//noSpaceName := strings.ReplaceAll(acl.PermissionTarget.Name, " ", "%20")
+	permissionImport.IncludePatterns = acl.PermissionTarget.Includes
+	permissionImport.ExcludePatterns = acl.PermissionTarget.Excludes
+	permissionImport.Repositories = acl.PermissionTarget.RepoKeys
+	permissionImport.Name = acl.PermissionTarget.Name
+	//need check for "" repo list, ANY *
+	for j := range acl.Aces {
+		//TODO verify that aces and mutableAces are the same
+		if acl.Aces[j].Group {
+			if permissionImport.Principals.Groups == nil {
+				permissionImport.Principals.Groups = make(map[string][]string)
 			}
-		}
-		if PermissionType == "build" {
-			if permissionImport.Build == nil {
-				permissionImport.Build = &PermissionDataV2Import{}
+			permissionImport.Principals.Groups[acl.Aces[j].Principal] = acl.Aces[j].PermissionsAsString
+		} else {
+			if permissionImport.Principals.Users == nil {
+				permissionImport.Principals.Users = make(map[string][]string)
 			}
+			permissionImport.Principals.Users[acl.Aces[j].Principal] = acl.Aces[j].PermissionsAsString
 		}
+	}
+	data.PermissionIndex = index
+	data.Name = acl.PermissionTarget.Name
 
-		permissionData.IncludePatterns = acls[i].PermissionTarget.Includes
-		permissionData.ExcludePatterns = acls[i].PermissionTarget.Excludes
-		permissionData.Repositories = acls[i].PermissionTarget.RepoKeys
-		//need check for "" repo list, ANY *
-		for j := range acls[i].Aces {
-			//TODO verify that aces and mutableAces are the same
-			if acls[i].Aces[j].Group {
-				if permissionData.Actions.Groups == nil {
-					permissionData.Actions.Groups = make(map[string][]string)
-				}
-				permissionData.Actions.Groups[acls[i].Aces[j].Principal] = acls[i].Aces[j].PermissionsDisplayNames
-			} else {
-				if permissionData.Actions.Users == nil {
-					permissionData.Actions.Users = make(map[string][]string)
-				}
-				permissionData.Actions.Users[acls[i].Aces[j].Principal] = acls[i].Aces[j].PermissionsDisplayNames
+	data.Permission = permissionImport
+	workQueue.Add(data)
+}
+
+func CreatePermissionV2QueueObject(workQueue Queue, acl PermissionsAcls, PermissionType string, index int) {
+	//check if v2 if > 6.6?
+	var permissionImport PermissionV2Import
+	var permissionData PermissionDataV2Import
+	var data ListTypes
+	data.AccessType = "permissionV2"
+	noSpaceName := strings.ReplaceAll(acl.PermissionTarget.Name, " ", "%20")
+	permissionImport.Name = acl.PermissionTarget.Name
+
+	permissionData.IncludePatterns = acl.PermissionTarget.Includes
+	permissionData.ExcludePatterns = acl.PermissionTarget.Excludes
+	permissionData.Repositories = acl.PermissionTarget.RepoKeys
+	//need check for "" repo list, ANY *
+	for j := range acl.Aces {
+		//TODO verify that aces and mutableAces are the same
+		if acl.Aces[j].Group {
+			if permissionData.Actions.Groups == nil {
+				permissionData.Actions.Groups = make(map[string][]string)
 			}
+			permissionData.Actions.Groups[acl.Aces[j].Principal] = acl.Aces[j].PermissionsDisplayNames
+		} else {
+			if permissionData.Actions.Users == nil {
+				permissionData.Actions.Users = make(map[string][]string)
+			}
+			permissionData.Actions.Users[acl.Aces[j].Principal] = acl.Aces[j].PermissionsDisplayNames
 		}
-		data.PermissionIndex = i + length
-		data.Name = noSpaceName
-		if PermissionType == "repository" {
-			permissionImport.Repo = &permissionData
-		}
-		if PermissionType == "build" {
-			permissionImport.Build = &permissionData
-		}
-
-		data.PermissionV2 = permissionImport
-		workQueue.PushBack(data)
 	}
-	return nil
+	data.PermissionIndex = index
+	data.Name = noSpaceName
+	if PermissionType == "repository" {
+		permissionImport.Repo = &permissionData
+	}
+	if PermissionType == "build" {
+		permissionImport.Build = &permissionData
+	}
+
+	data.PermissionV2 = permissionImport
+	workQueue.Add(data)
 }
 
-func CreateUsersFromGroups(workQueue *list.List, data []byte, UserEmailDomain string) error {
-	var result CreateUsersFromGroupsJSON
-	err := json.Unmarshal(data, &result)
+func CreateUsersFromGroups(workQueue Queue, r io.Reader, UserEmailDomain string) error {
+	groupCount := 0
+	userCount := 0
+	dec := json.NewDecoder(r)
+	err := streamObject(dec, func(key string) error {
+		if key != "groups" {
+			return skipValue(dec)
+		}
+		return streamArray(dec, func(i int) error {
+			var group CreateUsersFromGroupsDataJSON
+			if err := dec.Decode(&group); err != nil {
+				return err
+			}
+			groupCount++
+			for j := range group.UserNames {
+				var data ListTypes
+				data.AccessType = "user"
+				var userData UserImport
+				userData.Name = group.UserNames[j]
+				if strings.Contains(userData.Name, "@") {
+					userData.Email = group.UserNames[j]
+				} else {
+					userData.Email = group.UserNames[j] + UserEmailDomain
+				}
+				userData.Password = "password"
+				userData.ProfileUpdatable = true
+				userData.Groups = []string{group.Name}
+				data.UserIndex = userCount
+				data.Name = group.UserNames[j]
+				data.User = userData
+				workQueue.Add(data)
+				userCount++
+			}
+			return nil
+		})
+	})
 	if err != nil {
-		log.Warn("Error reading users from group: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		log.Error("Error reading users from group: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return errors.New("Error reading users from group: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
 	}
-	log.Info("Number of users from groups list:", len(result.Groups))
+	log.Info("Number of users from groups list:", groupCount)
+	return nil
+}
 
+func CreateUsersWithGroups(workQueue Queue, r io.Reader) error {
 	userCount := 0
-	for i := range result.Groups {
-		for j := range result.Groups[i].UserNames {
+	dec := json.NewDecoder(r)
+	err := streamObject(dec, func(key string) error {
+		if key != "users" {
+			return skipValue(dec)
+		}
+		return streamArray(dec, func(i int) error {
+			var user CreateUsersWithGroupsDataJSON
+			if err := dec.Decode(&user); err != nil {
+				return err
+			}
 			var data ListTypes
 			data.AccessType = "user"
 			var userData UserImport
-			userData.Name = result.Groups[i].UserNames[j]
-			if strings.Contains(userData.Name, "@") {
-				userData.Email = result.Groups[i].UserNames[j]
-			} else {
-				userData.Email = result.Groups[i].UserNames[j] + UserEmailDomain
-			}
+			userData.Name = user.Name
+			userData.Email = user.Email
 			userData.Password = "password"
 			userData.ProfileUpdatable = true
-			userData.Groups = []string{result.Groups[i].Name}
-			data.UserIndex = userCount
-			data.Name = result.Groups[i].UserNames[j]
+			userData.Groups = user.Groups
+			userData.DisableUIAccess = user.DisableUIAccess
+			userData.Admin = user.Admin
+			userData.InternalPasswordDisabled = user.InternalPasswordDisabled
+			userData.ProfileUpdatable = user.ProfileUpdatable
+			data.UserIndex = i
+			data.Name = user.Name
 			data.User = userData
-			workQueue.PushBack(data)
+			workQueue.Add(data)
 			userCount++
-		}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Error("Error reading users with groups: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return errors.New("Error reading users with groups: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
 	}
+	log.Info("Number of users:", userCount)
 	return nil
 }
 
-func CreateUsersWithGroups(workQueue *list.List, data []byte) error {
-	var result CreateUsersWithGroupsJSON
-	err := json.Unmarshal(data, &result)
-	if err != nil {
-		log.Warn("Error reading users with groups: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+//EntityName name of the group, user or permission target an item imports
+func (l ListTypes) EntityName() string {
+	switch l.AccessType {
+	case "group":
+		return l.Group.Name
+	case "user":
+		return l.User.Name
+	case "permission":
+		return l.Permission.Name
+	case "permissionV2":
+		return l.PermissionV2.Name
+	case "project":
+		return l.Project.Key
+	case "projectRepository":
+		return l.Project.Repository
+	case "projectMember":
+		return l.Project.Key + "/" + l.Project.principal() + "/" + l.Project.Name
 	}
-	log.Info("Number of users:", len(result.Users))
-
-	for i := range result.Users {
-		var data ListTypes
-		data.AccessType = "user"
-		var userData UserImport
-		userData.Name = result.Users[i].Name
-		userData.Email = result.Users[i].Email
-		userData.Password = "password"
-		userData.ProfileUpdatable = true
-		userData.Groups = result.Users[i].Groups
-		userData.DisableUIAccess = result.Users[i].DisableUIAccess
-		userData.Admin = result.Users[i].Admin
-		userData.InternalPasswordDisabled = result.Users[i].InternalPasswordDisabled
-		userData.ProfileUpdatable = result.Users[i].ProfileUpdatable
-		data.UserIndex = i
-		data.Name = result.Users[i].Name
-		data.User = userData
-		workQueue.PushBack(data)
+	return l.Name
+}
+
+//Key identifies the entity an item imports, e.g. group/readers or user/bob
+func (l ListTypes) Key() string {
+	return l.AccessType + "/" + l.EntityName()
+}
+
+//Dependencies keys of the groups and users that need to exist before this item can be imported
+func (l ListTypes) Dependencies() []string {
+	var deps []string
+	principals := func(users, groups map[string][]string) {
+		for user := range users {
+			deps = append(deps, "user/"+user)
+		}
+		for group := range groups {
+			deps = append(deps, "group/"+group)
+		}
+	}
+	switch l.AccessType {
+	case "user":
+		for _, group := range l.User.Groups {
+			deps = append(deps, "group/"+group)
+		}
+	case "permission":
+		principals(l.Permission.Principals.Users, l.Permission.Principals.Groups)
+	case "permissionV2":
+		if l.PermissionV2.Repo != nil {
+			principals(l.PermissionV2.Repo.Actions.Users, l.PermissionV2.Repo.Actions.Groups)
+		}
+		if l.PermissionV2.Build != nil {
+			principals(l.PermissionV2.Build.Actions.Users, l.PermissionV2.Build.Actions.Groups)
+		}
+	case "projectRepository":
+		deps = append(deps, "project/"+l.Project.Key)
+	case "projectMember":
+		deps = append(deps, "project/"+l.Project.Key, l.Project.principal()+"/"+l.Project.Name)
+	}
+	return deps
+}
+
+//ID identifies an item across runs. Users read from groups show up once per group and build permission
+//targets can share a name with a repo one, so those carry a suffix
+func (l ListTypes) ID() string {
+	switch {
+	case l.AccessType == "user" && len(l.User.Groups) > 0:
+		return l.Key() + "#" + strings.Join(l.User.Groups, ",")
+	case l.AccessType == "permissionV2" && l.PermissionV2.Build != nil:
+		return l.Key() + "#build"
+	case l.AccessType == "projectMember" && l.Project.Source != "":
+		return l.Key() + "#" + l.Project.Source
+	}
+	return l.Key()
+}
+
+//Payload the JSON body sent for this item
+func (l ListTypes) Payload() interface{} {
+	switch l.AccessType {
+	case "group":
+		return l.Group
+	case "user":
+		return l.User
+	case "permission":
+		return l.Permission
+	case "permissionV2":
+		return l.PermissionV2
+	case "project", "projectRepository", "projectMember":
+		return l.Project
 	}
 	return nil
 }
+
+//Endpoint path under the Artifactory URL the item lives at, the payload is PUT there on the legacy API
+func (l ListTypes) Endpoint() string {
+	switch {
+	case l.onAccess() && l.AccessType == "group":
+		return "/access/api/v2/groups/" + l.Group.Name
+	case l.onAccess():
+		return "/access/api/v2/users/" + l.User.Name
+	case l.isProject():
+		return l.projectEndpoint()
+	}
+	switch l.AccessType {
+	case "group":
+		return "/api/security/groups/" + l.Group.Name
+	case "user":
+		return "/api/security/users/" + l.User.Name
+	case "permission":
+		return "/api/security/permissions/" + l.Permission.Name
+	case "permissionV2":
+		return "/api/v2/security/permissions/" + l.PermissionV2.Name
+	}
+	return ""
+}
+
+//ItemFromPayload rebuild an item from its access type and JSON payload, the reverse of Payload
+func ItemFromPayload(accessType string, payload []byte) (ListTypes, error) {
+	var data ListTypes
+	data.AccessType = accessType
+	var err error
+	switch accessType {
+	case "group":
+		err = json.Unmarshal(payload, &data.Group)
+		data.Name = data.Group.Name
+	case "user":
+		err = json.Unmarshal(payload, &data.User)
+		data.Name = data.User.Name
+	case "permission":
+		err = json.Unmarshal(payload, &data.Permission)
+		data.Name = data.Permission.Name
+	case "permissionV2":
+		err = json.Unmarshal(payload, &data.PermissionV2)
+		data.Name = strings.ReplaceAll(data.PermissionV2.Name, " ", "%20")
+	case "project", "projectRepository", "projectMember":
+		err = json.Unmarshal(payload, &data.Project)
+		data.Name = data.EntityName()
+	default:
+		err = errors.New("unknown access type " + accessType)
+	}
+	return data, err
+}
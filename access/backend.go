@@ -0,0 +1,168 @@
+package access
+
+import (
+	"encoding/json"
+	"errors"
+	"security-json-import/helpers"
+	"strconv"
+
+	"github.com/Masterminds/semver"
+)
+
+//backends groups and users can be written through
+const (
+	AutoBackend   = "auto"
+	LegacyBackend = "legacy"
+	AccessBackend = "access"
+)
+
+//accessAPIVersion first Artifactory with the Access v2 users and groups APIs
+const accessAPIVersion = ">= 7.49.3"
+
+//AccessUser user as the Access v2 users API takes and returns it
+type AccessUser struct {
+	Username                 string   `json:"username"`
+	Email                    string   `json:"email"`
+	Password                 string   `json:"password,omitempty"`
+	Admin                    bool     `json:"admin"`
+	ProfileUpdatable         bool     `json:"profile_updatable"`
+	DisableUIAccess          bool     `json:"disable_ui_access"`
+	InternalPasswordDisabled bool     `json:"internal_password_disabled"`
+	Groups                   []string `json:"groups,omitempty"`
+}
+
+//AccessGroup group as the Access v2 groups API takes and returns it. Members are left to the users
+type AccessGroup struct {
+	Name            string `json:"name"`
+	Description     string `json:"description"`
+	AutoJoin        bool   `json:"auto_join"`
+	AdminPrivileges bool   `json:"admin_privileges"`
+	Realm           string `json:"realm,omitempty"`
+}
+
+//CheckBackend error if -backend is not one we know
+func CheckBackend(backend string) error {
+	switch backend {
+	case AutoBackend, LegacyBackend, AccessBackend:
+		return nil
+	}
+	return errors.New("Unknown -backend " + backend + ", expected auto, legacy or access " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+}
+
+//BackendFor the backend -backend asks for on a target of the given version, auto picks the Access API where it exists
+func BackendFor(backend, version string) (string, error) {
+	if err := CheckBackend(backend); err != nil {
+		return "", err
+	}
+	if backend != AutoBackend {
+		return backend, nil
+	}
+	c, err := semver.NewConstraint(accessAPIVersion)
+	if err != nil {
+		return "", err
+	}
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return "", err
+	}
+	if c.Check(v) {
+		return AccessBackend, nil
+	}
+	return LegacyBackend, nil
+}
+
+//onAccess true if the item is a group or user written through the Access API
+func (l ListTypes) onAccess() bool {
+	return l.Backend == AccessBackend && (l.AccessType == "group" || l.AccessType == "user")
+}
+
+//Body the JSON body sent to the target for this item, the Payload in the schema of its backend
+func (l ListTypes) Body() interface{} {
+	if l.isProject() {
+		return l.projectBody()
+	}
+	if !l.onAccess() {
+		return l.Payload()
+	}
+	if l.AccessType == "group" {
+		return toAccessGroup(l.Group)
+	}
+	return toAccessUser(l.User)
+}
+
+//Collection path new groups and users are POSTed to on the Access API, empty for the legacy API which PUTs to the Endpoint
+func (l ListTypes) Collection() string {
+	if !l.onAccess() {
+		return ""
+	}
+	if l.AccessType == "group" {
+		return "/access/api/v2/groups"
+	}
+	return "/access/api/v2/users"
+}
+
+//Write method, path and expected status to create the item, or with exists to update it
+func (l ListTypes) Write(exists bool) (string, string, int) {
+	switch {
+	case l.isProject():
+		return l.projectWrite(exists)
+	case l.onAccess() && exists:
+		return "PATCH", l.Endpoint(), 200
+	case l.onAccess():
+		return "POST", l.Collection(), 201
+	case l.AccessType == "group" || l.AccessType == "user":
+		return "PUT", l.Endpoint(), 201
+	}
+	return "PUT", l.Endpoint(), 200
+}
+
+//AccessBody what an Access API GET returned for a group or user, trimmed to the fields it takes back
+func AccessBody(accessType string, data []byte) ([]byte, error) {
+	item, err := decodeAccess(ListTypes{AccessType: accessType, Backend: AccessBackend}, data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(item.Body())
+}
+
+//decodeAccess a group or user returned by the Access API, into the same type the import sends
+func decodeAccess(item ListTypes, data []byte) (ListTypes, error) {
+	have := ListTypes{AccessType: item.AccessType, Name: item.Name, Backend: item.Backend}
+	switch item.AccessType {
+	case "group":
+		var group AccessGroup
+		if err := json.Unmarshal(data, &group); err != nil {
+			return have, err
+		}
+		have.Group = GroupImport{Name: group.Name, Description: group.Description, AutoJoin: group.AutoJoin, Realm: group.Realm, AdminPrivileges: group.AdminPrivileges}
+	case "user":
+		var user AccessUser
+		if err := json.Unmarshal(data, &user); err != nil {
+			return have, err
+		}
+		have.User = UserImport{Name: user.Username, Email: user.Email, Password: user.Password, Admin: user.Admin, ProfileUpdatable: user.ProfileUpdatable,
+			DisableUIAccess: user.DisableUIAccess, InternalPasswordDisabled: user.InternalPasswordDisabled, Groups: user.Groups}
+	}
+	return have, nil
+}
+
+func toAccessGroup(group GroupImport) AccessGroup {
+	return AccessGroup{Name: group.Name, Description: group.Description, AutoJoin: group.AutoJoin, AdminPrivileges: group.AdminPrivileges, Realm: group.Realm}
+}
+
+//toAccessUser the Access API has no watch or policy manager flags, those come from roles there
+func toAccessUser(user UserImport) AccessUser {
+	return AccessUser{Username: user.Name, Email: user.Email, Password: user.Password, Admin: user.Admin, ProfileUpdatable: user.ProfileUpdatable,
+		DisableUIAccess: user.DisableUIAccess, InternalPasswordDisabled: user.InternalPasswordDisabled, Groups: user.Groups}
+}
+
+//backendQueue tags every item with the backend before passing it on
+type backendQueue struct {
+	queue   Queue
+	backend string
+}
+
+func (q backendQueue) Add(item ListTypes) {
+	item.Backend = q.backend
+	q.queue.Add(item)
+}
@@ -0,0 +1,102 @@
+package access
+
+import (
+	"encoding/json"
+	"errors"
+	"security-json-import/auth"
+	"security-json-import/helpers"
+	"strconv"
+	"strings"
+)
+
+//Fetch read the target's version of item, decoded into the same type the import sends. found is false on 404
+func Fetch(creds auth.Creds, flags helpers.Flags, item ListTypes) (ListTypes, bool, error) {
+	data, found, err := FetchRaw(creds, flags, item)
+	if err != nil || !found {
+		return ListTypes{AccessType: item.AccessType, Name: item.Name, Backend: item.Backend}, false, err
+	}
+	have, err := Decode(item, data)
+	return have, err == nil, err
+}
+
+//FetchRaw read the target's version of item as it was returned. found is false on 404
+func FetchRaw(creds auth.Creds, flags helpers.Flags, item ListTypes) ([]byte, bool, error) {
+	data, respCode, _, getErr := auth.GetRestAPI("GET", true, creds.URL+item.Lookup(), creds.Username, creds.Apikey, "", nil, nil, 0, flags, nil)
+	if getErr != nil {
+		return nil, false, getErr
+	}
+	if respCode == 404 {
+		return nil, false, nil
+	}
+	if respCode != 200 {
+		return nil, false, errors.New("Error reading " + item.Key() + ", HTTP " + strconv.Itoa(respCode) + ": " + string(data) + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	return data, true, nil
+}
+
+//Decode the target's version of item into the same type the import sends
+func Decode(item ListTypes, data []byte) (ListTypes, error) {
+	if item.onAccess() || item.isProject() {
+		decode := decodeAccess
+		if item.isProject() {
+			decode = decodeProject
+		}
+		have, err := decode(item, data)
+		if err != nil {
+			return have, errors.New("Error parsing " + item.Key() + ": " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		return have, nil
+	}
+	have := ListTypes{AccessType: item.AccessType, Name: item.Name, Backend: item.Backend}
+	var err error
+	switch item.AccessType {
+	case "group":
+		err = json.Unmarshal(data, &have.Group)
+	case "user":
+		err = json.Unmarshal(data, &have.User)
+	case "permission":
+		err = decodePermissionV1(data, &have.Permission)
+	case "permissionV2":
+		err = json.Unmarshal(data, &have.PermissionV2)
+	}
+	if err != nil {
+		return have, errors.New("Error parsing " + item.Key() + ": " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	return have, nil
+}
+
+//permissionV1 what the v1 API returns for a permission target. The patterns come back as comma separated strings
+//rather than the lists the import sends
+type permissionV1 struct {
+	PermissionImport
+	IncludesPattern *string `json:"includesPattern"`
+	ExcludesPattern *string `json:"excludesPattern"`
+}
+
+//decodePermissionV1 a v1 permission target in the shape the import sends, whichever of the two the target returned
+func decodePermissionV1(data []byte, permission *PermissionImport) error {
+	var v1 permissionV1
+	err := json.Unmarshal(data, &v1)
+	if err != nil {
+		return err
+	}
+	*permission = v1.PermissionImport
+	if permission.IncludePatterns == nil && v1.IncludesPattern != nil {
+		permission.IncludePatterns = splitPatterns(*v1.IncludesPattern)
+	}
+	if permission.ExcludePatterns == nil && v1.ExcludesPattern != nil {
+		permission.ExcludePatterns = splitPatterns(*v1.ExcludesPattern)
+	}
+	return nil
+}
+
+//splitPatterns comma separated patterns as a list, nil if there are none
+func splitPatterns(s string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(s, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
@@ -0,0 +1,254 @@
+package access
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"security-json-import/helpers"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//ProjectImport a project, a repository attached to one, or the roles of a user or group in one
+type ProjectImport struct {
+	Key         string   `json:"project_key"`
+	DisplayName string   `json:"display_name,omitempty"`
+	Repository  string   `json:"repository,omitempty"`
+	Name        string   `json:"name,omitempty"`
+	Group       bool     `json:"group,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+	//Source permission target the roles were derived from
+	Source string `json:"source,omitempty"`
+}
+
+//ProjectMapping -projectMappingFile, which repositories belong to which project and the role each action gives
+type ProjectMapping struct {
+	Projects []ProjectMappingEntry `json:"projects"`
+	//Roles role per permission display name, on top of defaultRoles
+	Roles map[string]string `json:"roles"`
+}
+
+//ProjectMappingEntry one project and the repository keys or glob patterns in it. Create makes the project if it is missing
+type ProjectMappingEntry struct {
+	Key          string   `json:"key"`
+	DisplayName  string   `json:"displayName"`
+	Create       bool     `json:"create"`
+	Repositories []string `json:"repositories"`
+}
+
+//actionOrder permission display names from most to least powerful, a member gets the role of the first one they have
+var actionOrder = []string{"manage", "distribute", "delete", "write", "managedXrayMeta", "annotate", "read"}
+
+//defaultRoles the built in project roles closest to each action
+var defaultRoles = map[string]string{"manage": "Project Admin", "distribute": "Release Manager", "delete": "Developer", "write": "Contributor", "annotate": "Viewer", "read": "Viewer"}
+
+//ReadProjectMapping load and check a project mapping file
+func ReadProjectMapping(file string) (*ProjectMapping, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("Error reading project mapping: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	var mapping ProjectMapping
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, errors.New("Error parsing project mapping: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	for i, project := range mapping.Projects {
+		if project.Key == "" {
+			return nil, errors.New("Project mapping entry " + strconv.Itoa(i+1) + " has no key " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		for _, pattern := range project.Repositories {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.New("Bad repository pattern " + pattern + " for project " + project.Key + ": " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+			}
+		}
+	}
+	return &mapping, nil
+}
+
+//ProjectOf the project a repository key belongs to, the first entry that lists it wins
+func (m *ProjectMapping) ProjectOf(repoKey string) (string, bool) {
+	for _, project := range m.Projects {
+		for _, pattern := range project.Repositories {
+			if ok, _ := path.Match(pattern, repoKey); ok {
+				return project.Key, true
+			}
+		}
+	}
+	return "", false
+}
+
+//ProjectFor the project a permission target moves into, only if every one of its repositories is in that same project
+func (m *ProjectMapping) ProjectFor(repoKeys []string) (string, bool) {
+	var key string
+	for _, repo := range repoKeys {
+		//ANY, ANY LOCAL and ANY REMOTE span the whole instance
+		if strings.HasPrefix(repo, "ANY") {
+			return "", false
+		}
+		project, ok := m.ProjectOf(repo)
+		if !ok || (key != "" && project != key) {
+			return "", false
+		}
+		key = project
+	}
+	return key, key != ""
+}
+
+//RoleFor the role given by the most powerful of the actions, false if none of them maps to a role
+func (m *ProjectMapping) RoleFor(actions []string) (string, bool) {
+	have := make(map[string]bool)
+	for _, action := range actions {
+		have[action] = true
+	}
+	for _, action := range actionOrder {
+		if !have[action] {
+			continue
+		}
+		if role, ok := m.Roles[action]; ok {
+			return role, true
+		}
+		if role, ok := defaultRoles[action]; ok {
+			return role, true
+		}
+	}
+	return "", false
+}
+
+//projectQueue queues the projects to create and the repositories to attach once each
+type projectQueue struct {
+	mapping  *ProjectMapping
+	attached map[string]bool
+}
+
+func newProjectQueue(workQueue Queue, mapping *ProjectMapping) *projectQueue {
+	q := &projectQueue{mapping: mapping, attached: make(map[string]bool)}
+	for _, project := range mapping.Projects {
+		if project.Create {
+			displayName := project.DisplayName
+			if displayName == "" {
+				displayName = project.Key
+			}
+			workQueue.Add(ListTypes{AccessType: "project", Name: project.Key, Project: ProjectImport{Key: project.Key, DisplayName: displayName}})
+		}
+		//plain keys are attached even if no permission target mentions them
+		for _, repo := range project.Repositories {
+			if !strings.ContainsAny(repo, "*?[") {
+				q.attach(workQueue, project.Key, repo)
+			}
+		}
+	}
+	return q
+}
+
+func (q *projectQueue) attach(workQueue Queue, key, repo string) {
+	if q.attached[repo] {
+		return
+	}
+	q.attached[repo] = true
+	workQueue.Add(ListTypes{AccessType: "projectRepository", Name: repo, Project: ProjectImport{Key: key, Repository: repo}})
+}
+
+//members turn a permission target inside a project into role assignments of its users and groups
+func (q *projectQueue) members(workQueue Queue, acl PermissionsAcls, key string) {
+	for _, repo := range acl.PermissionTarget.RepoKeys {
+		q.attach(workQueue, key, repo)
+	}
+	for _, ace := range acl.Aces {
+		role, ok := q.mapping.RoleFor(ace.PermissionsDisplayNames)
+		if !ok {
+			log.Warn("No project role for ", ace.Principal, " in permission target ", acl.PermissionTarget.Name, " with actions ", ace.PermissionsDisplayNames, ", leaving it out")
+			continue
+		}
+		member := ProjectImport{Key: key, Name: ace.Principal, Group: ace.Group, Roles: []string{role}, Source: acl.PermissionTarget.Name}
+		workQueue.Add(ListTypes{AccessType: "projectMember", Name: ace.Principal, Project: member})
+	}
+}
+
+//isProject true for the project access types
+func (l ListTypes) isProject() bool {
+	return l.AccessType == "project" || l.AccessType == "projectRepository" || l.AccessType == "projectMember"
+}
+
+//principal user or group, the kind of member a projectMember item is
+func (p ProjectImport) principal() string {
+	if p.Group {
+		return "group"
+	}
+	return "user"
+}
+
+//projectEndpoint where a project item lives. For attached repositories that is the detach path
+func (l ListTypes) projectEndpoint() string {
+	switch l.AccessType {
+	case "project":
+		return "/access/api/v1/projects/" + l.Project.Key
+	case "projectRepository":
+		return "/access/api/v1/projects/_/attach/repositories/" + l.Project.Repository
+	}
+	return "/access/api/v1/projects/" + l.Project.Key + "/" + l.Project.principal() + "s/" + l.Project.Name
+}
+
+//Lookup path the target's version of the item is read from, the repository configuration for attached repositories
+func (l ListTypes) Lookup() string {
+	if l.AccessType == "projectRepository" {
+		return "/api/repositories/" + l.Project.Repository
+	}
+	return l.Endpoint()
+}
+
+//projectBody what the projects API takes, nothing for attaching a repository
+func (l ListTypes) projectBody() interface{} {
+	switch l.AccessType {
+	case "project":
+		return struct {
+			Key         string `json:"project_key"`
+			DisplayName string `json:"display_name"`
+		}{l.Project.Key, l.Project.DisplayName}
+	case "projectMember":
+		return struct {
+			Name  string   `json:"name"`
+			Roles []string `json:"roles"`
+		}{l.Project.Name, l.Project.Roles}
+	}
+	return nil
+}
+
+//projectWrite method, path and expected status for a project item
+func (l ListTypes) projectWrite(exists bool) (string, string, int) {
+	switch {
+	case l.AccessType == "project" && exists:
+		return "PUT", l.Endpoint(), 200
+	case l.AccessType == "project":
+		return "POST", "/access/api/v1/projects", 201
+	case l.AccessType == "projectRepository":
+		return "PUT", l.Endpoint() + "/" + l.Project.Key, 204
+	}
+	return "PUT", l.Endpoint(), 200
+}
+
+//decodeProject the target's version of a project item. An attached repository is read from its configuration
+func decodeProject(item ListTypes, data []byte) (ListTypes, error) {
+	have := ListTypes{AccessType: item.AccessType, Name: item.Name, Project: item.Project}
+	switch item.AccessType {
+	case "project":
+		have.Project = ProjectImport{}
+		err := json.Unmarshal(data, &have.Project)
+		return have, err
+	case "projectRepository":
+		var repo struct {
+			ProjectKey string `json:"projectKey"`
+		}
+		err := json.Unmarshal(data, &repo)
+		have.Project.Key = repo.ProjectKey
+		return have, err
+	}
+	var member struct {
+		Roles []string `json:"roles"`
+	}
+	err := json.Unmarshal(data, &member)
+	have.Project.Roles = member.Roles
+	return have, err
+}
@@ -0,0 +1,129 @@
+package access
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+//SecurityJSONHandlers callbacks fired while streaming security.json
+type SecurityJSONHandlers struct {
+	Group      func(index int, group GroupData) error
+	RepoAcl    func(index int, acl PermissionsAcls) error
+	BuildAcl   func(index int, acl PermissionsAcls) error
+	BeforeAcls func() error
+}
+
+//StreamSecurityJSON walks security.json once, decoding one group or acl at a time so memory stays flat
+func StreamSecurityJSON(r io.Reader, handlers SecurityJSONHandlers) error {
+	dec := json.NewDecoder(r)
+	return streamObject(dec, func(key string) error {
+		switch key {
+		case "groups":
+			if handlers.Group == nil {
+				return skipValue(dec)
+			}
+			return streamArray(dec, func(i int) error {
+				var group GroupData
+				if err := dec.Decode(&group); err != nil {
+					return err
+				}
+				return handlers.Group(i, group)
+			})
+		case "repoAcls", "buildAcls":
+			handler := handlers.RepoAcl
+			if key == "buildAcls" {
+				handler = handlers.BuildAcl
+			}
+			if handler == nil {
+				return skipValue(dec)
+			}
+			if handlers.BeforeAcls != nil {
+				if err := handlers.BeforeAcls(); err != nil {
+					return err
+				}
+			}
+			return streamArray(dec, func(i int) error {
+				var acl PermissionsAcls
+				if err := dec.Decode(&acl); err != nil {
+					return err
+				}
+				return handler(i, acl)
+			})
+		default:
+			return skipValue(dec)
+		}
+	})
+}
+
+//streamObject calls fn for every key of the next object, fn must consume exactly one value
+func streamObject(dec *json.Decoder, fn func(key string) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("expected JSON object, got %v at offset %d", tok, dec.InputOffset())
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("expected object key, got %v at offset %d", tok, dec.InputOffset())
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	_, err = dec.Token()
+	return err
+}
+
+//streamArray calls fn for every element of the next array, fn must consume exactly one value
+func streamArray(dec *json.Decoder, fn func(index int) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("expected JSON array, got %v at offset %d", tok, dec.InputOffset())
+	}
+	for i := 0; dec.More(); i++ {
+		if err := fn(i); err != nil {
+			return err
+		}
+	}
+	_, err = dec.Token()
+	return err
+}
+
+//skipValue discards the next value token by token without buffering it
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if delim, ok := tok.(json.Delim); ok {
+			switch delim {
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+			}
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
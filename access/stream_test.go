@@ -0,0 +1,158 @@
+package access
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//events stream s, recording every callback as type:index:name
+func events(s string) ([]string, error) {
+	var got []string
+	err := StreamSecurityJSON(strings.NewReader(s), SecurityJSONHandlers{
+		Group: func(i int, group GroupData) error {
+			got = append(got, "group:"+strconv.Itoa(i)+":"+group.GroupName)
+			return nil
+		},
+		RepoAcl: func(i int, acl PermissionsAcls) error {
+			got = append(got, "repo:"+strconv.Itoa(i)+":"+acl.PermissionTarget.Name)
+			return nil
+		},
+		BuildAcl: func(i int, acl PermissionsAcls) error {
+			got = append(got, "build:"+strconv.Itoa(i)+":"+acl.PermissionTarget.Name)
+			return nil
+		},
+		BeforeAcls: func() error {
+			got = append(got, "acls")
+			return nil
+		},
+	})
+	return got, err
+}
+
+func TestStreamSecurityJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want []string
+	}{
+		{"in order", `{"groups":[{"groupName":"a"},{"groupName":"b"}],"repoAcls":[{"permissionTarget":{"name":"p"}}],"buildAcls":[{"permissionTarget":{"name":"q"}}]}`,
+			[]string{"group:0:a", "group:1:b", "acls", "repo:0:p", "acls", "build:0:q"}},
+		{"acls before groups", `{"buildAcls":[{"permissionTarget":{"name":"q"}}],"repoAcls":[{"permissionTarget":{"name":"p"}}],"groups":[{"groupName":"a"}]}`,
+			[]string{"acls", "build:0:q", "acls", "repo:0:p", "group:0:a"}},
+		{"unknown keys are skipped whatever they hold", `{"version":"7","users":[{"name":"x","groups":["a"]}],"groups":[{"groupName":"a","extra":{"deep":[1,[2,{"k":null}]]}}],"ldapSettings":{},"n":1.5,"ok":true,"nothing":null}`,
+			[]string{"group:0:a"}},
+		{"null and empty arrays", `{"groups":null,"repoAcls":[],"buildAcls":null}`, []string{"acls", "acls"}},
+		{"empty object", `{}`, nil},
+		{"null document", `null`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := events(tt.json)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("StreamSecurityJSON() fired %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamSecurityJSONErrors(t *testing.T) {
+	full := `{"groups":[{"groupName":"a"},{"groupName":"b"}],"repoAcls":[{"permissionTarget":{"name":"p"}}]}`
+	//every cut short of the whole file is an error, never a silently shorter import
+	for i := 0; i < len(full); i++ {
+		if _, err := events(full[:i]); err == nil {
+			t.Errorf("StreamSecurityJSON(%q) = nil error, want one for truncated input", full[:i])
+		}
+	}
+	tests := []struct {
+		name string
+		json string
+	}{
+		{"not an object", `[{"groupName":"a"}]`},
+		{"groups not an array", `{"groups":{"groupName":"a"}}`},
+		{"acls not an array", `{"repoAcls":"p"}`},
+		{"group of the wrong type", `{"groups":[{"groupName":1}]}`},
+		{"garbage", `{"groups":[{"groupName":"a"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := events(tt.json); err == nil {
+				t.Errorf("StreamSecurityJSON(%s) = nil error, want one", tt.json)
+			}
+		})
+	}
+}
+
+func TestStreamSecurityJSONSkipsWithoutHandler(t *testing.T) {
+	var groups []string
+	err := StreamSecurityJSON(strings.NewReader(`{"repoAcls":[{"permissionTarget":{"name":"p"}}],"groups":[{"groupName":"a"}],"buildAcls":[{"x":[{}]}]}`), SecurityJSONHandlers{
+		Group: func(i int, group GroupData) error {
+			groups = append(groups, group.GroupName)
+			return nil
+		},
+		BeforeAcls: func() error {
+			t.Error("BeforeAcls called without an acl handler")
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(groups, []string{"a"}) {
+		t.Errorf("groups = %v, want [a]", groups)
+	}
+}
+
+//names collects the keys of what is queued
+type names []string
+
+func (n *names) Add(item ListTypes) {
+	*n = append(*n, item.Key())
+}
+
+func TestCreateUsers(t *testing.T) {
+	fromGroups := `{"groups":[{"name":"devs","userNames":["bob","alice@example.com"]},{"name":"ops","userNames":["bob"]}]}`
+	withGroups := `{"users":[{"name":"bob","groups":["devs","ops"]},{"name":"alice"}]}`
+	read := map[string]func(q Queue, s string) error{
+		"from groups": func(q Queue, s string) error { return CreateUsersFromGroups(q, strings.NewReader(s), "@example.com") },
+		"with groups": func(q Queue, s string) error { return CreateUsersWithGroups(q, strings.NewReader(s)) },
+	}
+	tests := []struct {
+		name string
+		read string
+		json string
+		want []string
+	}{
+		{"users from groups", "from groups", fromGroups, []string{"user/bob", "user/alice@example.com", "user/bob"}},
+		{"users with groups", "with groups", withGroups, []string{"user/bob", "user/alice"}},
+		{"unknown keys", "with groups", `{"version":1,"users":[{"name":"bob"}],"groups":[{"name":"devs"}]}`, []string{"user/bob"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got names
+			if err := read[tt.read](&got, tt.json); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual([]string(got), tt.want) {
+				t.Errorf("queued %v, want %v", got, tt.want)
+			}
+		})
+	}
+	//a truncated or malformed file is an error, never a silently shorter import
+	for name, full := range map[string]string{"from groups": fromGroups, "with groups": withGroups} {
+		for i := 0; i < len(full); i++ {
+			var got names
+			if err := read[name](&got, full[:i]); err == nil {
+				t.Errorf("reading users %s from %q = nil error, want one for truncated input", name, full[:i])
+			}
+		}
+		var got names
+		if err := read[name](&got, `{"users":[{"name":1}],"groups":[{"name":1}]}`); err == nil {
+			t.Errorf("reading users %s with a name of the wrong type = nil error, want one", name)
+		}
+	}
+}
@@ -2,13 +2,15 @@ package auth
 
 import (
 	"bytes"
+	"errors"
 	"io"
-	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
 	"security-json-import/helpers"
+	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -21,142 +23,163 @@ type Creds struct {
 	Apikey   string
 }
 
-// VerifyAPIKey for errors
+// VerifyAPIKey for errors. Ping answers anonymous callers too, so the credentials are also tried on the
+//admin only group list, which fails if the -authMode does not fit them
 func VerifyAPIKey(urlInput, userName, apiKey string, flags helpers.Flags) (bool, error) {
-	log.Debug("starting VerifyAPIkey request. Testing:", userName)
+	log.Debug("starting VerifyAPIkey request. Testing:", userName, " with auth mode ", flags.AuthModeVar)
 	//TODO need to sanitize invalid url strings, esp in custom flag
-	data, _, _, err := GetRestAPI("GET", true, urlInput+"/api/system/ping", userName, apiKey, "", nil, nil, 1, flags, nil)
+	data, _, _, err := GetRestAPI("GET", true, urlInput+"/api/system/ping", userName, apiKey, "", nil, nil, 0, flags, nil)
 	if err != nil {
 		return false, err
 	}
-	if string(data) == "OK" {
-		log.Debug("finished VerifyAPIkey request. Credentials are good to go.")
-		return true, nil
+	if string(data) != "OK" {
+		log.Warn("Received unexpected response:", string(data), " against ", urlInput+"/api/system/ping. Double check your URL and credentials.")
+		return false, nil
 	}
-	log.Warn("Received unexpected response:", string(data), " against ", urlInput+"/api/system/ping. Double check your URL and credentials.")
-	return false, nil
+	_, respCode, _, err := GetRestAPI("GET", true, urlInput+"/api/security/groups", userName, apiKey, "", nil, nil, 0, flags, nil)
+	if err != nil {
+		return false, err
+	}
+	if respCode != http.StatusOK {
+		log.Warn("Received ", respCode, " against ", urlInput+"/api/security/groups with auth mode ", flags.AuthModeVar, ". The credentials need to be valid for that mode and belong to an admin.")
+		return false, nil
+	}
+	log.Debug("finished VerifyAPIkey request. Credentials are good to go.")
+	return true, nil
 }
 
-//GetRestAPI GET rest APIs response with error handling
+//GetRestAPI GET rest APIs response with error handling. Retries according to the RetryPolicy ConfigureRetry parsed,
+//retry being the attempts already used and err the error of the last one, if any. Once out of retries it returns
+//the final response, or the errors of every attempt if there was none
 func GetRestAPI(method string, auth bool, urlInput, userName, apiKey, providedfilepath string, jsonBody []byte, header map[string]string, retry int, flags helpers.Flags, err error) ([]byte, int, http.Header, error) {
-	if retry > flags.HTTPRetryMaxVar {
-		log.Error("Exceeded retry limit, cancelling further attempts")
-		return nil, 0, nil, err
+	policy, policyErr := retryPolicy(flags)
+	if policyErr != nil {
+		return nil, 0, nil, policyErr
+	}
+	var errs []string
+	if err != nil {
+		errs = append(errs, err.Error())
 	}
 
-	body := new(bytes.Buffer)
+	var body []byte
 	//PUT upload file
 	if method == "PUT" && providedfilepath != "" {
-		//req.Header.Set()
+		buf := new(bytes.Buffer)
 		file, err := os.Open(providedfilepath)
 		helpers.Check(err, false, "open", helpers.Trace())
 		defer file.Close()
 
-		writer := multipart.NewWriter(body)
+		writer := multipart.NewWriter(buf)
 
 		part, err := writer.CreateFormFile("file", filepath.Base(providedfilepath))
 		helpers.Check(err, false, "create", helpers.Trace())
 		io.Copy(part, file)
 		err = writer.Close()
 		helpers.Check(err, false, "writer close", helpers.Trace())
-	} else if method == "PUT" && jsonBody != nil {
-		body = bytes.NewBuffer(jsonBody)
+		body = buf.Bytes()
+	} else if (method == "PUT" || method == "POST" || method == "PATCH") && jsonBody != nil {
+		body = jsonBody
+	}
+
+	limit := limitFor(urlInput, flags)
+	start := time.Now()
+	for attempt := retry + 1; ; attempt++ {
+		done := limit.acquire()
+		data, statusCode, headers, err := doRequest(flags, method, auth, urlInput, userName, apiKey, providedfilepath, body, header)
+		done(statusCode, err)
+		if err == nil && !policy.Retryable(method, statusCode) {
+			return data, statusCode, headers, nil
+		}
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+			errs = append(errs, "attempt "+strconv.Itoa(attempt)+": "+reason)
+		} else {
+			reason = "HTTP " + strconv.Itoa(statusCode)
+		}
+		if err != nil && !idempotent(method) {
+			//it may have gone through before the connection broke, sending it again could apply it twice
+			log.Error("Not retrying ", method, " request for ", urlInput, " after: ", reason)
+			return nil, 0, nil, errors.New(method + " " + urlInput + " failed: " + strings.Join(errs, "; "))
+		}
+		delay := policy.Backoff(attempt-retry, headers)
+		if attempt >= policy.MaxAttempts || (policy.MaxElapsed > 0 && time.Since(start)+delay > policy.MaxElapsed) {
+			log.Error("Exceeded retry limit on ", method, " request for ", urlInput, " after ", attempt, " attempts, last: ", reason)
+			if err != nil {
+				return nil, 0, nil, errors.New(method + " " + urlInput + " failed after " + strconv.Itoa(attempt) + " attempts: " + strings.Join(errs, "; "))
+			}
+			return data, statusCode, headers, nil
+		}
+		log.Warn("Received ", reason, " on ", method, " request for ", urlInput, ", retrying in ", delay.Round(time.Millisecond), ", attempt ", attempt)
+		time.Sleep(delay)
 	}
+}
 
-	client := http.Client{}
-	req, err := http.NewRequest(method, urlInput, body)
+//doRequest send one request. Only errors before a status was received count as errors
+func doRequest(flags helpers.Flags, method string, auth bool, urlInput, userName, apiKey, providedfilepath string, body []byte, header map[string]string) ([]byte, int, http.Header, error) {
+	client := sharedClient(flags)
+	req, err := http.NewRequest(method, urlInput, bytes.NewReader(body))
+	if err != nil {
+		log.Warn("The HTTP request failed with error", err)
+		return nil, 0, nil, err
+	}
 
-	//https://stackoverflow.com/questions/17714494/golang-http-request-results-in-eof-errors-when-making-multiple-requests-successi
-	req.Close = true
 	if auth {
-		req.SetBasicAuth(userName, apiKey)
+		setAuth(req, flags, userName, apiKey)
 	}
 	for x, y := range header {
 		log.Debug("Recieved extra header:", x+":"+y)
 		req.Header.Set(x, y)
 	}
 
+	resp, err := client.Do(req)
 	if err != nil {
-		log.Warn("The HTTP request failed with error", err)
-	} else {
-
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Warn("The HTTP request failed with error:", err)
-			time.Sleep(time.Duration(flags.HTTPSleepSecondsVar) * time.Second)
-			GetRestAPI(method, auth, urlInput, userName, apiKey, providedfilepath, jsonBody, header, retry+1, flags, err)
-		}
-		// need to account for 403s with xray, or other 403s, 429? 204 is bad too (no content for docker)
-		if resp == nil {
-			log.Error("Returning error due to nil response on request:", err)
-			return nil, 0, nil, err
-		}
-		switch resp.StatusCode {
-		case 200:
-			log.Debug("Received ", resp.StatusCode, " OK on ", method, " request for ", urlInput, " continuing")
-		case 201:
-			if method == "PUT" {
-				log.Debug("Received ", resp.StatusCode, " ", method, " request for ", urlInput, " continuing")
-			}
-		case 403:
-			log.Error("Received ", resp.StatusCode, " Forbidden on ", method, " request for ", urlInput, " continuing")
-			// should we try retry here? probably not
-		case 404:
-			log.Debug("Received ", resp.StatusCode, " Not Found on ", method, " request for ", urlInput, " continuing")
-		case 429:
-			log.Error("Received ", resp.StatusCode, " Too Many Requests on ", method, " request for ", urlInput, ", sleeping then retrying, attempt ", retry)
-			time.Sleep(time.Duration(flags.HTTPSleepSecondsVar) * time.Second)
-			GetRestAPI(method, auth, urlInput, userName, apiKey, providedfilepath, jsonBody, header, retry+1, flags, err)
-		case 204:
-			if method == "GET" {
-				log.Error("Received ", resp.StatusCode, " No Content on ", method, " request for ", urlInput, ", sleeping then retrying")
-				time.Sleep(10 * time.Second)
-				GetRestAPI(method, auth, urlInput, userName, apiKey, providedfilepath, jsonBody, header, retry+1, flags, err)
-			} else {
-				log.Debug("Received ", resp.StatusCode, " OK on ", method, " request for ", urlInput, " continuing")
-			}
-		case 500:
-			log.Error("Received ", resp.StatusCode, " Internal Server error on ", method, " request for ", urlInput, " failing out")
-			return nil, resp.StatusCode, nil, err
-		case 502:
-			log.Error("Received ", resp.StatusCode, " Internal Server error on ", method, " request for ", urlInput, " failing out")
-			return nil, resp.StatusCode, nil, err
-		case 503:
-			log.Error("Received ", resp.StatusCode, " Internal Server error on ", method, " request for ", urlInput, " failing out")
-			return nil, resp.StatusCode, nil, err
-		default:
-			log.Warn("Received ", resp.StatusCode, " on ", method, " request for ", urlInput, " continuing")
-		}
-		//Mostly for HEAD requests
-		statusCode := resp.StatusCode
-		headers := resp.Header
-
-		if providedfilepath != "" && method == "GET" {
-			// Create the file
-			out, err := os.Create(providedfilepath)
-			helpers.Check(err, false, "File create:"+providedfilepath, helpers.Trace())
-			defer out.Close()
-
-			//done := make(chan int64)
-			//go helpers.PrintDownloadPercent(done, filepath, int64(resp.ContentLength))
-			_, err = io.Copy(out, resp.Body)
-			helpers.Check(err, false, "The file copy:"+providedfilepath, helpers.Trace())
-
-			//return OK after copy is done
-			return nil, 0, nil, nil
-		} else {
-			//maybe skip the download or retry if error here, like EOF
-			data, err := ioutil.ReadAll(resp.Body)
-			helpers.Check(err, false, "Data read:"+urlInput, helpers.Trace())
-			if err != nil {
-				log.Warn("Data Read on ", urlInput, " failed with:", err, ", sleeping then retrying, attempt:", retry)
-				time.Sleep(time.Duration(flags.HTTPSleepSecondsVar) * time.Second)
-
-				GetRestAPI(method, auth, urlInput, userName, apiKey, providedfilepath, jsonBody, header, retry+1, flags, err)
-			}
-
-			return data, statusCode, headers, nil
+		log.Warn("The HTTP request failed with error:", err)
+		return nil, 0, nil, err
+	}
+	defer resp.Body.Close()
+	// need to account for 403s with xray, or other 403s, 429? 204 is bad too (no content for docker)
+	switch resp.StatusCode {
+	case 200:
+		log.Debug("Received ", resp.StatusCode, " OK on ", method, " request for ", urlInput, " continuing")
+	case 201:
+		if method == "PUT" {
+			log.Debug("Received ", resp.StatusCode, " ", method, " request for ", urlInput, " continuing")
 		}
+	case 403:
+		log.Error("Received ", resp.StatusCode, " Forbidden on ", method, " request for ", urlInput, " continuing")
+	case 404:
+		log.Debug("Received ", resp.StatusCode, " Not Found on ", method, " request for ", urlInput, " continuing")
+	case 204:
+		log.Debug("Received ", resp.StatusCode, " No Content on ", method, " request for ", urlInput)
+	case 429, 500, 502, 503, 504:
+		log.Debug("Received ", resp.StatusCode, " on ", method, " request for ", urlInput)
+	default:
+		log.Warn("Received ", resp.StatusCode, " on ", method, " request for ", urlInput, " continuing")
+	}
+	//Mostly for HEAD requests
+	statusCode := resp.StatusCode
+	headers := resp.Header
+
+	if providedfilepath != "" && method == "GET" {
+		// Create the file
+		out, err := os.Create(providedfilepath)
+		helpers.Check(err, false, "File create:"+providedfilepath, helpers.Trace())
+		defer out.Close()
+
+		//done := make(chan int64)
+		//go helpers.PrintDownloadPercent(done, filepath, int64(resp.ContentLength))
+		_, err = io.Copy(out, resp.Body)
+		helpers.Check(err, false, "The file copy:"+providedfilepath, helpers.Trace())
+
+		//return OK after copy is done
+		return nil, 0, nil, nil
+	}
+	//maybe skip the download or retry if error here, like EOF
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Warn("Data Read on ", urlInput, " failed with:", err)
+		return nil, 0, nil, err
 	}
-	return nil, 0, nil, err
+	return data, statusCode, headers, nil
 }
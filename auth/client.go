@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"security-json-import/helpers"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var clientOnce sync.Once
+var client *http.Client
+var clientErr error
+
+//ConfigureClient build the shared client from flags, so bad TLS or proxy settings are reported before anything is sent
+func ConfigureClient(flags helpers.Flags) error {
+	clientOnce.Do(func() {
+		client, clientErr = newClient(flags)
+	})
+	return clientErr
+}
+
+//sharedClient one client for the whole run so connections are kept alive and reused, set up from flags on first use
+func sharedClient(flags helpers.Flags) *http.Client {
+	if err := ConfigureClient(flags); err != nil {
+		//main refuses to start with a broken config, this only happens to callers that skipped ConfigureClient
+		log.Error("Falling back to the default HTTP client: ", err)
+		return &http.Client{Timeout: flags.HTTPTimeoutVar}
+	}
+	return client
+}
+
+//newClient client with keep alive, TLS and proxy set up from flags
+func newClient(flags helpers.Flags) (*http.Client, error) {
+	idle := flags.WorkersVar
+	if idle < 2 {
+		idle = 2
+	}
+	tlsConfig, err := tlsConfigFromFlags(flags)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := proxyFromFlags(flags)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:   tlsConfig,
+		ForceAttemptHTTP2: true,
+		//every worker keeps its connection between requests
+		MaxIdleConnsPerHost:   idle,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &http.Client{Transport: transport, Timeout: flags.HTTPTimeoutVar}, nil
+}
+
+//tlsConfigFromFlags system roots plus -caCert, the -clientCert for mutual TLS, and -insecureSkipVerify
+func tlsConfigFromFlags(flags helpers.Flags) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if flags.CACertVar != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(flags.CACertVar)
+		if err != nil {
+			return nil, errors.New("Error reading CA certificate: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No PEM certificates found in " + flags.CACertVar + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		config.RootCAs = pool
+	}
+	if (flags.ClientCertVar == "") != (flags.ClientKeyVar == "") {
+		return nil, errors.New("-clientCert and -clientKey go together " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	if flags.ClientCertVar != "" {
+		cert, err := tls.LoadX509KeyPair(flags.ClientCertVar, flags.ClientKeyVar)
+		if err != nil {
+			return nil, errors.New("Error loading client certificate: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if flags.InsecureSkipVerifyVar {
+		log.Warn("TLS certificates are not verified, anyone in between can read the credentials. Only use -insecureSkipVerify in a lab")
+		config.InsecureSkipVerify = true
+	}
+	return config, nil
+}
+
+//proxyFromFlags -proxy for every host not in -noProxy. Without -proxy the HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+//environment variables apply, still skipping -noProxy
+func proxyFromFlags(flags helpers.Flags) (func(*http.Request) (*url.URL, error), error) {
+	var proxyURL *url.URL
+	if flags.ProxyVar != "" {
+		var err error
+		proxyURL, err = url.Parse(flags.ProxyVar)
+		if err != nil || proxyURL.Host == "" {
+			if err == nil {
+				err = errors.New("no host")
+			}
+			return nil, errors.New("Invalid -proxy " + flags.ProxyVar + ": " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+	}
+	var noProxy []string
+	for _, entry := range strings.Split(flags.NoProxyVar, ",") {
+		if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" {
+			noProxy = append(noProxy, entry)
+		}
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(noProxy, req.URL) {
+			return nil, nil
+		}
+		if proxyURL != nil {
+			return proxyURL, nil
+		}
+		return http.ProxyFromEnvironment(req)
+	}, nil
+}
+
+//bypassProxy true if the host matches a no proxy entry: * for all, an IP or CIDR range, a host with or without port,
+//or a domain that also covers its subdomains, with or without a leading dot. IPv6 entries may be in brackets, and a
+//url without a port has the default port of its scheme
+func bypassProxy(noProxy []string, u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+	ip := net.ParseIP(host)
+	for _, entry := range noProxy {
+		if entry == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		entryHost, entryPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			entryHost, entryPort = entry, ""
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		entryHost = strings.TrimSuffix(strings.TrimPrefix(entryHost, "["), "]")
+		if entryIP := net.ParseIP(entryHost); entryIP != nil {
+			//2001:db8::1 and 2001:0db8:0:0::1 are the same address
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		entryHost = strings.TrimPrefix(entryHost, ".")
+		if host == entryHost || strings.HasSuffix(host, "."+entryHost) {
+			return true
+		}
+	}
+	return false
+}
+
+//idempotent true if sending the request twice does no harm, so it can be retried after a connection error
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
+		return true
+	}
+	return false
+}
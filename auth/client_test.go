@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"net/http"
+	"net/url"
+	"security-json-import/helpers"
+	"testing"
+)
+
+func TestBypassProxy(t *testing.T) {
+	tests := []struct {
+		noProxy []string
+		url     string
+		want    bool
+	}{
+		{nil, "https://art.example.com", false},
+		{[]string{"*"}, "https://art.example.com", true},
+		{[]string{"art.example.com"}, "https://art.example.com/artifactory", true},
+		{[]string{"art.example.com"}, "https://ART.example.com", true},
+		{[]string{"art.example.com"}, "https://other.example.com", false},
+		{[]string{"example.com"}, "https://art.example.com", true},
+		{[]string{".example.com"}, "https://art.example.com", true},
+		{[]string{".example.com"}, "https://example.com", true},
+		{[]string{"example.com"}, "https://badexample.com", false},
+		{[]string{"art.example.com:8081"}, "http://art.example.com:8081", true},
+		{[]string{"art.example.com:8081"}, "http://art.example.com:8082", false},
+		{[]string{"art.example.com:443"}, "https://art.example.com", true},
+		{[]string{"art.example.com:80"}, "http://art.example.com", true},
+		{[]string{"art.example.com:80"}, "https://art.example.com", false},
+		{[]string{"10.0.0.5"}, "http://10.0.0.5:8081", true},
+		{[]string{"10.0.0.5"}, "http://110.0.0.5", false},
+		{[]string{"10.0.0.0/8"}, "http://10.1.2.3", true},
+		{[]string{"10.0.0.0/8"}, "http://11.1.2.3", false},
+		{[]string{"10.0.0.0/8"}, "http://ten.example.com", false},
+		{[]string{"192.168.1.0/24"}, "http://192.168.1.200:8081", true},
+		{[]string{"::1"}, "http://[::1]:8081", true},
+		{[]string{"[::1]"}, "http://[::1]:8081", true},
+		{[]string{"[::1]:8081"}, "http://[::1]:8081", true},
+		{[]string{"[::1]:8081"}, "http://[::1]:8082", false},
+		{[]string{"2001:db8::1"}, "http://[2001:0db8:0:0::1]", true},
+		{[]string{"fd00::/8"}, "http://[fd12:3456::1]", true},
+		{[]string{"fd00::/8"}, "http://[fe80::1]", false},
+		{[]string{"fd00::/8"}, "http://10.1.2.3", false},
+		{[]string{"other", "example.com"}, "https://art.example.com", true},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bypassProxy(tt.noProxy, u); got != tt.want {
+			t.Errorf("bypassProxy(%v, %s) = %v, want %v", tt.noProxy, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestProxyFromFlags(t *testing.T) {
+	flags := helpers.DefaultFlags()
+	flags.ProxyVar = "http://proxy.example.com:3128"
+	flags.NoProxyVar = " Art.Example.com , ,10.0.0.0/8"
+	proxy, err := proxyFromFlags(flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://art.example.com/artifactory", ""},
+		{"http://10.1.2.3", ""},
+		{"https://other.example.com", "http://proxy.example.com:3128"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		got, err := proxy(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (got == nil && tt.want != "") || (got != nil && got.String() != tt.want) {
+			t.Errorf("proxy(%s) = %v, want %q", tt.url, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"proxy.example.com:3128", "://nope"} {
+		flags.ProxyVar = bad
+		if _, err := proxyFromFlags(flags); err == nil {
+			t.Errorf("proxyFromFlags(-proxy %s) = nil error, want one", bad)
+		}
+	}
+}
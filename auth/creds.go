@@ -0,0 +1,352 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"security-json-import/helpers"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//ResolveCreds fill -user and -apikey when they were not given on the command line. The secret comes from the first of
+//-tokenFile, stdin, the -tokenEnv variable, the credential helper and the netrc file that has one
+func ResolveCreds(flags *helpers.Flags) error {
+	if flags.UsernameVar == "" && flags.UserEnvVar != "" {
+		flags.UsernameVar = strings.TrimSpace(os.Getenv(flags.UserEnvVar))
+	}
+	if flags.ApikeyVar != "" && (flags.TokenFileVar != "" || flags.APIKeyStdinVar) {
+		return errors.New("Use only one of -apikey, -tokenFile and -apikeyStdin " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	if flags.TokenFileVar != "" && flags.APIKeyStdinVar {
+		return errors.New("Use only one of -apikey, -tokenFile and -apikeyStdin " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	if flags.ApikeyVar != "" {
+		return nil
+	}
+
+	switch {
+	case flags.TokenFileVar != "":
+		data, err := os.ReadFile(flags.TokenFileVar)
+		if err != nil {
+			return errors.New("Error reading token file: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		flags.ApikeyVar = strings.TrimSpace(string(data))
+		if flags.ApikeyVar == "" {
+			return errors.New("Token file " + flags.TokenFileVar + " is empty " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		return nil
+	case flags.APIKeyStdinVar:
+		if helpers.Interactive() {
+			fmt.Fprint(os.Stderr, "Secret for ", flags.UsernameVar, ": ")
+		}
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		flags.ApikeyVar = strings.TrimSpace(line)
+		if flags.ApikeyVar == "" {
+			if err == nil {
+				err = errors.New("empty line")
+			}
+			return errors.New("Error reading the secret from stdin: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		return nil
+	}
+
+	if flags.TokenEnvVar != "" {
+		if secret := strings.TrimSpace(os.Getenv(flags.TokenEnvVar)); secret != "" {
+			flags.ApikeyVar = secret
+			return nil
+		}
+	}
+	if flags.URLVar == "" {
+		//nothing to look the host up by, the missing flags are reported later
+		return nil
+	}
+	if flags.CredentialHelperVar != "" {
+		user, secret, err := credentialHelper(flags.CredentialHelperVar, flags.URLVar, flags.UsernameVar)
+		if err != nil {
+			return err
+		}
+		if secret != "" {
+			setCreds(flags, user, secret)
+			return nil
+		}
+	}
+	user, secret, err := netrc(flags.NetrcFileVar, flags.URLVar, flags.UsernameVar)
+	if err != nil {
+		return err
+	}
+	setCreds(flags, user, secret)
+	return nil
+}
+
+//setCreds take the secret, and the user unless one was already given
+func setCreds(flags *helpers.Flags, user, secret string) {
+	flags.ApikeyVar = secret
+	if flags.UsernameVar == "" {
+		flags.UsernameVar = user
+	}
+}
+
+//credentialHelper ask an external command for the creds of the url, speaking git's credential helper protocol:
+//the command is run with get, fed protocol, host and username lines and answers with username and password lines
+func credentialHelper(command, urlInput, userName string) (string, string, error) {
+	u, err := url.Parse(urlInput)
+	if err != nil {
+		return "", "", errors.New("Error parsing url for the credential helper: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", "", errors.New("-credentialHelper is blank " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	cmd := exec.Command(args[0], append(args[1:], "get")...)
+	input := "protocol=" + u.Scheme + "\nhost=" + u.Host + "\n"
+	if userName != "" {
+		input += "username=" + userName + "\n"
+	}
+	cmd.Stdin = strings.NewReader(input + "\n")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", "", errors.New("Error running credential helper " + args[0] + ": " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	var user, secret string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "username":
+			user = value
+		case "password":
+			secret = value
+		}
+	}
+	log.Debug("credential helper ", args[0], " answered for ", u.Host, " with user ", user)
+	return user, secret, nil
+}
+
+//netrc login and password of the url host from a netrc file, the default entry if the host has none. When a user
+//is known only its entry counts. path defaults to $NETRC, then ~/.netrc, and a missing file is no error
+func netrc(path, urlInput, userName string) (string, string, error) {
+	explicit := path != ""
+	if path == "" {
+		path = os.Getenv("NETRC")
+	}
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", nil
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return "", "", nil
+		}
+		return "", "", errors.New("Error reading netrc: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	u, err := url.Parse(urlInput)
+	if err != nil {
+		return "", "", errors.New("Error parsing url for netrc: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+
+	//tokens can be spread over lines, only comments and macro definitions are line based
+	var tokens []string
+	var macro bool
+	for _, line := range strings.Split(string(data), "\n") {
+		//a macro definition runs until the next blank line
+		if macro {
+			macro = strings.TrimSpace(line) != ""
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			if strings.HasPrefix(field, "#") {
+				break
+			}
+			if field == "macdef" {
+				macro = true
+				break
+			}
+			tokens = append(tokens, field)
+		}
+	}
+
+	type entry struct{ machine, login, password string }
+	var entries []*entry
+	var current *entry
+	for i := 0; i < len(tokens); i++ {
+		var value string
+		if i+1 < len(tokens) {
+			value = tokens[i+1]
+		}
+		switch tokens[i] {
+		case "machine":
+			current = &entry{machine: value}
+			entries = append(entries, current)
+			i++
+		case "default":
+			current = &entry{}
+			entries = append(entries, current)
+		case "login":
+			if current != nil {
+				current.login = value
+			}
+			i++
+		case "password":
+			if current != nil {
+				current.password = value
+			}
+			i++
+		case "account":
+			i++
+		}
+	}
+
+	var fallback *entry
+	for _, e := range entries {
+		if userName != "" && e.login != userName {
+			continue
+		}
+		if e.machine == u.Hostname() || e.machine == u.Host {
+			log.Debug("using netrc entry from ", path, " for ", u.Host)
+			return e.login, e.password, nil
+		}
+		if e.machine == "" && fallback == nil {
+			fallback = e
+		}
+	}
+	if fallback != nil {
+		log.Debug("using netrc default entry from ", path)
+		return fallback.login, fallback.password, nil
+	}
+	return "", "", nil
+}
+
+//CredsFile structured creds file. Comments are allowed, like in the JSON config of editors
+type CredsFile struct {
+	Credentials []CredsEntry `json:"credentials"`
+}
+
+//CredsEntry one user of a creds file, with exactly one of the secrets
+type CredsEntry struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+	Apikey   string `json:"apikey"`
+}
+
+//ReadCredsFile the user and secret pairs of a creds file, in file order. A file starting with { is read as JSON with
+//comments, anything else as the legacy format of one user and secret per line, separated by whitespace
+func ReadCredsFile(path string, flags helpers.Flags) (map[int][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("Error reading creds file: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	if stat, err := os.Stat(path); err == nil && stat.Mode().Perm()&0077 != 0 {
+		log.Warn("Creds file ", path, " can be read by other users, consider chmod 600")
+	}
+
+	creds := make(map[int][]string)
+	if trimmed := bytes.TrimSpace(stripComments(data)); len(trimmed) > 0 && trimmed[0] == '{' {
+		var file CredsFile
+		dec := json.NewDecoder(bytes.NewReader(trimmed))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&file); err != nil {
+			return nil, errors.New("Error parsing creds file: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		for i, entry := range file.Credentials {
+			var secrets []string
+			for _, secret := range []string{entry.Password, entry.Token, entry.Apikey} {
+				if secret != "" {
+					secrets = append(secrets, secret)
+				}
+			}
+			if len(secrets) != 1 {
+				return nil, errors.New("Creds file entry " + strconv.Itoa(i+1) + " needs exactly one of password, token or apikey " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+			}
+			if entry.User == "" && NeedsUser(flags) {
+				return nil, errors.New("Creds file entry " + strconv.Itoa(i+1) + " has no user, which only -authMode bearer can do without " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+			}
+			creds[len(creds)] = []string{entry.User, secrets[0]}
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for line := 1; scanner.Scan(); line++ {
+			fields := strings.Fields(scanner.Text())
+			switch {
+			case len(fields) == 0:
+				continue
+			case len(fields) == 1 && !NeedsUser(flags):
+				//a token on its own line, the token says who we are
+				fields = []string{"", fields[0]}
+			case len(fields) != 2:
+				return nil, errors.New("Invalid creds file line " + strconv.Itoa(line) + ", expected a user and a secret separated by whitespace. Use the JSON format for secrets with spaces " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+			}
+			creds[len(creds)] = fields
+		}
+	}
+	if len(creds) == 0 {
+		return nil, errors.New("No creds in creds file " + path + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	return creds, nil
+}
+
+//stripComments blank out // and /* */ comments outside of JSON strings, and # comments at the start of a line
+func stripComments(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	var inString, escaped bool
+	lineStart := true
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inString {
+			out = append(out, c)
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		switch {
+		case c == '"':
+			inString = true
+		case c == '#' && lineStart, c == '/' && i+1 < len(data) && data[i+1] == '/':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			if i < len(data) {
+				out = append(out, '\n')
+			}
+			lineStart = true
+			continue
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				return append(out, data[i:]...)
+			}
+			i += end + 3
+			continue
+		}
+		out = append(out, c)
+		if c == '\n' {
+			lineStart = true
+		} else if c != ' ' && c != '\t' && c != '\r' {
+			lineStart = false
+		}
+	}
+	return out
+}
@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"security-json-import/helpers"
+	"testing"
+)
+
+//writeFile a file with data in a temporary directory, readable by the owner only
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNetrc(t *testing.T) {
+	tests := []struct {
+		name     string
+		netrc    string
+		url      string
+		user     string
+		login    string
+		password string
+	}{
+		{"machine on one line", "machine art.example.com login bob password s3cret\n", "https://art.example.com/artifactory", "", "bob", "s3cret"},
+		{"tokens over several lines", "machine art.example.com\n  login bob\n  password s3cret\n", "https://art.example.com", "", "bob", "s3cret"},
+		{"token and value on separate lines", "machine\nart.example.com\nlogin\nbob\npassword\ns3cret\n", "https://art.example.com", "", "bob", "s3cret"},
+		{"other machines are ignored", "machine other login alice password a\nmachine art.example.com login bob password b\n", "https://art.example.com", "", "bob", "b"},
+		{"default entry when the host has none", "machine other login alice password a\ndefault login bob password b\n", "https://art.example.com", "", "bob", "b"},
+		{"host entry wins over an earlier default", "default login bob password b\nmachine art.example.com login carol password c\n", "https://art.example.com", "", "carol", "c"},
+		{"default only", "default login bob password b", "https://art.example.com", "", "bob", "b"},
+		{"host with port", "machine art.example.com:8081 login bob password b\n", "http://art.example.com:8081", "", "bob", "b"},
+		{"hostname matches a url with port", "machine art.example.com login bob password b\n", "http://art.example.com:8081", "", "bob", "b"},
+		{"given user picks its entry", "machine art.example.com login alice password a\nmachine art.example.com login bob password b\n", "https://art.example.com", "bob", "bob", "b"},
+		{"given user not in the file", "machine art.example.com login alice password a\n", "https://art.example.com", "bob", "", ""},
+		{"account is skipped", "machine art.example.com login bob account acct password b\n", "https://art.example.com", "", "bob", "b"},
+		{"comments", "# machine art.example.com login mallory password m\nmachine art.example.com login bob password b # trailing\n", "https://art.example.com", "", "bob", "b"},
+		{"macro bodies are skipped", "macdef init\nmachine art.example.com login mallory password m\n\nmachine art.example.com login bob password b\n", "https://art.example.com", "", "bob", "b"},
+		{"no entry", "machine other login alice password a\n", "https://art.example.com", "", "", ""},
+		{"empty", "", "https://art.example.com", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, "netrc", tt.netrc)
+			login, password, err := netrc(path, tt.url, tt.user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if login != tt.login || password != tt.password {
+				t.Errorf("netrc() = %q, %q, want %q, %q", login, password, tt.login, tt.password)
+			}
+		})
+	}
+}
+
+func TestNetrcFile(t *testing.T) {
+	if _, _, err := netrc(filepath.Join(t.TempDir(), "missing"), "https://art.example.com", ""); err == nil {
+		t.Error("netrc() of a missing -netrcFile = nil error, want one")
+	}
+	dir := t.TempDir()
+	t.Setenv("NETRC", filepath.Join(dir, "missing"))
+	if login, _, err := netrc("", "https://art.example.com", ""); err != nil || login != "" {
+		t.Errorf("netrc() without a default file = %q, %v, want nothing and no error", login, err)
+	}
+	t.Setenv("NETRC", writeFile(t, "netrc", "machine art.example.com login bob password b\n"))
+	if login, _, err := netrc("", "https://art.example.com", ""); err != nil || login != "bob" {
+		t.Errorf("netrc() from $NETRC = %q, %v, want bob", login, err)
+	}
+}
+
+func TestStripComments(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"line comment", "{\"a\": 1} // one\n", "{\"a\": 1} \n"},
+		{"line comment at the end", "{\"a\": 1} // one", "{\"a\": 1} "},
+		{"hash at the start of a line", "# header\n  # indented\n{}", "\n  \n{}"},
+		{"hash inside a line is kept", "{\"a\": 1 # not a comment\n}", "{\"a\": 1 # not a comment\n}"},
+		{"block comment", "{/* one\ntwo */\"a\": 1}", "{\"a\": 1}"},
+		{"unterminated block comment", "{\"a\": 1} /* open", "{\"a\": 1} /* open"},
+		{"slashes inside strings", `{"url": "https://art.example.com//x", "p": "a/*b*/c"}`, `{"url": "https://art.example.com//x", "p": "a/*b*/c"}`},
+		{"hash inside strings", "{\"p\":\n\"# secret\"}", "{\"p\":\n\"# secret\"}"},
+		{"escaped quotes", `{"p": "a\"//b", "q": "c\\"} // d`, `{"p": "a\"//b", "q": "c\\"} `},
+		{"single slash", `{"p": 1/2}`, `{"p": 1/2}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(stripComments([]byte(tt.in))); got != tt.want {
+				t.Errorf("stripComments(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadCredsFile(t *testing.T) {
+	basic := helpers.DefaultFlags()
+	bearer := helpers.DefaultFlags()
+	bearer.AuthModeVar = BearerMode
+	tests := []struct {
+		name    string
+		data    string
+		flags   helpers.Flags
+		want    map[int][]string
+		wantErr bool
+	}{
+		{"legacy", "bob s3cret\n\nalice pass\n", basic, map[int][]string{0: {"bob", "s3cret"}, 1: {"alice", "pass"}}, false},
+		{"legacy secret with comment characters", "bob pa//ss#1\n", basic, map[int][]string{0: {"bob", "pa//ss#1"}}, false},
+		{"legacy token alone with bearer", "tok3n\n", bearer, map[int][]string{0: {"", "tok3n"}}, false},
+		{"legacy token alone needs bearer", "tok3n\n", basic, nil, true},
+		{"legacy secret with spaces", "bob pass word\n", basic, nil, true},
+		{"json with comments", `// users
+{
+  # one per line
+  "credentials": [
+    {"user": "bob", "password": "pa//ss /* not a comment */"}, /* the next */
+    {"user": "alice", "apikey": "AKC"}
+  ]
+}`, basic, map[int][]string{0: {"bob", "pa//ss /* not a comment */"}, 1: {"alice", "AKC"}}, false},
+		{"json token without user with bearer", `{"credentials": [{"token": "t"}]}`, bearer, map[int][]string{0: {"", "t"}}, false},
+		{"json without user", `{"credentials": [{"password": "p"}]}`, basic, nil, true},
+		{"json with two secrets", `{"credentials": [{"user": "bob", "password": "p", "token": "t"}]}`, basic, nil, true},
+		{"json with no secret", `{"credentials": [{"user": "bob"}]}`, basic, nil, true},
+		{"json with an unknown field", `{"credentials": [{"user": "bob", "pasword": "p"}]}`, basic, nil, true},
+		{"empty", "\n", basic, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadCredsFile(writeFile(t, "creds", tt.data), tt.flags)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadCredsFile() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadCredsFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCredentialHelper(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("helper is a shell script")
+	}
+	//echoes what it was asked back in the answer, so the request can be checked
+	script := writeFile(t, "helper.sh", `#!/bin/sh
+[ "$1" = get ] || exit 1
+while read -r line && [ -n "$line" ]; do
+	case "$line" in
+	host=*) host=${line#host=} ;;
+	protocol=*) protocol=${line#protocol=} ;;
+	username=*) user=${line#username=} ;;
+	esac
+done
+echo "protocol=$protocol"
+echo "host=$host"
+echo "username=${user:-helper-user}"
+echo "password=$protocol-$host=x"
+echo "garbage"
+`)
+	tests := []struct {
+		name    string
+		command string
+		url     string
+		user    string
+		want    []string
+		wantErr bool
+	}{
+		{"host and protocol", "sh " + script, "https://art.example.com/artifactory", "", []string{"helper-user", "https-art.example.com=x"}, false},
+		{"port is part of the host", "sh " + script, "http://art.example.com:8081/artifactory", "", []string{"helper-user", "http-art.example.com:8081=x"}, false},
+		{"known user is passed on", "sh " + script, "https://art.example.com", "bob", []string{"bob", "https-art.example.com=x"}, false},
+		{"helper fails", "false", "https://art.example.com", "", nil, true},
+		{"helper missing", filepath.Join(t.TempDir(), "missing"), "https://art.example.com", "", nil, true},
+		{"blank command", "  ", "https://art.example.com", "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, secret, err := credentialHelper(tt.command, tt.url, tt.user)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("credentialHelper() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual([]string{user, secret}, tt.want) {
+				t.Errorf("credentialHelper() = %q, %q, want %q", user, secret, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveCreds(t *testing.T) {
+	netrcFile := writeFile(t, "netrc", "machine art.example.com login bob password from-netrc\n")
+	tokenFile := writeFile(t, "token", "  from-file\n")
+	tests := []struct {
+		name       string
+		set        func(flags *helpers.Flags)
+		env        string
+		user, want string
+		wantErr    bool
+	}{
+		{"given on the command line", func(f *helpers.Flags) { f.ApikeyVar = "given" }, "from-env", "", "given", false},
+		{"token file", func(f *helpers.Flags) { f.TokenFileVar = tokenFile }, "from-env", "", "from-file", false},
+		{"token file and apikey", func(f *helpers.Flags) { f.TokenFileVar, f.ApikeyVar = tokenFile, "given" }, "", "", "", true},
+		{"environment before netrc", func(f *helpers.Flags) {}, "from-env", "", "from-env", false},
+		{"netrc with its user", func(f *helpers.Flags) {}, "", "bob", "from-netrc", false},
+		{"netrc entry of another user", func(f *helpers.Flags) { f.UsernameVar = "alice" }, "", "alice", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SJI_TEST_TOKEN", tt.env)
+			flags := helpers.DefaultFlags()
+			flags.URLVar = "https://art.example.com/artifactory"
+			flags.TokenEnvVar = "SJI_TEST_TOKEN"
+			flags.UserEnvVar = ""
+			flags.NetrcFileVar = netrcFile
+			tt.set(&flags)
+			err := ResolveCreds(&flags)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveCreds() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if flags.ApikeyVar != tt.want || flags.UsernameVar != tt.user {
+				t.Errorf("ResolveCreds() gave %q, %q, want %q, %q", flags.UsernameVar, flags.ApikeyVar, tt.user, tt.want)
+			}
+		})
+	}
+}
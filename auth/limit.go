@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"math"
+	"net/url"
+	"security-json-import/helpers"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//hostLimit throttling of the requests to one host, shared by every worker
+type hostLimit struct {
+	host     string
+	bucket   *tokenBucket
+	adaptive *adaptiveLimit
+}
+
+var limitsMu sync.Mutex
+var limits = make(map[string]*hostLimit)
+
+//limitFor the throttling of the host in urlInput, set up from -maxRPS and -adaptiveConcurrency on first use
+func limitFor(urlInput string, flags helpers.Flags) *hostLimit {
+	host := urlInput
+	if u, err := url.Parse(urlInput); err == nil {
+		host = u.Host
+	}
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+	l, ok := limits[host]
+	if !ok {
+		l = &hostLimit{host: host}
+		if flags.MaxRPSVar > 0 {
+			l.bucket = &tokenBucket{rate: flags.MaxRPSVar, burst: math.Max(1, flags.MaxRPSVar), tokens: math.Max(1, flags.MaxRPSVar), last: time.Now()}
+		}
+		if flags.AdaptiveConcurrencyVar {
+			l.adaptive = newAdaptiveLimit(host, flags.WorkersVar)
+		}
+		limits[host] = l
+	}
+	return l
+}
+
+//acquire wait for a token and a concurrency slot, call done with the outcome once the response is in
+func (l *hostLimit) acquire() func(statusCode int, err error) {
+	if l.bucket != nil {
+		l.bucket.wait()
+	}
+	if l.adaptive == nil {
+		return func(int, error) {}
+	}
+	started := l.adaptive.acquire()
+	return func(statusCode int, err error) {
+		l.adaptive.release(started, statusCode, err)
+	}
+}
+
+//ThrottleStatus one line per throttled host with the current concurrency and how many requests waited, empty without throttling
+func ThrottleStatus() []string {
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+	var lines []string
+	for _, l := range limits {
+		var parts []string
+		if l.adaptive != nil {
+			limit, inflight := l.adaptive.status()
+			parts = append(parts, "concurrency "+strconv.Itoa(limit)+" of "+strconv.Itoa(l.adaptive.max), strconv.Itoa(inflight)+" in flight")
+		}
+		if l.bucket != nil {
+			parts = append(parts, strconv.Itoa(l.bucket.delayed())+" requests delayed by -maxRPS")
+		}
+		if len(parts) > 0 {
+			lines = append(lines, l.host+": "+strings.Join(parts, ", "))
+		}
+	}
+	return lines
+}
+
+//tokenBucket allows rate requests per second with bursts of up to burst
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	waited int
+}
+
+//wait take a token, sleeping until there is one. Tokens are reserved up front so waiters queue up fairly
+func (b *tokenBucket) wait() {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+		b.waited++
+	}
+	b.mu.Unlock()
+	if delay > 0 {
+		log.Trace("rate limited, waiting ", delay)
+		time.Sleep(delay)
+	}
+}
+
+func (b *tokenBucket) delayed() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.waited
+}
+
+//adaptiveLimit additive increase, multiplicative decrease of the requests in flight. 429s, 5xx, connection
+//errors and responses much slower than usual halve it, every success grows it by about one per round trip
+type adaptiveLimit struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	host     string
+	limit    float64
+	max      int
+	inflight int
+	//latency moving average of successful responses
+	latency time.Duration
+	samples int
+	//lastCut requests started before the last decrease do not count against the new limit
+	lastCut time.Time
+}
+
+func newAdaptiveLimit(host string, max int) *adaptiveLimit {
+	if max < 1 {
+		max = 1
+	}
+	a := &adaptiveLimit{host: host, limit: float64(max), max: max}
+	a.cond = sync.NewCond(&a.mu)
+	return a
+}
+
+func (a *adaptiveLimit) acquire() time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for a.inflight >= int(a.limit) {
+		a.cond.Wait()
+	}
+	a.inflight++
+	return time.Now()
+}
+
+func (a *adaptiveLimit) release(started time.Time, statusCode int, err error) {
+	elapsed := time.Since(started)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.inflight--
+	defer a.cond.Broadcast()
+
+	reason := ""
+	switch {
+	case err != nil:
+		reason = "connection error"
+	case statusCode == 429 || statusCode >= 500:
+		reason = "HTTP " + strconv.Itoa(statusCode)
+	case a.samples >= 20 && elapsed > 4*a.latency && elapsed > 2*time.Second:
+		reason = "slow response " + elapsed.Round(time.Millisecond).String()
+	}
+	if reason != "" {
+		if started.Before(a.lastCut) {
+			return
+		}
+		old := int(a.limit)
+		a.limit = math.Max(1, a.limit/2)
+		a.lastCut = time.Now()
+		log.Warn("Throttling ", a.host, " after ", reason, ", concurrency ", old, " -> ", int(a.limit))
+		return
+	}
+	if a.samples == 0 {
+		a.latency = elapsed
+	} else {
+		a.latency = (a.latency*9 + elapsed) / 10
+	}
+	a.samples++
+	if int(a.limit) < a.max {
+		old := int(a.limit)
+		a.limit = math.Min(float64(a.max), a.limit+1/a.limit)
+		if int(a.limit) > old {
+			log.Debug("Concurrency for ", a.host, " up to ", int(a.limit))
+			if int(a.limit) == a.max {
+				log.Info("Concurrency for ", a.host, " back to ", a.max)
+			}
+		}
+	}
+}
+
+func (a *adaptiveLimit) status() (int, int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return int(a.limit), a.inflight
+}
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"security-json-import/helpers"
+	"strconv"
+)
+
+//auth modes, how the secret of a user is sent
+const (
+	BasicMode        = "basic"
+	BearerMode       = "bearer"
+	APIKeyHeaderMode = "apikey-header"
+)
+
+//CheckAuthMode error if -authMode is not one we know
+func CheckAuthMode(flags helpers.Flags) error {
+	switch flags.AuthModeVar {
+	case BasicMode, BearerMode, APIKeyHeaderMode:
+		return nil
+	}
+	return errors.New("Unknown -authMode " + flags.AuthModeVar + ", expected " + BasicMode + ", " + BearerMode + " or " + APIKeyHeaderMode + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+}
+
+//NeedsUser false if the secret alone identifies the caller, as access tokens do
+func NeedsUser(flags helpers.Flags) bool {
+	return flags.AuthModeVar != BearerMode
+}
+
+//setAuth add the secret to the request the way -authMode asks for
+func setAuth(req *http.Request, flags helpers.Flags, userName, secret string) {
+	switch flags.AuthModeVar {
+	case BearerMode:
+		req.Header.Set("Authorization", "Bearer "+secret)
+	case APIKeyHeaderMode:
+		req.Header.Set("X-JFrog-Art-Api", secret)
+	default:
+		req.SetBasicAuth(userName, secret)
+	}
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"security-json-import/helpers"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//RetryPolicy when and how long GetRestAPI waits before trying a request again
+type RetryPolicy struct {
+	//MaxAttempts including the first one
+	MaxAttempts int
+	//BaseDelay the first retry waits about this long, doubling on every further attempt up to MaxDelay
+	BaseDelay, MaxDelay time.Duration
+	//MaxElapsed no retry is started that would end after this long since the first attempt
+	MaxElapsed time.Duration
+	//Rules statuses worth retrying, with the methods they apply to or nil for every method
+	Rules map[int][]string
+}
+
+var retryOnce sync.Once
+var retryConfig RetryPolicy
+var retryErr error
+
+//ConfigureRetry parse the retry flags once for the whole run, so a bad -retryStatus is reported before anything is sent
+func ConfigureRetry(flags helpers.Flags) error {
+	retryOnce.Do(func() {
+		retryConfig, retryErr = RetryPolicyFromFlags(flags)
+	})
+	return retryErr
+}
+
+//retryPolicy the policy ConfigureRetry parsed, parsed from flags on first use by callers that skipped it
+func retryPolicy(flags helpers.Flags) (RetryPolicy, error) {
+	err := ConfigureRetry(flags)
+	return retryConfig, err
+}
+
+//RetryPolicyFromFlags -retry, -httpSleep, -retryMaxDelay, -retryMaxElapsed and -retryStatus
+func RetryPolicyFromFlags(flags helpers.Flags) (RetryPolicy, error) {
+	rules, err := ParseRetryStatus(flags.RetryStatusVar)
+	if err != nil {
+		return RetryPolicy{}, err
+	}
+	return RetryPolicy{
+		MaxAttempts: flags.HTTPRetryMaxVar + 1,
+		BaseDelay:   time.Duration(flags.HTTPSleepSecondsVar) * time.Second,
+		MaxDelay:    flags.RetryMaxDelayVar,
+		MaxElapsed:  flags.RetryMaxElapsedVar,
+		Rules:       rules,
+	}, nil
+}
+
+//ParseRetryStatus comma separated statuses, each optionally limited to some methods, e.g. 204:GET,429,503:GET|HEAD
+func ParseRetryStatus(list string) (map[int][]string, error) {
+	rules := make(map[int][]string)
+	for _, rule := range strings.Split(list, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		parts := strings.SplitN(rule, ":", 2)
+		status, err := strconv.Atoi(parts[0])
+		if err != nil || status < 100 || status > 599 {
+			return nil, errors.New("Invalid -retryStatus rule " + rule + ", expected a status like 503 or 204:GET")
+		}
+		var methods []string
+		if len(parts) == 2 {
+			methods = strings.Split(strings.ToUpper(parts[1]), "|")
+			for _, method := range methods {
+				if method == "" {
+					return nil, errors.New("Invalid -retryStatus rule " + rule + ", expected methods like 204:GET or 500:GET|HEAD")
+				}
+			}
+		}
+		rules[status] = methods
+	}
+	return rules, nil
+}
+
+//Retryable true if a response with this status should be tried again
+func (p RetryPolicy) Retryable(method string, status int) bool {
+	methods, ok := p.Rules[status]
+	if !ok {
+		return false
+	}
+	if methods == nil {
+		return true
+	}
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+//Backoff how long to wait before the given retry, 1 being the first. Exponential with jitter,
+//or what the server asked for in Retry-After if that is longer
+func (p RetryPolicy) Backoff(retry int, headers http.Header) time.Duration {
+	backoff := p.BaseDelay
+	for i := 1; i < retry && (p.MaxDelay <= 0 || backoff < p.MaxDelay); i++ {
+		backoff *= 2
+	}
+	if p.MaxDelay > 0 && backoff > p.MaxDelay {
+		backoff = p.MaxDelay
+	}
+	//half fixed, half random, so workers that failed together do not come back together
+	delay := backoff / 2
+	if backoff > 1 {
+		delay += time.Duration(rand.Int63n(int64(backoff - delay)))
+	}
+	if after := retryAfter(headers); after > delay {
+		delay = after
+	}
+	return delay
+}
+
+//retryAfter the Retry-After header in seconds or as an HTTP date, 0 without one
+func retryAfter(headers http.Header) time.Duration {
+	value := headers.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
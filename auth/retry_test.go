@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRetryStatus(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    map[int][]string
+		wantErr bool
+	}{
+		{"", map[int][]string{}, false},
+		{"503", map[int][]string{503: nil}, false},
+		{"204:GET,429, 502 ,503:get|head", map[int][]string{204: {"GET"}, 429: nil, 502: nil, 503: {"GET", "HEAD"}}, false},
+		{"503,,504", map[int][]string{503: nil, 504: nil}, false},
+		{"abc", nil, true},
+		{"99", nil, true},
+		{"600", nil, true},
+		{"503:", nil, true},
+		{"503:GET|", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRetryStatus(tt.list)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRetryStatus(%q) error = %v, want error %v", tt.list, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseRetryStatus(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	rules, err := ParseRetryStatus("204:GET,429,500:GET|HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := RetryPolicy{Rules: rules}
+	tests := []struct {
+		method string
+		status int
+		want   bool
+	}{
+		{"GET", 204, true},
+		{"PUT", 204, false},
+		{"POST", 429, true},
+		{"HEAD", 500, true},
+		{"PUT", 500, false},
+		{"GET", 200, false},
+		{"GET", 404, false},
+	}
+	for _, tt := range tests {
+		if got := p.Retryable(tt.method, tt.status); got != tt.want {
+			t.Errorf("Retryable(%s, %d) = %v, want %v", tt.method, tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{BaseDelay: time.Second, MaxDelay: 4 * time.Second}
+	tests := []struct {
+		retry    int
+		min, max time.Duration
+	}{
+		{1, 500 * time.Millisecond, time.Second},
+		{2, time.Second, 2 * time.Second},
+		{3, 2 * time.Second, 4 * time.Second},
+		//capped at MaxDelay
+		{4, 2 * time.Second, 4 * time.Second},
+		{50, 2 * time.Second, 4 * time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			got := p.Backoff(tt.retry, nil)
+			if got < tt.min || got >= tt.max {
+				t.Errorf("Backoff(%d) = %v, want in [%v, %v)", tt.retry, got, tt.min, tt.max)
+				break
+			}
+		}
+	}
+
+	uncapped := RetryPolicy{BaseDelay: time.Second}
+	if got := uncapped.Backoff(5, nil); got < 8*time.Second || got >= 16*time.Second {
+		t.Errorf("Backoff(5) without MaxDelay = %v, want in [8s, 16s)", got)
+	}
+	if got := (RetryPolicy{}).Backoff(3, nil); got != 0 {
+		t.Errorf("Backoff without BaseDelay = %v, want 0", got)
+	}
+}
+
+func TestBackoffRetryAfter(t *testing.T) {
+	p := RetryPolicy{BaseDelay: time.Second, MaxDelay: 4 * time.Second}
+	header := func(value string) http.Header {
+		h := http.Header{}
+		h.Set("Retry-After", value)
+		return h
+	}
+	tests := []struct {
+		name     string
+		headers  http.Header
+		min, max time.Duration
+	}{
+		{"seconds longer than the backoff win", header("30"), 30 * time.Second, 30 * time.Second},
+		{"seconds shorter than the backoff lose", header("0"), 500 * time.Millisecond, time.Second},
+		{"date", header(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)), 55 * time.Second, time.Minute},
+		{"date in the past", header(time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)), 500 * time.Millisecond, time.Second},
+		{"garbage", header("soon"), 500 * time.Millisecond, time.Second},
+		{"none", http.Header{}, 500 * time.Millisecond, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := p.Backoff(1, tt.headers)
+			if got < tt.min || got > tt.max {
+				t.Errorf("Backoff() = %v, want in [%v, %v]", got, tt.min, tt.max)
+			}
+		})
+	}
+}
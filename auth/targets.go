@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"security-json-import/helpers"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Target one instance to import into. Without a secret of its own it uses -user and -apikey, or whatever -credentialHelper
+//and the netrc file have for its host
+type Target struct {
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	User      string `json:"user"`
+	Password  string `json:"password"`
+	Token     string `json:"token"`
+	Apikey    string `json:"apikey"`
+	CredsFile string `json:"credsFile"`
+}
+
+//TargetsFile the -targetsFile. Comments are allowed, like in the creds file
+type TargetsFile struct {
+	Targets []Target `json:"targets"`
+}
+
+//ReadTargets the instances to import into, from -targetsFile or the comma separated -url. Names default to the host
+//and port, and are unique, they tell the journals and failure reports of the targets apart
+func ReadTargets(flags helpers.Flags) ([]Target, error) {
+	var targets []Target
+	switch {
+	case flags.TargetsFileVar != "" && flags.URLVar != "":
+		return nil, errors.New("Use either -url or -targetsFile " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	case flags.TargetsFileVar != "":
+		data, err := os.ReadFile(flags.TargetsFileVar)
+		if err != nil {
+			return nil, errors.New("Error reading targets file: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		var file TargetsFile
+		dec := json.NewDecoder(bytes.NewReader(stripComments(data)))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&file); err != nil {
+			return nil, errors.New("Error parsing targets file: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		targets = file.Targets
+		if len(targets) == 0 {
+			return nil, errors.New("No targets in targets file " + flags.TargetsFileVar + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		for _, t := range targets {
+			if stat, err := os.Stat(flags.TargetsFileVar); err == nil && stat.Mode().Perm()&0077 != 0 && t.Secret() != "" {
+				log.Warn("Targets file ", flags.TargetsFileVar, " holds secrets and can be read by other users, consider chmod 600")
+				break
+			}
+		}
+	default:
+		for _, u := range strings.Split(flags.URLVar, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				targets = append(targets, Target{URL: u})
+			}
+		}
+	}
+
+	names := make(map[string]bool)
+	for i := range targets {
+		t := &targets[i]
+		t.URL = strings.TrimSuffix(t.URL, "/")
+		parsed, err := url.Parse(t.URL)
+		if t.URL == "" || err != nil || parsed.Host == "" {
+			return nil, errors.New("Target " + strconv.Itoa(i+1) + " needs a url like https://host/artifactory, not " + t.URL + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		var secrets int
+		for _, secret := range []string{t.Password, t.Token, t.Apikey} {
+			if secret != "" {
+				secrets++
+			}
+		}
+		if secrets > 1 {
+			return nil, errors.New("Target " + strconv.Itoa(i+1) + " has more than one of password, token and apikey " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		if t.Name == "" {
+			t.Name = parsed.Hostname()
+			if parsed.Port() != "" {
+				t.Name += "-" + parsed.Port()
+			}
+		}
+		//names go into the paths of the journal and failure report of the target
+		if strings.ContainsAny(t.Name, `/\`) || strings.Contains(t.Name, "..") || strings.TrimSpace(t.Name) != t.Name {
+			return nil, errors.New("Target " + strconv.Itoa(i+1) + " name " + strconv.Quote(t.Name) + " may not contain /, \\, .. or surrounding spaces " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		name := t.Name
+		for n := 2; names[name]; n++ {
+			name = t.Name + "-" + strconv.Itoa(n)
+		}
+		t.Name = name
+		names[name] = true
+	}
+	return targets, nil
+}
+
+//Secret the password, token or API key of the target
+func (t Target) Secret() string {
+	return t.Password + t.Token + t.Apikey
+}
+
+//TargetFlags flags with -url, -user, -apikey and -credsFile set for the target, its own credentials winning over the
+//ones given for all targets
+func TargetFlags(flags helpers.Flags, target Target) (helpers.Flags, error) {
+	flags.URLVar = target.URL
+	if target.CredsFile != "" {
+		flags.CredsFileVar = target.CredsFile
+	}
+	if target.User != "" {
+		flags.UsernameVar = target.User
+	}
+	if target.Secret() != "" {
+		flags.ApikeyVar = target.Secret()
+		return flags, nil
+	}
+	if flags.ApikeyVar != "" {
+		return flags, nil
+	}
+	err := ResolveCreds(&flags)
+	return flags, err
+}
+
+//ResolveSharedCreds the part of ResolveCreds that does not depend on the host, for several targets. What is left is
+//looked up per target by TargetFlags
+func ResolveSharedCreds(flags *helpers.Flags) error {
+	shared := *flags
+	shared.URLVar = ""
+	if err := ResolveCreds(&shared); err != nil {
+		return err
+	}
+	flags.UsernameVar = shared.UsernameVar
+	flags.ApikeyVar = shared.ApikeyVar
+	//read once, not again for every target
+	flags.TokenFileVar = ""
+	flags.APIKeyStdinVar = false
+	return nil
+}
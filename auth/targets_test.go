@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"reflect"
+	"security-json-import/helpers"
+	"testing"
+)
+
+func TestReadTargets(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		file    string
+		want    []string
+		wantErr bool
+	}{
+		{"names from host and port", "https://prod/artifactory, http://dr:8081/artifactory/", "", []string{"prod", "dr-8081"}, false},
+		{"same host twice", "https://prod/a,https://prod/b", "", []string{"prod", "prod-2"}, false},
+		{"given names", "", `{"targets": [{"name": "prod", "url": "https://prod"}, {"url": "https://dr"}]}`, []string{"prod", "dr"}, false},
+		{"name with a slash", "", `{"targets": [{"name": "a/b", "url": "https://prod"}]}`, nil, true},
+		{"name with a backslash", "", `{"targets": [{"name": "a\\b", "url": "https://prod"}]}`, nil, true},
+		{"name going up", "", `{"targets": [{"name": "..", "url": "https://prod"}]}`, nil, true},
+		{"name with spaces around", "", `{"targets": [{"name": " prod", "url": "https://prod"}]}`, nil, true},
+		{"no url", "", `{"targets": [{"name": "prod"}]}`, nil, true},
+		{"two secrets", "", `{"targets": [{"url": "https://prod", "token": "t", "apikey": "a"}]}`, nil, true},
+		{"no targets", "", `{"targets": []}`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := helpers.DefaultFlags()
+			flags.URLVar = tt.url
+			if tt.file != "" {
+				flags.TargetsFileVar = writeFile(t, "targets.json", tt.file)
+			}
+			targets, err := ReadTargets(flags)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadTargets() error = %v, want error %v", err, tt.wantErr)
+			}
+			var names []string
+			for _, target := range targets {
+				names = append(names, target.Name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("ReadTargets() names = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
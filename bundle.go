@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"security-json-import/access"
+	"security-json-import/bundle"
+	"security-json-import/helpers"
+	"security-json-import/journal"
+	"security-json-import/plan"
+	"security-json-import/repository"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//bundleSecurityJSON read the source as an import into -targetVersion would and write every request into a bundle,
+//for apply to import on a target this machine cannot reach. Nothing is sent anywhere
+func bundleSecurityJSON(flags helpers.Flags, startTime time.Time) {
+	if len(flags.Args) != 1 {
+		log.Error("bundle needs the file to write, e.g. bundle security.bundle.tgz")
+		os.Exit(helpers.ExitConfigError)
+	}
+	if missingImportFlags(flags) {
+		os.Exit(helpers.ExitConfigError)
+	}
+	path := flags.Args[0]
+	backend, err := access.BackendFor(flags.BackendVar, flags.TargetVersionVar)
+	if err != nil {
+		log.Error("Invalid -targetVersion ", flags.TargetVersionVar, ": ", err)
+		os.Exit(helpers.ExitConfigError)
+	}
+	manifest := bundle.Manifest{Tool: "security-json-import", Created: startTime.UTC(), TargetVersion: flags.TargetVersionVar, Backend: backend}
+	if !flags.SkipPermissionImportVar {
+		manifest.PermissionAPI, err = bundle.PermissionAPI(flags.TargetVersionVar)
+		if err != nil {
+			log.Error("Invalid -targetVersion ", flags.TargetVersionVar, ": ", err)
+			os.Exit(helpers.ExitConfigError)
+		}
+	}
+	inputs := map[string]string{"securityJSONFile": flags.SecurityJSONFileVar, "configXMLFile": flags.ConfigXMLFileVar, "projectMappingFile": flags.ProjectMappingFileVar}
+	if !flags.SkipUserImportVar {
+		inputs["userGroupAssocationFile"] = flags.UserGroupAssocationFileVar
+	}
+	manifest.Inputs, err = journal.HashInputs(inputs)
+	if err != nil {
+		log.Error(err)
+		os.Exit(helpers.ExitConfigError)
+	}
+	var repoConfig *repository.Config
+	if flags.ConfigXMLFileVar != "" {
+		repoConfig, err = repository.ReadConfigXML(flags.ConfigXMLFileVar)
+		if err != nil {
+			log.Error("Could not read config xml. Exiting due to:", err)
+			os.Exit(helpers.ExitConfigError)
+		}
+	}
+
+	//users listed under several groups become one request, like plan shows them
+	c := plan.NewCollector()
+	err = access.ReadSecurityJSONTargets([]access.TargetQueue{{Queue: c, Version: flags.TargetVersionVar}}, flags)
+	if err != nil {
+		log.Error(err)
+		os.Exit(helpers.ExitError)
+	}
+	items := c.Items()
+	err = bundle.Write(path, manifest, items, repoConfig)
+	if err != nil {
+		log.Error(err)
+		os.Exit(helpers.ExitError)
+	}
+	log.Info("Wrote ", len(items), " requests for ", flags.TargetVersionVar, " to ", path, ", import them with apply ", path)
+}
@@ -0,0 +1,307 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"security-json-import/access"
+	"security-json-import/helpers"
+	"security-json-import/repository"
+	"strconv"
+	"time"
+
+	"github.com/Masterminds/semver"
+)
+
+//Format version of the bundle layout, Read refuses anything newer
+const Format = 1
+
+const (
+	manifestName     = "manifest.json"
+	requestsName     = "requests.jsonl"
+	repositoriesName = "repositories.json"
+)
+
+//Manifest what a bundle holds and what it was built for, the first file in the archive
+type Manifest struct {
+	Format  int       `json:"format"`
+	Tool    string    `json:"tool"`
+	Created time.Time `json:"created"`
+	//TargetVersion the Artifactory version the requests were adapted to, Backend and PermissionAPI what that gave
+	TargetVersion string `json:"targetVersion"`
+	Backend       string `json:"backend"`
+	PermissionAPI string `json:"permissionAPI,omitempty"`
+	//Inputs sha256 of the files the bundle was built from, keyed by flag
+	Inputs   map[string]string `json:"inputs"`
+	Requests int               `json:"requests"`
+	Types    map[string]int    `json:"types"`
+	//Repositories number of repository definitions from config xml, recreated on apply if permission targets need them
+	Repositories int `json:"repositories,omitempty"`
+}
+
+//Request one planned request, in dependency order. Payload is what ItemFromPayload takes back, Method and Path
+//where it goes when the entity does not exist yet
+type Request struct {
+	Seq          int             `json:"seq"`
+	ID           string          `json:"id"`
+	Type         string          `json:"type"`
+	Name         string          `json:"name"`
+	Backend      string          `json:"backend,omitempty"`
+	Index        int             `json:"index"`
+	Method       string          `json:"method"`
+	Path         string          `json:"path"`
+	Dependencies []string        `json:"dependencies,omitempty"`
+	Payload      json.RawMessage `json:"payload"`
+}
+
+//Order items so every item comes after the ones it depends on, otherwise keeping the order they were read in
+func Order(items []access.ListTypes) []access.ListTypes {
+	byKey := make(map[string][]int)
+	for i, item := range items {
+		byKey[item.Key()] = append(byKey[item.Key()], i)
+	}
+	visited := make([]bool, len(items))
+	ordered := make([]access.ListTypes, 0, len(items))
+	var visit func(i int)
+	visit = func(i int) {
+		if visited[i] {
+			return
+		}
+		visited[i] = true
+		for _, dep := range items[i].Dependencies() {
+			for _, j := range byKey[dep] {
+				visit(j)
+			}
+		}
+		ordered = append(ordered, items[i])
+	}
+	for i := range items {
+		visit(i)
+	}
+	return ordered
+}
+
+//index the security json index of the item, for the -skip*Index flags
+func index(item access.ListTypes) int {
+	switch item.AccessType {
+	case "group":
+		return item.GroupIndex
+	case "user":
+		return item.UserIndex
+	}
+	return item.PermissionIndex
+}
+
+//Write the items as a gzipped tar at path, in dependency order, with the manifest first and the repository definitions
+//of config if there is one. Types, Requests and Repositories of the manifest are filled in
+func Write(path string, manifest Manifest, items []access.ListTypes, config *repository.Config) error {
+	var requests bytes.Buffer
+	enc := json.NewEncoder(&requests)
+	manifest.Format = Format
+	manifest.Types = make(map[string]int)
+	for seq, item := range Order(items) {
+		payload, err := json.Marshal(item.Payload())
+		if err != nil {
+			return errors.New("Error marshaling " + item.ID() + ": " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		method, endpoint, _ := item.Write(false)
+		request := Request{Seq: seq + 1, ID: item.ID(), Type: item.AccessType, Name: item.EntityName(), Backend: item.Backend, Index: index(item), Method: method, Path: endpoint, Dependencies: item.Dependencies(), Payload: payload}
+		if err := enc.Encode(request); err != nil {
+			return errors.New("Error marshaling " + item.ID() + ": " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		manifest.Types[item.AccessType]++
+		manifest.Requests++
+	}
+	var repositories []byte
+	if config != nil {
+		var err error
+		repositories, err = json.Marshal(config.Definitions)
+		if err != nil {
+			return errors.New("Error marshaling repositories: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		manifest.Repositories = len(config.Definitions)
+	}
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.New("Error marshaling manifest: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return errors.New("Error writing bundle: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	buf := bufio.NewWriter(file)
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	add := func(name string, data []byte) error {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: manifest.Created, Typeflag: tar.TypeReg})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	}
+	err = add(manifestName, manifestData)
+	if err == nil {
+		err = add(requestsName, requests.Bytes())
+	}
+	if err == nil && repositories != nil {
+		err = add(repositoriesName, repositories)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return errors.New("Error writing bundle: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	return nil
+}
+
+//Bundle a bundle read back, with its repository definitions if it has any
+type Bundle struct {
+	Path     string
+	Manifest Manifest
+	Config   *repository.Config
+	requests []byte
+}
+
+//Read the bundle at path. The requests are only parsed by Queue
+func Read(path string) (*Bundle, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New("Error reading bundle: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return nil, errors.New("Error reading bundle " + path + ", not a bundle: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	b := &Bundle{Path: path}
+	var haveManifest bool
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.New("Error reading bundle: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, errors.New("Error reading bundle: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		switch header.Name {
+		case manifestName:
+			if err := json.Unmarshal(data, &b.Manifest); err != nil {
+				return nil, errors.New("Error parsing bundle manifest: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+			}
+			haveManifest = true
+		case requestsName:
+			b.requests = data
+		case repositoriesName:
+			config := &repository.Config{}
+			if err := json.Unmarshal(data, &config.Definitions); err != nil {
+				return nil, errors.New("Error parsing bundle repositories: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+			}
+			b.Config = config
+		}
+	}
+	if !haveManifest {
+		return nil, errors.New("Error reading bundle " + path + ": no " + manifestName + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	if b.Manifest.Format > Format {
+		return nil, errors.New("Bundle " + path + " has format " + strconv.Itoa(b.Manifest.Format) + ", this version only reads up to " + strconv.Itoa(Format) + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	return b, nil
+}
+
+//PermissionAPI v2 for targets of 6.6.0 and above, v1 before, like the import picks
+func PermissionAPI(version string) (string, error) {
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return "", err
+	}
+	c, err := semver.NewConstraint(">= 6.6.0")
+	if err != nil {
+		return "", err
+	}
+	if c.Check(v) {
+		return "v2", nil
+	}
+	return "v1", nil
+}
+
+//Check error if a target of the given version cannot take the requests as they were adapted, e.g. v2 permission
+//targets before 6.6.0. Returns the backend to write groups and users with: the one backend, the -backend flag, names,
+//otherwise the one of the bundle, which has to be the one the target would pick
+func (b *Bundle) Check(version, backend string) (string, error) {
+	permissionAPI, err := PermissionAPI(version)
+	if err != nil {
+		return "", err
+	}
+	if b.Manifest.PermissionAPI != "" && b.Manifest.PermissionAPI != permissionAPI {
+		return "", errors.New("Bundle was made for " + b.Manifest.TargetVersion + " with " + b.Manifest.PermissionAPI + " permission targets, " + version + " takes " + permissionAPI + ". Bundle again with -targetVersion " + version + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	targetBackend, err := access.BackendFor(backend, version)
+	if err != nil {
+		return "", err
+	}
+	if backend != access.AutoBackend || b.Manifest.Backend == "" {
+		return targetBackend, nil
+	}
+	if b.Manifest.Backend != targetBackend {
+		return "", errors.New("Bundle was made for " + b.Manifest.TargetVersion + " writing groups and users through the " + b.Manifest.Backend + " API, " + version + " would use the " + targetBackend + " API. Pass -backend " + b.Manifest.Backend + " to apply it as it is, or bundle again with -targetVersion " + version + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	return b.Manifest.Backend, nil
+}
+
+//Queue every request into the queue in bundle order, written through backend, returns the number queued
+func (b *Bundle) Queue(workQueue access.Queue, backend string) (int, error) {
+	dec := json.NewDecoder(bytes.NewReader(b.requests))
+	count := 0
+	for {
+		var request Request
+		err := dec.Decode(&request)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, errors.New("Error parsing bundle requests: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		item, err := access.ItemFromPayload(request.Type, request.Payload)
+		if err != nil {
+			return count, errors.New("Error parsing bundle request " + request.ID + ": " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		item.Backend = backend
+		switch item.AccessType {
+		case "group":
+			item.GroupIndex = request.Index
+		case "user":
+			item.UserIndex = request.Index
+		default:
+			item.PermissionIndex = request.Index
+		}
+		workQueue.Add(item)
+		count++
+	}
+}
@@ -0,0 +1,200 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"security-json-import/access"
+	"security-json-import/repository"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest Manifest
+		version  string
+		backend  string
+		want     string
+		wantErr  bool
+	}{
+		{"same version", Manifest{TargetVersion: "7.77.3", Backend: access.AccessBackend, PermissionAPI: "v2"}, "7.77.3", access.AutoBackend, access.AccessBackend, false},
+		{"other version with the same APIs", Manifest{TargetVersion: "7.77.3", Backend: access.AccessBackend, PermissionAPI: "v2"}, "7.90.1", access.AutoBackend, access.AccessBackend, false},
+		{"v2 permission targets before 6.6.0", Manifest{TargetVersion: "7.77.3", Backend: access.LegacyBackend, PermissionAPI: "v2"}, "6.5.0", access.AutoBackend, "", true},
+		{"v1 permission targets from 6.6.0", Manifest{TargetVersion: "6.5.0", Backend: access.LegacyBackend, PermissionAPI: "v1"}, "7.41.0", access.AutoBackend, "", true},
+		{"no permission targets bundled", Manifest{TargetVersion: "6.5.0", Backend: access.LegacyBackend}, "7.41.0", access.AutoBackend, access.LegacyBackend, false},
+		{"access bundle on a target without it", Manifest{TargetVersion: "7.77.3", Backend: access.AccessBackend, PermissionAPI: "v2"}, "7.41.0", access.AutoBackend, "", true},
+		{"legacy bundle on a target that would use access", Manifest{TargetVersion: "7.41.0", Backend: access.LegacyBackend, PermissionAPI: "v2"}, "7.77.3", access.AutoBackend, "", true},
+		{"-backend keeps the bundle as it is", Manifest{TargetVersion: "7.41.0", Backend: access.LegacyBackend, PermissionAPI: "v2"}, "7.77.3", access.LegacyBackend, access.LegacyBackend, false},
+		{"-backend wins over the bundle", Manifest{TargetVersion: "7.77.3", Backend: access.AccessBackend, PermissionAPI: "v2"}, "7.77.3", access.LegacyBackend, access.LegacyBackend, false},
+		{"unknown -backend", Manifest{TargetVersion: "7.77.3", Backend: access.AccessBackend}, "7.77.3", "ldap", "", true},
+		{"invalid version", Manifest{TargetVersion: "7.77.3", Backend: access.AccessBackend}, "seven", access.AutoBackend, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := (&Bundle{Manifest: tt.manifest}).Check(tt.version, tt.backend)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Check() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Check() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrder(t *testing.T) {
+	group := func(name string) access.ListTypes {
+		return access.ListTypes{AccessType: "group", Group: access.GroupImport{Name: name}}
+	}
+	user := func(name string, groups ...string) access.ListTypes {
+		return access.ListTypes{AccessType: "user", User: access.UserImport{Name: name, Groups: groups}}
+	}
+	permission := func(name string, users ...string) access.ListTypes {
+		actions := access.PermissionV2ActionsImport{Users: make(map[string][]string)}
+		for _, user := range users {
+			actions.Users[user] = []string{"read"}
+		}
+		return access.ListTypes{AccessType: "permissionV2", PermissionV2: access.PermissionV2Import{Name: name, Repo: &access.PermissionDataV2Import{Actions: actions}}}
+	}
+	tests := []struct {
+		name  string
+		items []access.ListTypes
+		want  []string
+	}{
+		{"already in order", []access.ListTypes{group("devs"), user("bob", "devs"), permission("p", "bob")},
+			[]string{"group/devs", "user/bob", "permissionV2/p"}},
+		{"dependencies first", []access.ListTypes{permission("p", "bob"), user("bob", "devs", "ops"), group("ops"), group("devs")},
+			[]string{"group/devs", "group/ops", "user/bob", "permissionV2/p"}},
+		{"otherwise the order they were read in", []access.ListTypes{group("qa"), user("bob"), group("devs"), user("alice")},
+			[]string{"group/qa", "user/bob", "group/devs", "user/alice"}},
+		{"dependencies not in the items", []access.ListTypes{user("bob", "devs"), permission("p", "carol")},
+			[]string{"user/bob", "permissionV2/p"}},
+		{"all items with the key go first", []access.ListTypes{permission("p", "bob"), user("bob"), user("bob", "devs")},
+			[]string{"user/bob", "user/bob", "permissionV2/p"}},
+		{"empty", nil, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]string, 0)
+			for _, item := range Order(tt.items) {
+				got = append(got, item.Key())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Order() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+//queued collects what Queue adds
+type queued []access.ListTypes
+
+func (q *queued) Add(item access.ListTypes) {
+	*q = append(*q, item)
+}
+
+func TestWriteRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "import.bundle")
+	items := []access.ListTypes{
+		{AccessType: "user", Backend: access.AccessBackend, UserIndex: 4, User: access.UserImport{Name: "bob", Email: "bob@example.com", Groups: []string{"devs"}}},
+		{AccessType: "permissionV2", PermissionIndex: 7, PermissionV2: access.PermissionV2Import{Name: "p", Repo: &access.PermissionDataV2Import{
+			Repositories: []string{"libs"}, Actions: access.PermissionV2ActionsImport{Users: map[string][]string{"bob": {"read"}}}}}},
+		{AccessType: "group", Backend: access.AccessBackend, GroupIndex: 2, Group: access.GroupImport{Name: "devs", Description: "developers"}},
+	}
+	config := &repository.Config{Definitions: map[string]repository.Definition{"libs": {Key: "libs", RClass: "local", PackageType: "maven"}}}
+	manifest := Manifest{Tool: "test", Created: time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC), TargetVersion: "7.77.3", Backend: access.AccessBackend, PermissionAPI: "v2",
+		Inputs: map[string]string{"securityJSONFile": "aa"}}
+	if err := Write(path, manifest, items, config); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Format, manifest.Requests, manifest.Repositories = Format, 3, 1
+	manifest.Types = map[string]int{"group": 1, "user": 1, "permissionV2": 1}
+	if !reflect.DeepEqual(b.Manifest, manifest) {
+		t.Errorf("Manifest = %+v, want %+v", b.Manifest, manifest)
+	}
+	if b.Config == nil || !reflect.DeepEqual(b.Config.Definitions, config.Definitions) {
+		t.Errorf("Config = %+v, want %+v", b.Config, config)
+	}
+
+	var got queued
+	count, err := b.Queue(&got, access.LegacyBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 || len(got) != 3 {
+		t.Fatalf("Queue() = %d with %d queued, want 3", count, len(got))
+	}
+	want := []access.ListTypes{items[2], items[0], items[1]}
+	for i := range want {
+		//the backend of the target applying the bundle wins over the one it was made for
+		want[i].Backend = access.LegacyBackend
+		if got[i].Key() != want[i].Key() || got[i].Backend != want[i].Backend || index(got[i]) != index(want[i]) ||
+			!reflect.DeepEqual(got[i].Payload(), want[i].Payload()) {
+			t.Errorf("queued %+v, want %+v", got[i], want[i])
+		}
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	dir := t.TempDir()
+	//bundle writes a gzipped tar with the given files
+	bundle := func(name string, files map[string]string) string {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		for file, data := range files {
+			if err := tw.WriteHeader(&tar.Header{Name: file, Mode: 0600, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	notGzip := filepath.Join(dir, "security.json")
+	if err := os.WriteFile(notGzip, []byte(`{"groups":[]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{"missing", filepath.Join(dir, "missing"), true},
+		{"not gzip", notGzip, true},
+		{"no manifest", bundle("none", map[string]string{requestsName: ""}), true},
+		{"broken manifest", bundle("broken", map[string]string{manifestName: "{"}), true},
+		{"newer format", bundle("newer", map[string]string{manifestName: `{"format":` + strconv.Itoa(Format+1) + `}`}), true},
+		{"current format", bundle("current", map[string]string{manifestName: `{"format":` + strconv.Itoa(Format) + `}`}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Read(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Read() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
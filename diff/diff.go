@@ -0,0 +1,130 @@
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+//Change one field that differs. Lists of strings are compared as sets and report Added and Removed, anything else From and To
+type Change struct {
+	Field   string      `json:"field"`
+	From    interface{} `json:"from,omitempty"`
+	To      interface{} `json:"to,omitempty"`
+	Added   []string    `json:"added,omitempty"`
+	Removed []string    `json:"removed,omitempty"`
+}
+
+func (c Change) String() string {
+	if c.Added != nil || c.Removed != nil {
+		s := c.Field + ":"
+		for _, v := range c.Added {
+			s += " +" + v
+		}
+		for _, v := range c.Removed {
+			s += " -" + v
+		}
+		return s
+	}
+	from, _ := json.Marshal(c.From)
+	to, _ := json.Marshal(c.To)
+	return fmt.Sprintf("%s: %s -> %s", c.Field, from, to)
+}
+
+//Compare the JSON forms of have and want, field paths are dotted JSON keys
+func Compare(have, want interface{}) ([]Change, error) {
+	haveValue, err := generic(have)
+	if err != nil {
+		return nil, err
+	}
+	wantValue, err := generic(want)
+	if err != nil {
+		return nil, err
+	}
+	var changes []Change
+	walk("", haveValue, wantValue, &changes)
+	return changes, nil
+}
+
+//generic round trip through JSON, so both sides are maps, slices and scalars
+func generic(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	err = json.Unmarshal(data, &out)
+	return out, err
+}
+
+func walk(path string, have, want interface{}, changes *[]Change) {
+	haveMap, haveIsMap := have.(map[string]interface{})
+	wantMap, wantIsMap := want.(map[string]interface{})
+	if (haveIsMap || have == nil) && (wantIsMap || want == nil) && (haveIsMap || wantIsMap) {
+		keys := make(map[string]bool)
+		for k := range haveMap {
+			keys[k] = true
+		}
+		for k := range wantMap {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			field := k
+			if path != "" {
+				field = path + "." + k
+			}
+			walk(field, haveMap[k], wantMap[k], changes)
+		}
+		return
+	}
+	haveSet, haveIsSet := stringSet(have)
+	wantSet, wantIsSet := stringSet(want)
+	if haveIsSet && wantIsSet {
+		change := Change{Field: path}
+		for v := range wantSet {
+			if !haveSet[v] {
+				change.Added = append(change.Added, v)
+			}
+		}
+		for v := range haveSet {
+			if !wantSet[v] {
+				change.Removed = append(change.Removed, v)
+			}
+		}
+		if change.Added != nil || change.Removed != nil {
+			sort.Strings(change.Added)
+			sort.Strings(change.Removed)
+			*changes = append(*changes, change)
+		}
+		return
+	}
+	if !reflect.DeepEqual(have, want) {
+		*changes = append(*changes, Change{Field: path, From: have, To: want})
+	}
+}
+
+//stringSet a list of strings as a set, nil counts as the empty list
+func stringSet(v interface{}) (map[string]bool, bool) {
+	set := make(map[string]bool)
+	if v == nil {
+		return set, true
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	for _, e := range list {
+		s, ok := e.(string)
+		if !ok {
+			return nil, false
+		}
+		set[s] = true
+	}
+	return set, true
+}
@@ -0,0 +1,73 @@
+package diff
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	type principals struct {
+		Users map[string][]string `json:"users,omitempty"`
+	}
+	type entity struct {
+		Name         string      `json:"name"`
+		Admin        bool        `json:"admin"`
+		Repositories []string    `json:"repositories,omitempty"`
+		Principals   principals  `json:"principals"`
+		Extra        *principals `json:"extra,omitempty"`
+		Counts       []int       `json:"counts,omitempty"`
+	}
+	tests := []struct {
+		name string
+		have interface{}
+		want interface{}
+		out  []Change
+	}{
+		{"equal", entity{Name: "p", Repositories: []string{"a", "b"}}, entity{Name: "p", Repositories: []string{"a", "b"}}, nil},
+		{"string lists are sets", entity{Repositories: []string{"b", "a", "a"}}, entity{Repositories: []string{"a", "b"}}, nil},
+		{"scalar", entity{Name: "p", Admin: true}, entity{Name: "q"},
+			[]Change{{Field: "admin", From: true, To: false}, {Field: "name", From: "p", To: "q"}}},
+		{"list added and removed", entity{Repositories: []string{"a", "b"}}, entity{Repositories: []string{"c", "a", "d"}},
+			[]Change{{Field: "repositories", Added: []string{"c", "d"}, Removed: []string{"b"}}}},
+		{"missing list is empty", entity{}, entity{Repositories: []string{"a"}}, []Change{{Field: "repositories", Added: []string{"a"}}}},
+		{"nested maps give dotted paths", entity{Principals: principals{Users: map[string][]string{"bob": {"r"}, "alice": {"r"}}}},
+			entity{Principals: principals{Users: map[string][]string{"bob": {"r", "w"}, "carol": {"r"}}}},
+			[]Change{{Field: "principals.users.alice", Removed: []string{"r"}}, {Field: "principals.users.bob", Added: []string{"w"}}, {Field: "principals.users.carol", Added: []string{"r"}}}},
+		{"object only on one side", entity{}, entity{Extra: &principals{Users: map[string][]string{"bob": {"r"}}}},
+			[]Change{{Field: "extra.users.bob", Added: []string{"r"}}}},
+		{"lists that are not strings are compared whole", entity{Counts: []int{1, 2}}, entity{Counts: []int{2, 1}},
+			[]Change{{Field: "counts", From: []interface{}{1.0, 2.0}, To: []interface{}{2.0, 1.0}}}},
+		{"different shapes", map[string]interface{}{"a": "x"}, map[string]interface{}{"a": map[string]interface{}{"b": "x"}},
+			[]Change{{Field: "a", From: "x", To: map[string]interface{}{"b": "x"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Compare(tt.have, tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.out) {
+				t.Errorf("Compare() = %#v, want %#v", got, tt.out)
+			}
+		})
+	}
+	if _, err := Compare(func() {}, nil); err == nil {
+		t.Error("Compare() of something that is not JSON = nil error, want one")
+	}
+}
+
+func TestChangeString(t *testing.T) {
+	tests := []struct {
+		change Change
+		want   string
+	}{
+		{Change{Field: "repositories", Added: []string{"c"}, Removed: []string{"a", "b"}}, "repositories: +c -a -b"},
+		{Change{Field: "admin", From: true, To: false}, "admin: true -> false"},
+		{Change{Field: "email", From: nil, To: "bob@example.com"}, `email: null -> "bob@example.com"`},
+	}
+	for _, tt := range tests {
+		if got := tt.change.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"security-json-import/access"
+	"security-json-import/auth"
+	"security-json-import/helpers"
+	"security-json-import/importer"
+	"security-json-import/report"
+	"security-json-import/repository"
+	"security-json-import/scheduler"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//dryRepos repository.Repos that has no repositories and writes the placeholders instead of creating them
+type dryRepos struct {
+	out  io.Writer
+	base string
+}
+
+func (d dryRepos) RepoExists(key string) (bool, error) {
+	return false, nil
+}
+
+func (d dryRepos) CreateRepo(key string, config []byte) ([]byte, int, error) {
+	var data bytes.Buffer
+	if err := json.Indent(&data, config, "", "  "); err != nil {
+		return nil, 0, err
+	}
+	_, err := fmt.Fprintf(d.out, "PUT %s\n%s\n\n", d.base+"/api/repositories/"+url.PathEscape(key), data.Bytes())
+	if err != nil {
+		return nil, 0, err
+	}
+	return nil, 200, nil
+}
+
+//repositories the repositories an item references, which a real run creates from config xml when they are missing
+func repositories(item access.ListTypes) []string {
+	switch item.AccessType {
+	case "permission":
+		return item.Permission.Repositories
+	case "permissionV2":
+		if item.PermissionV2.Repo != nil {
+			return item.PermissionV2.Repo.Repositories
+		}
+	case "projectRepository":
+		return []string{item.Project.Repository}
+	}
+	return nil
+}
+
+//dryRun run the input through the scheduler and write the requests instead of sending them.
+//The version GET in ReadSecurityJSON is the only call made to the target. As nothing is looked up, every entity is
+//written as if it was missing: the policies for existing ones are not applied, and every repository in -configXMLFile
+//that a permission target references is created before it
+func dryRun(creds auth.Creds, flags helpers.Flags) {
+	var config *repository.Config
+	if flags.ConfigXMLFileVar != "" {
+		var err error
+		config, err = repository.ReadConfigXML(flags.ConfigXMLFileVar)
+		if err != nil {
+			log.Error("Could not read config xml. Exiting due to:", err)
+			os.Exit(helpers.ExitConfigError)
+		}
+	}
+	var out io.Writer = os.Stdout
+	if flags.DryRunOutputVar != "" {
+		file, err := os.Create(flags.DryRunOutputVar)
+		if err != nil {
+			log.Error("Could not create dry run output. Exiting due to:", err)
+			os.Exit(helpers.ExitConfigError)
+		}
+		defer file.Close()
+		out = file
+	}
+	buf := bufio.NewWriter(out)
+	defer buf.Flush()
+	fmt.Fprintf(buf, "# create-only, policies not evaluated: every entity is written as if it did not exist on %s\n\n", creds.URL)
+	resolver := repository.NewResolver(config)
+	repos := dryRepos{out: buf, base: creds.URL}
+
+	sched := scheduler.New()
+	sched.Limit = flags.QueueSizeVar
+	sched.Forget = true
+	go func() {
+		var err error
+		if flags.ReplayFailuresVar != "" {
+			_, err = report.Read(flags.ReplayFailuresVar, sched)
+		} else {
+			err = access.ReadSecurityJSON(sched, flags)
+		}
+		if err != nil {
+			log.Error(err)
+			os.Exit(helpers.ExitError)
+		}
+		sched.Close()
+	}()
+
+	var mu sync.Mutex
+	var writeErr error
+	//a single worker, so requests come out in the order a real run would start them
+	sched.Run(1, func(i int, job *scheduler.Job) scheduler.Result {
+		if job.Item.AccessType == "user" && importer.ForbiddenNames[job.Item.User.Name] == "bad" {
+			return scheduler.Result{State: scheduler.Skipped}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		//only the repositories config xml defines, the others are left to the target to check
+		var defined []string
+		for _, key := range repositories(job.Item) {
+			if _, ok := config.Lookup(key); ok {
+				defined = append(defined, key)
+			} else if _, ok := config.Lookup(strings.TrimSuffix(key, "-cache")); ok {
+				defined = append(defined, key)
+			}
+		}
+		if _, err := resolver.Resolve(repos, defined); err != nil && writeErr == nil {
+			writeErr = err
+		}
+		var data []byte
+		var err error
+		if body := job.Item.Body(); body != nil {
+			data, err = json.MarshalIndent(body, "", "  ")
+			if err != nil {
+				return scheduler.Result{State: scheduler.Failed, Err: err}
+			}
+			data = append(data, '\n')
+		}
+		//nothing is looked up, so everything shows as created
+		method, path, _ := job.Item.Write(false)
+		_, err = fmt.Fprintf(buf, "%s %s\n%s\n", method, creds.URL+path, data)
+		if err != nil && writeErr == nil {
+			writeErr = err
+		}
+		return scheduler.Result{State: scheduler.Succeeded}
+	})
+	stats := sched.Stats()
+	log.Info("Dry run planned ", stats.States[scheduler.Succeeded], " requests, skipped ", stats.States[scheduler.Skipped], ", nothing was sent to ", creds.URL, ". Create-only, policies not evaluated")
+	if writeErr != nil {
+		log.Error("Could not write dry run output: ", writeErr)
+		buf.Flush()
+		os.Exit(helpers.ExitError)
+	}
+}
@@ -0,0 +1,235 @@
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"security-json-import/access"
+	"security-json-import/auth"
+	"security-json-import/helpers"
+	"strconv"
+	"sync"
+
+	"github.com/Masterminds/semver"
+	log "github.com/sirupsen/logrus"
+)
+
+//listEntry entry of the group and user list endpoints
+type listEntry struct {
+	Name string `json:"name"`
+	URI  string `json:"uri"`
+}
+
+//Run writes the user group association file from the source Artifactory at creds.URL
+func Run(creds auth.Creds, flags helpers.Flags) error {
+	usersFromGroups, err := pickMode(creds, flags)
+	if err != nil {
+		return err
+	}
+
+	listPath := "/api/security/users"
+	rootKey := "users"
+	importFlag := "-usersWithGroups"
+	if usersFromGroups {
+		listPath = "/api/security/groups"
+		rootKey = "groups"
+		importFlag = "-usersFromGroups"
+	}
+	data, respCode, _, getErr := auth.GetRestAPI("GET", true, creds.URL+listPath, creds.Username, creds.Apikey, "", nil, nil, 0, flags, nil)
+	if getErr != nil {
+		return getErr
+	}
+	if respCode != 200 {
+		return errors.New("Error listing " + rootKey + ", HTTP " + strconv.Itoa(respCode) + ": " + string(data) + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	var entries []listEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return errors.New("Error reading " + rootKey + " list: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	log.Info("Number of ", rootKey, " to export:", len(entries))
+
+	out, err := newArrayWriter(flags.UserGroupAssocationFileVar, rootKey)
+	if err != nil {
+		return err
+	}
+
+	//fetch each entry with a pool of workers
+	names := make(chan string)
+	var wg sync.WaitGroup
+	var failedMu sync.Mutex
+	var failed []string
+	for i := 0; i < flags.WorkersVar; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for name := range names {
+				var entry interface{}
+				var err error
+				if usersFromGroups {
+					entry, err = getGroup(creds, flags, name)
+				} else {
+					entry, err = getUser(creds, flags, name)
+				}
+				if err == nil {
+					err = out.Write(entry)
+				}
+				if err != nil {
+					log.Warn("worker ", i, " failed to export ", rootKey, " ", name, ": ", err)
+					failedMu.Lock()
+					failed = append(failed, name)
+					failedMu.Unlock()
+					continue
+				}
+				log.Debug("worker ", i, " exported ", rootKey, " ", name)
+			}
+		}(i)
+	}
+	for i := range entries {
+		names <- entries[i].Name
+	}
+	close(names)
+	wg.Wait()
+
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	log.Info("Exported ", out.count, " ", rootKey, " to ", flags.UserGroupAssocationFileVar, ", import it with ", importFlag)
+	if len(failed) > 0 {
+		return errors.New("Failed to export " + strconv.Itoa(len(failed)) + " " + rootKey + ", they are missing from the file: " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	return nil
+}
+
+//pickMode uses includeUsers=true on 6.13.0 and above, per user fetches otherwise, unless told otherwise
+func pickMode(creds auth.Creds, flags helpers.Flags) (bool, error) {
+	var artVer access.ArtifactoryVersion
+	data, _, _, getErr := auth.GetRestAPI("GET", true, creds.URL+"/api/system/version", creds.Username, creds.Apikey, "", nil, nil, 0, flags, nil)
+	if getErr != nil {
+		return false, getErr
+	}
+	err := json.Unmarshal(data, &artVer)
+	if err != nil {
+		return false, err
+	}
+	c, err := semver.NewConstraint(">= 6.13.0")
+	if err != nil {
+		return false, err
+	}
+	v, err := semver.NewVersion(artVer.Version)
+	if err != nil {
+		return false, err
+	}
+	supported := c.Check(v)
+	switch {
+	case flags.UsersFromGroupsVar && flags.UsersWithGroupsVar:
+		return false, errors.New("When selecting export format, please only pick one: -usersWithGroups or -usersFromGroups")
+	case flags.UsersFromGroupsVar && !supported:
+		return false, errors.New("The source must be atleast 6.13.0 to get Users from Groups, source is " + artVer.Version)
+	case flags.UsersFromGroupsVar:
+		return true, nil
+	case flags.UsersWithGroupsVar:
+		return false, nil
+	}
+	if supported {
+		log.Info(artVer.Version, " detected, exporting groups with users")
+	} else {
+		log.Info(artVer.Version, " detected, exporting users with groups one user at a time")
+	}
+	return supported, nil
+}
+
+func getGroup(creds auth.Creds, flags helpers.Flags, name string) (interface{}, error) {
+	data, respCode, _, getErr := auth.GetRestAPI("GET", true, creds.URL+"/api/security/groups/"+url.PathEscape(name)+"?includeUsers=true", creds.Username, creds.Apikey, "", nil, nil, 0, flags, nil)
+	if getErr != nil {
+		return nil, getErr
+	}
+	if respCode != 200 {
+		return nil, errors.New("HTTP " + strconv.Itoa(respCode) + ": " + string(data))
+	}
+	var group access.CreateUsersFromGroupsDataJSON
+	err := json.Unmarshal(data, &group)
+	return group, err
+}
+
+func getUser(creds auth.Creds, flags helpers.Flags, name string) (interface{}, error) {
+	data, respCode, _, getErr := auth.GetRestAPI("GET", true, creds.URL+"/api/security/users/"+url.PathEscape(name), creds.Username, creds.Apikey, "", nil, nil, 0, flags, nil)
+	if getErr != nil {
+		return nil, getErr
+	}
+	if respCode != 200 {
+		return nil, errors.New("HTTP " + strconv.Itoa(respCode) + ": " + string(data))
+	}
+	var user access.CreateUsersWithGroupsDataJSON
+	err := json.Unmarshal(data, &user)
+	return user, err
+}
+
+//arrayWriter writes {"<key>":[...]} one element at a time into a temp file, renamed into place on Close
+type arrayWriter struct {
+	mu    sync.Mutex
+	path  string
+	file  *os.File
+	buf   *bufio.Writer
+	count int
+}
+
+func newArrayWriter(path, key string) (*arrayWriter, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, errors.New("Error creating export file: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	w := &arrayWriter{path: path, file: file, buf: bufio.NewWriter(file)}
+	keyData, _ := json.Marshal(key)
+	_, err = w.buf.WriteString("{" + string(keyData) + ":[")
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *arrayWriter) Write(entry interface{}) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.count > 0 {
+		w.buf.WriteString(",\n")
+	} else {
+		w.buf.WriteString("\n")
+	}
+	_, err = w.buf.Write(data)
+	if err != nil {
+		return err
+	}
+	w.count++
+	return nil
+}
+
+func (w *arrayWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.WriteString("\n]}\n")
+	err := w.buf.Flush()
+	if err == nil {
+		err = w.file.Close()
+	} else {
+		w.file.Close()
+	}
+	if err == nil {
+		err = os.Rename(w.file.Name(), w.path)
+	}
+	if err != nil {
+		os.Remove(w.file.Name())
+		return errors.New("Error writing export file: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	return nil
+}
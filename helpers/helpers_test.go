@@ -0,0 +1,18 @@
+package helpers
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestDefaultFlags(t *testing.T) {
+	//twice, as a library may build several importers
+	DefaultFlags()
+	flags := DefaultFlags()
+	if flags.WorkersVar != 50 || flags.GroupPolicyVar != "overwrite" || flags.UserPolicyVar != "merge" || flags.PermissionPolicyVar != "overwrite" || flags.QueueSizeVar != 1000 {
+		t.Errorf("DefaultFlags() = %+v, want the CLI defaults", flags)
+	}
+	if flag.CommandLine.Lookup("workers") != nil {
+		t.Error("DefaultFlags() registered flags on the command line")
+	}
+}
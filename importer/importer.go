@@ -0,0 +1,106 @@
+package importer
+
+import (
+	"errors"
+	"security-json-import/access"
+	"security-json-import/helpers"
+	"security-json-import/journal"
+	"security-json-import/policy"
+	"security-json-import/repository"
+	"security-json-import/scheduler"
+	"strconv"
+	"sync"
+)
+
+//Importer imports groups, users, permission targets and projects into a Target. Items are imported concurrently by
+//-workers workers, each once the groups and users it references are in. Items can be added while the import runs,
+//the CLI streams security json straight into it
+type Importer struct {
+	Target   Target
+	Flags    helpers.Flags
+	Policies policy.Policies
+	//Repositories recreates repositories permission targets reference from config xml, or drops the missing ones
+	Repositories *repository.Resolver
+	//Journal records the previous state of everything before it is changed, so it can be rolled back. Optional
+	Journal *journal.Writer
+	//OnStart called when a worker picks up a job, OnComplete with every job that reaches a terminal state. Optional,
+	//both are called from the workers
+	OnStart    func(job scheduler.Job)
+	OnComplete func(job scheduler.Job)
+	sched      *scheduler.Scheduler
+	mu         sync.Mutex
+	//missingUsers users permission targets reference, by name. mu only guards the map, each user has its own lock
+	missingUsers map[string]*missingUser
+	usersMu      sync.Mutex
+	//writtenUsers the groups of every user written this run
+	writtenUsers map[string][]string
+}
+
+//missingUser whether a user permission targets reference was created or found on the target this run. A check that
+//failed is tried again
+type missingUser struct {
+	mu   sync.Mutex
+	done bool
+}
+
+//New importer into target with the policies of flags, e.g. helpers.DefaultFlags with the fields changed. Repositories are
+//only dropped until Repositories is given a config
+func New(target Target, flags helpers.Flags) (*Importer, error) {
+	if flags.WorkersVar < 1 {
+		return nil, errors.New("-workers must be at least 1, not " + strconv.Itoa(flags.WorkersVar) + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	policies, err := policy.FromFlags(flags)
+	if err != nil {
+		return nil, err
+	}
+	imp := &Importer{Target: target, Flags: flags, Policies: policies, Repositories: repository.NewResolver(nil), sched: scheduler.New(), missingUsers: make(map[string]*missingUser), writtenUsers: make(map[string][]string)}
+	imp.sched.OnComplete = func(job scheduler.Job) {
+		if imp.OnComplete != nil {
+			imp.OnComplete(job)
+		}
+	}
+	return imp, nil
+}
+
+//Add queue an item, satisfies access.Queue
+func (imp *Importer) Add(item access.ListTypes) {
+	imp.sched.Add(item)
+}
+
+//AddDone record an item that needs no importing, e.g. one an earlier run completed
+func (imp *Importer) AddDone(item access.ListTypes, result scheduler.Result) {
+	imp.sched.AddDone(item, result)
+}
+
+//Close no more items are coming. Run returns once everything added is done
+func (imp *Importer) Close() {
+	imp.sched.Close()
+}
+
+//Run import until every item is done or the import is aborted. Call it again after retrying failures
+func (imp *Importer) Run() scheduler.Stats {
+	imp.sched.Run(imp.Flags.WorkersVar, imp.process)
+	return imp.sched.Stats()
+}
+
+//Import items that were read already, e.g. collected with plan.NewCollector
+func (imp *Importer) Import(items []access.ListTypes) scheduler.Stats {
+	for _, item := range items {
+		imp.Add(item)
+	}
+	imp.Close()
+	return imp.Run()
+}
+
+//Scheduler the jobs, for progress, failures, retries and aborting
+func (imp *Importer) Scheduler() *scheduler.Scheduler {
+	return imp.sched
+}
+
+//journal write a record if there is a journal
+func (imp *Importer) journal(record journal.Record) error {
+	if imp.Journal == nil {
+		return nil
+	}
+	return imp.Journal.Write(record)
+}
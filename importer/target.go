@@ -0,0 +1,146 @@
+package importer
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/url"
+	"security-json-import/access"
+	"security-json-import/auth"
+	"security-json-import/helpers"
+	"security-json-import/repository"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Target the calls the importer makes to the instance it imports into. Client makes them over the REST API, other tooling
+//or tests can plug in their own. Writes return the response body and HTTP status, errors are for requests that got no answer
+type Target interface {
+	repository.Repos
+	//Get the target's version of item as it was returned, found is false if it does not exist
+	Get(item access.ListTypes) (data []byte, found bool, err error)
+	//GetUser a user by name, found is false if it does not exist
+	GetUser(name string) (user access.UserImport, found bool, err error)
+	//CreateGroup create the group, or with exists update it
+	CreateGroup(item access.ListTypes, exists bool) ([]byte, int, error)
+	//PutUser create the user, or with exists replace it. With update as well it is changed in place, keeping its password
+	PutUser(item access.ListTypes, exists, update bool) ([]byte, int, error)
+	//PutPermissionV1 create or replace a permission target through the v1 API
+	PutPermissionV1(item access.ListTypes) ([]byte, int, error)
+	//PutPermissionV2 create or replace the repo or build half of a permission target through the v2 API
+	PutPermissionV2(item access.ListTypes) ([]byte, int, error)
+	//PutProject create a project, or with exists update it. Also sets the roles of a project member
+	PutProject(item access.ListTypes, exists bool) ([]byte, int, error)
+	//AttachRepository move the repository of item into its project
+	AttachRepository(item access.ListTypes) ([]byte, int, error)
+}
+
+//Client Target over the Artifactory REST API. With -credsFile every request goes out as a random one of its users
+type Client struct {
+	Creds auth.Creds
+	Flags helpers.Flags
+	//CredsFile users and secrets to pick from per request, optional
+	CredsFile map[int][]string
+	//Backend the API GetUser reads users through, legacy or access
+	Backend string
+}
+
+//NewClient client for the instance at creds.URL
+func NewClient(creds auth.Creds, flags helpers.Flags) *Client {
+	return &Client{Creds: creds, Flags: flags, Backend: access.LegacyBackend}
+}
+
+//creds the creds for the next request
+func (c *Client) creds() auth.Creds {
+	creds := c.Creds
+	if len(c.CredsFile) > 0 {
+		//pick random user and password from list
+		randCredIndex := rand.Intn(len(c.CredsFile))
+		creds.Username = c.CredsFile[randCredIndex][0]
+		creds.Apikey = c.CredsFile[randCredIndex][1]
+	}
+	return creds
+}
+
+//send body as JSON, nothing if it is nil
+func (c *Client) send(method, path string, body interface{}) ([]byte, int, error) {
+	var data []byte
+	var header map[string]string
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return nil, 0, errors.New("Error marshaling " + path + ": " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		header = map[string]string{"Content-Type": "application/json"}
+		log.Debug(method, " ", path, " JSON:", string(data))
+	}
+	creds := c.creds()
+	respData, respCode, _, err := auth.GetRestAPI(method, true, creds.URL+path, creds.Username, creds.Apikey, "", data, header, 0, c.Flags, nil)
+	return respData, respCode, err
+}
+
+func (c *Client) Get(item access.ListTypes) ([]byte, bool, error) {
+	return access.FetchRaw(c.creds(), c.Flags, item)
+}
+
+func (c *Client) GetUser(name string) (access.UserImport, bool, error) {
+	item := access.ListTypes{AccessType: "user", Name: name, User: access.UserImport{Name: name}, Backend: c.Backend}
+	have, found, err := access.Fetch(c.creds(), c.Flags, item)
+	return have.User, found, err
+}
+
+func (c *Client) CreateGroup(item access.ListTypes, exists bool) ([]byte, int, error) {
+	method, path, _ := item.Write(exists)
+	return c.send(method, path, item.Body())
+}
+
+func (c *Client) PutUser(item access.ListTypes, exists, update bool) ([]byte, int, error) {
+	method, path, _ := item.Write(exists)
+	if exists && update && method == "PUT" {
+		//the legacy API updates in place on POST, a PUT would need the password which is never returned
+		method = "POST"
+	}
+	return c.send(method, path, item.Body())
+}
+
+func (c *Client) PutPermissionV1(item access.ListTypes) ([]byte, int, error) {
+	return c.send("PUT", item.Endpoint(), item.Permission)
+}
+
+func (c *Client) PutPermissionV2(item access.ListTypes) ([]byte, int, error) {
+	return c.send("PUT", item.Endpoint(), item.PermissionV2)
+}
+
+func (c *Client) PutProject(item access.ListTypes, exists bool) ([]byte, int, error) {
+	method, path, _ := item.Write(exists)
+	return c.send(method, path, item.Body())
+}
+
+func (c *Client) AttachRepository(item access.ListTypes) ([]byte, int, error) {
+	method, path, _ := item.Write(false)
+	return c.send(method, path, nil)
+}
+
+//RepoExists only a 404 means the repository is missing, any other answer but 200 is an error
+func (c *Client) RepoExists(key string) (bool, error) {
+	creds := c.creds()
+	_, respCheckCode, _, getErr := auth.GetRestAPI("HEAD", true, creds.URL+"/api/repositories/"+url.PathEscape(key), creds.Username, creds.Apikey, "", nil, nil, 0, c.Flags, nil)
+	if getErr != nil {
+		return false, getErr
+	}
+	switch respCheckCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	}
+	return false, errors.New("Checking repository " + key + " returned HTTP " + strconv.Itoa(respCheckCode) + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+}
+
+func (c *Client) CreateRepo(key string, config []byte) ([]byte, int, error) {
+	creds := c.creds()
+	data, respCode, _, err := auth.GetRestAPI("PUT", true, creds.URL+"/api/repositories/"+url.PathEscape(key), creds.Username, creds.Apikey, "", config, map[string]string{"Content-Type": "application/json"}, 0, c.Flags, nil)
+	return data, respCode, err
+}
@@ -0,0 +1,444 @@
+package importer
+
+import (
+	"encoding/json"
+	"errors"
+	"security-json-import/access"
+	"security-json-import/helpers"
+	"security-json-import/journal"
+	"security-json-import/policy"
+	"security-json-import/scheduler"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//ForbiddenNames internal users that are never imported
+var ForbiddenNames = map[string]string{"access-admin": "bad", "admin": "bad", "xray": "bad", "_internal": "bad", "anonymous": "bad"}
+
+//failed result for a job that should be retried
+func failed(statusCode int, data []byte, err error) scheduler.Result {
+	return scheduler.Result{State: scheduler.Failed, StatusCode: statusCode, Body: data, Err: err}
+}
+
+//process import a single job, called by the scheduler workers
+func (imp *Importer) process(i int, job *scheduler.Job) scheduler.Result {
+	log.Debug("worker ", i, " starting job")
+	if imp.OnStart != nil {
+		imp.OnStart(*job)
+	}
+
+	var result scheduler.Result
+	switch job.Item.AccessType {
+	case "group":
+		result = imp.importGroup(job.Item, i)
+	case "permission":
+		result = imp.importPermission(job.Item, i)
+	case "permissionV2":
+		result = imp.importPermissionV2(job, i)
+	case "user":
+		result = imp.importUser(job.Item, i)
+	case "project", "projectMember":
+		result = imp.importProject(job.Item, i)
+	case "projectRepository":
+		result = imp.importProjectRepository(job.Item, i)
+	default:
+		result = failed(0, nil, errors.New("unknown access type "+job.Item.AccessType))
+	}
+	log.Debug("worker ", i, " finished job")
+	return result
+}
+
+func (imp *Importer) importGroup(requestData access.ListTypes, i int) scheduler.Result {
+	flags := imp.Flags
+	md := requestData.Group
+	log.Debug("worker ", i, " starting group index:", requestData.GroupIndex, " name:", md.Name)
+	if requestData.GroupIndex < flags.SkipGroupIndexVar {
+		log.Info("worker ", i, " skipping group index:", requestData.GroupIndex, " name:", md.Name)
+		return scheduler.Result{State: scheduler.Skipped}
+	}
+	requestData, exists, result := imp.applyPolicy(requestData, i)
+	if result != nil {
+		return *result
+	}
+	md = requestData.Group
+	_, _, expectedCode := requestData.Write(exists)
+
+	data, respGroupCode, getErr := imp.Target.CreateGroup(requestData, exists)
+	if getErr != nil {
+		log.Warn("adding to failure queue, group: " + md.Name + " " + getErr.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return failed(respGroupCode, data, getErr)
+	}
+	log.Info("worker ", i, " finished creating group index:", requestData.GroupIndex, " name:", md.Name, " HTTP ", respGroupCode)
+	//201 created, 200 updated on the Access API
+	if respGroupCode != expectedCode {
+		log.Warn("some error occured on group index ", requestData.GroupIndex, ":", string(data))
+		log.Warn("adding to failure queue, group: " + md.Name + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return failed(respGroupCode, data, nil)
+	}
+	return scheduler.Result{State: scheduler.Succeeded, StatusCode: respGroupCode, Body: data}
+}
+
+func (imp *Importer) importPermission(requestData access.ListTypes, i int) scheduler.Result {
+	flags := imp.Flags
+	md := requestData.Permission
+	log.Debug("worker ", i, " starting permission index:", requestData.PermissionIndex, " name:", md.Name)
+	if requestData.PermissionIndex < flags.SkipPermissionIndexVar {
+		log.Info("worker ", i, " skipping permission index:", requestData.PermissionIndex, " name:", md.Name)
+		return scheduler.Result{State: scheduler.Skipped}
+	}
+	requestData, _, result := imp.applyPolicy(requestData, i)
+	if result != nil {
+		return *result
+	}
+	md = requestData.Permission
+	data, respPermCode, getErr := imp.Target.PutPermissionV1(requestData)
+	if getErr != nil {
+		log.Warn("adding to failure queue, permission: " + md.Name + " " + getErr.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return failed(respPermCode, data, getErr)
+	}
+	log.Info("worker ", i, " finished creating permission index:", requestData.PermissionIndex, " name:", md.Name, " HTTP ", respPermCode)
+	if respPermCode != 200 {
+		log.Warn("worker ", i, " some error occured on permission index ", requestData.PermissionIndex, ":", string(data))
+		if strings.Contains(string(data), "Permission target contains a reference to a non-existing repository") {
+			return imp.permissionV1RepoVerification(md, requestData, i, respPermCode, data)
+		}
+		log.Warn("adding to failure queue, permission: " + md.Name + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return failed(respPermCode, data, nil)
+	}
+	return scheduler.Result{State: scheduler.Succeeded, StatusCode: respPermCode, Body: data}
+}
+
+func (imp *Importer) importPermissionV2(job *scheduler.Job, i int) scheduler.Result {
+	requestData := job.Item
+	flags := imp.Flags
+	md := requestData.PermissionV2
+	log.Debug("worker ", i, " starting permission v2 index:", requestData.PermissionIndex, " name:", md.Name)
+	if requestData.PermissionIndex < flags.SkipPermissionIndexVar {
+		log.Info("worker ", i, " skipping permission v2 index:", requestData.PermissionIndex, " name:", md.Name)
+		return scheduler.Result{State: scheduler.Skipped}
+	}
+	requestData, _, result := imp.applyPolicy(requestData, i)
+	if result != nil {
+		return *result
+	}
+	md = requestData.PermissionV2
+	data, respPermCode, getErr := imp.Target.PutPermissionV2(requestData)
+	if getErr != nil {
+		log.Warn("adding to failure queue, permission: " + md.Name + " " + getErr.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return failed(respPermCode, data, getErr)
+	}
+	log.Info("worker ", i, " finished creating permission v2 index:", requestData.PermissionIndex, " name:", md.Name, " HTTP ", respPermCode)
+	if respPermCode == 200 {
+		return scheduler.Result{State: scheduler.Succeeded, StatusCode: respPermCode, Body: data}
+	}
+	log.Warn("worker ", i, " some error occured on permission v2 index ", requestData.PermissionIndex, ":", string(data))
+	if strings.Contains(string(data), "Permission target request missing repositories") || strings.Contains(string(data), "Permission target contains a reference to a non-existing repository") {
+		return imp.permissionRepoVerification(md, requestData, i)
+	}
+	if strings.Contains(string(data), "reference to a non-existing user") {
+		var ArtError access.ArtifactoryError
+		err := json.Unmarshal(data, &ArtError)
+		if err != nil {
+			return failed(respPermCode, data, err)
+		}
+		actions := md.Build
+		if md.Repo != nil {
+			actions = md.Repo
+		}
+		//users that are part of this import are already prerequisites, only create the ones nobody mentioned
+		created := 0
+		for user := range actions.Actions.Users {
+			if imp.sched.Known("user/"+user) || ForbiddenNames[user] == "bad" {
+				continue
+			}
+			result := imp.createMissingUser(user, requestData.Backend, i)
+			if result.State != scheduler.Succeeded && result.State != scheduler.Skipped {
+				log.Warn("adding to failure queue, permission v2: " + md.Name + " could not create missing user " + user + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+				return failed(respPermCode, data, errors.New("missing user "+user+" could not be created"))
+			}
+			created++
+		}
+		if created > 0 && job.Attempts < 3 {
+			//wait for the new users, then try the permission target again
+			return scheduler.Result{State: scheduler.Pending, StatusCode: respPermCode, Body: data}
+		}
+		log.Warn("adding to failure queue, permission v2: " + md.Name + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return failed(respPermCode, data, nil)
+	}
+	log.Warn("adding to failure queue, permission v2: " + md.Name + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	return failed(respPermCode, data, nil)
+}
+
+func (imp *Importer) importUser(requestData access.ListTypes, i int) scheduler.Result {
+	flags := imp.Flags
+	md := requestData.User
+	log.Debug("worker ", i, " starting user index:", requestData.UserIndex, " name:", md.Name)
+	if requestData.UserIndex < flags.SkipUserIndexVar {
+		log.Info("worker ", i, " skipping user index:", requestData.UserIndex, " name:", md.Name)
+		return scheduler.Result{State: scheduler.Skipped}
+	}
+	if ForbiddenNames[md.Name] == "bad" {
+		log.Info("worker ", i, " skipping user index:", requestData.UserIndex, " name:", md.Name, " as it is internal")
+		return scheduler.Result{State: scheduler.Skipped}
+	}
+
+	return imp.putUser(requestData, i)
+}
+
+//putUser create or update a user as its policy says. A user read once per group is a job per group, the ones after
+//the first add their group to what this run wrote whatever the policy, jobs with the same key never run at once
+func (imp *Importer) putUser(requestData access.ListTypes, i int) scheduler.Result {
+	policies := imp.Policies
+	imp.usersMu.Lock()
+	groups, written := imp.writtenUsers[requestData.User.Name]
+	imp.usersMu.Unlock()
+	if written {
+		requestData.User.Groups = policy.Union(groups, requestData.User.Groups)
+		policies = policy.Policies{"user": policy.Merge}
+	}
+	requestData, exists, result := imp.applyPolicies(policies, requestData, i)
+	if result != nil {
+		return *result
+	}
+	md := requestData.User
+	method, _, expectedCode := requestData.Write(exists)
+	update := false
+	verb := "creating"
+	if exists && method == "PATCH" {
+		//the Access API only updates in place, the existing password is kept
+		verb = "updating"
+	} else if exists && policies.For("user") == policy.Merge {
+		//update in place, the existing password is kept
+		update, expectedCode, verb = true, 200, "updating"
+	} else if exists {
+		verb = "replacing"
+	} else {
+		log.Info("worker ", i, " did not find user ", md.Name, " creating now")
+	}
+	data, respUserCode, getErr := imp.Target.PutUser(requestData, exists, update)
+	if getErr != nil {
+		log.Warn("adding to failure queue, user: " + md.Name + " " + getErr.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return failed(respUserCode, data, getErr)
+	}
+	log.Info("worker ", i, " finished ", verb, " user index:", requestData.UserIndex, " name:", md.Name, " HTTP ", respUserCode)
+	if respUserCode != expectedCode {
+		log.Warn("some error occured on user index ", requestData.UserIndex, ":", string(data))
+		log.Warn("adding to failure queue, user: " + md.Name + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return failed(respUserCode, data, nil)
+	}
+	imp.usersMu.Lock()
+	imp.writtenUsers[md.Name] = md.Groups
+	imp.usersMu.Unlock()
+	return scheduler.Result{State: scheduler.Succeeded, StatusCode: respUserCode, Body: data}
+}
+
+//createMissingUser create a user a permission target references that is in neither the source nor the target. It gets no
+//password, it can only log in through SSO or once an admin sets one. Each name is only created once per run, workers
+//needing different users do not wait for each other
+func (imp *Importer) createMissingUser(name, backend string, i int) scheduler.Result {
+	imp.mu.Lock()
+	state, ok := imp.missingUsers[name]
+	if !ok {
+		state = &missingUser{}
+		imp.missingUsers[name] = state
+	}
+	imp.mu.Unlock()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.done {
+		return scheduler.Result{State: scheduler.Skipped}
+	}
+	_, found, err := imp.Target.GetUser(name)
+	if err != nil {
+		//not knowing whether it exists, creating it could replace a real user with one that cannot log in
+		log.Warn("adding to failure queue, could not check for user " + name + ": " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return failed(0, nil, err)
+	}
+	if found {
+		state.done = true
+		return scheduler.Result{State: scheduler.Skipped}
+	}
+	log.Warn("worker ", i, " user ", name, " is referenced by a permission target but is not in the source, creating it with the internal password disabled")
+	user := access.UserImport{Name: name, Email: name + imp.Flags.UserEmailDomainVar, ProfileUpdatable: true, InternalPasswordDisabled: true}
+	result := imp.putUser(access.ListTypes{AccessType: "user", Name: name, User: user, Backend: backend}, i)
+	if result.State == scheduler.Succeeded || result.State == scheduler.Skipped {
+		state.done = true
+	}
+	return result
+}
+
+//importProject create a project, or give a user or group their roles in one
+func (imp *Importer) importProject(requestData access.ListTypes, i int) scheduler.Result {
+	name := requestData.EntityName()
+	log.Debug("worker ", i, " starting ", requestData.AccessType, " ", name)
+	requestData, exists, result := imp.applyPolicy(requestData, i)
+	if result != nil {
+		return *result
+	}
+	_, _, expectedCode := requestData.Write(exists)
+	data, respCode, getErr := imp.Target.PutProject(requestData, exists)
+	if getErr != nil {
+		log.Warn("adding to failure queue, " + requestData.AccessType + ": " + name + " " + getErr.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return failed(respCode, data, getErr)
+	}
+	log.Info("worker ", i, " finished ", requestData.AccessType, " ", name, " HTTP ", respCode)
+	if respCode != expectedCode {
+		log.Warn("some error occured on ", requestData.AccessType, " ", name, ":", string(data))
+		log.Warn("adding to failure queue, " + requestData.AccessType + ": " + name + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return failed(respCode, data, nil)
+	}
+	return scheduler.Result{State: scheduler.Succeeded, StatusCode: respCode, Body: data}
+}
+
+//importProjectRepository attach a repository to its project. A repository already in another project is left where it is,
+//moving it would take it away from that project's members
+func (imp *Importer) importProjectRepository(requestData access.ListTypes, i int) scheduler.Result {
+	md := requestData.Project
+	data, exists, err := imp.Target.Get(requestData)
+	if err != nil {
+		log.Warn("adding to failure queue, repository: " + md.Repository + " " + err.Error())
+		return failed(0, nil, err)
+	}
+	if !exists {
+		//created from config xml like the repositories of permission targets
+		if repos, err := imp.Repositories.Resolve(imp.Target, []string{md.Repository}); err != nil || len(repos) == 0 || repos[0] != md.Repository {
+			log.Warn("adding to failure queue, repository: " + md.Repository + " does not exist, it cannot be attached to project " + md.Key)
+			return failed(404, nil, errors.New("repository "+md.Repository+" not found"))
+		}
+		data, exists, err = imp.Target.Get(requestData)
+		if err != nil || !exists {
+			return failed(0, nil, errors.New("repository "+md.Repository+" not found after creating it"))
+		}
+	}
+	have, err := access.Decode(requestData, data)
+	if err != nil {
+		return failed(0, data, err)
+	}
+	switch have.Project.Key {
+	case md.Key:
+		log.Info("worker ", i, " skipping repository ", md.Repository, " as it is already in project ", md.Key)
+		return scheduler.Result{State: scheduler.Skipped}
+	case "":
+	default:
+		log.Warn("adding to failure queue, repository: " + md.Repository + " is in project " + have.Project.Key + ", not " + md.Key)
+		return failed(409, nil, errors.New("repository "+md.Repository+" belongs to project "+have.Project.Key))
+	}
+	//rolling back detaches it again
+	err = imp.journal(journal.Record{Kind: journal.BeforeKind, ID: requestData.ID(), Type: requestData.AccessType, Name: md.Repository, Endpoint: requestData.Endpoint(), Absent: true})
+	if err != nil {
+		log.Warn("adding to failure queue, repository: " + md.Repository + " could not journal previous state " + err.Error())
+		return failed(0, nil, err)
+	}
+	_, _, expectedCode := requestData.Write(false)
+	data, respCode, getErr := imp.Target.AttachRepository(requestData)
+	if getErr != nil {
+		log.Warn("adding to failure queue, repository: " + md.Repository + " " + getErr.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return failed(respCode, data, getErr)
+	}
+	log.Info("worker ", i, " finished attaching repository ", md.Repository, " to project ", md.Key, " HTTP ", respCode)
+	if respCode != expectedCode {
+		log.Warn("some error occured attaching repository ", md.Repository, ":", string(data))
+		return failed(respCode, data, nil)
+	}
+	return scheduler.Result{State: scheduler.Succeeded, StatusCode: respCode, Body: data}
+}
+
+//applyPolicy look up what the target already has and work out what to send, according to the -groupPolicy, -userPolicy
+//or -permissionPolicy. The previous state is journaled first so the import can be rolled back.
+//A non nil result finishes the job without sending anything
+func (imp *Importer) applyPolicy(requestData access.ListTypes, i int) (access.ListTypes, bool, *scheduler.Result) {
+	return imp.applyPolicies(imp.Policies, requestData, i)
+}
+
+//applyPolicies applyPolicy with the given policies instead of the importer's
+func (imp *Importer) applyPolicies(policies policy.Policies, requestData access.ListTypes, i int) (access.ListTypes, bool, *scheduler.Result) {
+	data, exists, err := imp.Target.Get(requestData)
+	if err != nil {
+		log.Warn("adding to failure queue, " + requestData.AccessType + ": " + requestData.EntityName() + " " + err.Error())
+		result := failed(0, nil, err)
+		return requestData, false, &result
+	}
+	sent := requestData
+	if exists {
+		have, err := access.Decode(requestData, data)
+		if err != nil {
+			result := failed(0, data, err)
+			return requestData, true, &result
+		}
+		var ok bool
+		sent, ok = policies.Apply(have, requestData)
+		if !ok {
+			log.Info("worker ", i, " skipping ", requestData.AccessType, " ", requestData.EntityName(), " as it already exists")
+			return requestData, true, &scheduler.Result{State: scheduler.Skipped}
+		}
+	}
+	err = imp.journal(journal.Record{Kind: journal.BeforeKind, ID: requestData.ID(), Type: requestData.AccessType, Name: requestData.EntityName(), Endpoint: requestData.Endpoint(), Previous: data, Absent: !exists})
+	if err != nil {
+		//nothing is changed that could not be rolled back
+		log.Warn("adding to failure queue, " + requestData.AccessType + ": " + requestData.EntityName() + " could not journal previous state " + err.Error())
+		result := failed(0, nil, err)
+		return requestData, exists, &result
+	}
+	return sent, exists, nil
+}
+
+func (imp *Importer) permissionRepoVerification(md access.PermissionV2Import, requestData access.ListTypes, i int) scheduler.Result {
+	if md.Repo == nil {
+		log.Warn("adding to failure queue, permission: " + md.Name + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return failed(0, nil, errors.New("build permission target references a missing repository"))
+	}
+
+	//one or more repo's dont exist, attempt to fix
+	newRepos, err := imp.Repositories.Resolve(imp.Target, md.Repo.Repositories)
+	if err != nil {
+		log.Warn("adding to failure queue, permission: " + md.Name + " " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return failed(0, nil, err)
+	}
+	log.Info("worker ", i, " new repo list index:", requestData.PermissionIndex, " name:", md.Name, " ", newRepos)
+	repo := *md.Repo
+	repo.Repositories = newRepos
+	md.Repo = &repo
+	requestData.PermissionV2 = md
+	data, respPermCode, getErr := imp.Target.PutPermissionV2(requestData)
+	if getErr != nil {
+		log.Warn("adding to failure queue, permission: " + md.Name + " " + getErr.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return failed(respPermCode, data, getErr)
+	}
+	if respPermCode != 200 {
+		log.Warn("worker ", i, " some error occured on 2nd attempt permission v2 index ", requestData.PermissionIndex, ":", string(data))
+		log.Warn("adding to failure queue, permission: " + md.Name + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return failed(respPermCode, data, nil)
+	}
+	log.Info("worker ", i, " succeeded on 2nd attempt permission v2 index ", requestData.PermissionIndex, ":", string(data))
+	return scheduler.Result{State: scheduler.Succeeded, StatusCode: respPermCode, Body: data}
+}
+
+func (imp *Importer) permissionV1RepoVerification(md access.PermissionImport, requestData access.ListTypes, i int, respCode int, respData []byte) scheduler.Result {
+	if imp.Repositories.Config == nil {
+		//repo does not exist and there is no config xml to recreate it from, not worth retrying
+		return scheduler.Result{State: scheduler.Skipped, StatusCode: respCode, Body: respData}
+	}
+	newRepos, err := imp.Repositories.Resolve(imp.Target, md.Repositories)
+	if err != nil {
+		log.Warn("adding to failure queue, permission: " + md.Name + " " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return failed(0, nil, err)
+	}
+	log.Info("worker ", i, " new repo list index:", requestData.PermissionIndex, " name:", md.Name, " ", newRepos)
+	md.Repositories = newRepos
+	requestData.Permission = md
+	data, respPermCode, getErr := imp.Target.PutPermissionV1(requestData)
+	if getErr != nil {
+		log.Warn("adding to failure queue, permission: " + md.Name + " " + getErr.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return failed(respPermCode, data, getErr)
+	}
+	if respPermCode != 200 {
+		log.Warn("worker ", i, " some error occured on 2nd attempt permission index ", requestData.PermissionIndex, ":", string(data))
+		log.Warn("adding to failure queue, permission: " + md.Name + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return failed(respPermCode, data, nil)
+	}
+	log.Info("worker ", i, " succeeded on 2nd attempt permission index ", requestData.PermissionIndex, ":", string(data))
+	return scheduler.Result{State: scheduler.Succeeded, StatusCode: respPermCode, Body: data}
+}
@@ -0,0 +1,587 @@
+package importer
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"security-json-import/access"
+	"security-json-import/helpers"
+	"security-json-import/policy"
+	"security-json-import/repository"
+	"security-json-import/scheduler"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.ErrorLevel)
+	os.Exit(m.Run())
+}
+
+//fakeTarget a legacy API target in memory. Permission targets are refused like Artifactory does when they reference
+//repositories or users it does not have
+type fakeTarget struct {
+	mu sync.Mutex
+	//entities the payload of everything on the target by key
+	entities map[string][]byte
+	repos    map[string]bool
+	//status answers every write to a key with this status instead
+	status map[string]int
+	//calls every write, as method and key
+	calls []string
+	//lookup called on every user lookup outside the lock, an error fails the lookup. Optional
+	lookup func(name string) error
+}
+
+func newFakeTarget() *fakeTarget {
+	return &fakeTarget{entities: make(map[string][]byte), repos: make(map[string]bool), status: make(map[string]int)}
+}
+
+//have put item on the target before the import
+func (f *fakeTarget) have(item access.ListTypes) *fakeTarget {
+	data, _ := json.Marshal(item.Payload())
+	f.entities[item.Key()] = data
+	return f
+}
+
+//decoded what the target has for item, nil if nothing
+func (f *fakeTarget) decoded(t *testing.T, item access.ListTypes) *access.ListTypes {
+	t.Helper()
+	f.mu.Lock()
+	data, ok := f.entities[item.Key()]
+	f.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	have, err := access.Decode(item, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &have
+}
+
+func (f *fakeTarget) write(method string, item access.ListTypes, code int) ([]byte, int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, method+" "+item.Key())
+	if status, ok := f.status[item.Key()]; ok {
+		return []byte(`{"errors":[{"status":` + strconv.Itoa(status) + `,"message":"refused"}]}`), status, nil
+	}
+	data, _ := json.Marshal(item.Payload())
+	f.entities[item.Key()] = data
+	return nil, code, nil
+}
+
+func (f *fakeTarget) Get(item access.ListTypes) ([]byte, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.entities[item.Key()]
+	return data, ok, nil
+}
+
+func (f *fakeTarget) GetUser(name string) (access.UserImport, bool, error) {
+	if f.lookup != nil {
+		if err := f.lookup(name); err != nil {
+			return access.UserImport{}, false, err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var user access.UserImport
+	data, ok := f.entities["user/"+name]
+	if ok {
+		json.Unmarshal(data, &user)
+	}
+	return user, ok, nil
+}
+
+func (f *fakeTarget) CreateGroup(item access.ListTypes, exists bool) ([]byte, int, error) {
+	return f.write("PUT", item, 201)
+}
+
+func (f *fakeTarget) PutUser(item access.ListTypes, exists, update bool) ([]byte, int, error) {
+	if update {
+		return f.write("POST", item, 200)
+	}
+	return f.write("PUT", item, 201)
+}
+
+func (f *fakeTarget) PutPermissionV1(item access.ListTypes) ([]byte, int, error) {
+	return f.write("PUT", item, 200)
+}
+
+func (f *fakeTarget) PutPermissionV2(item access.ListTypes) ([]byte, int, error) {
+	f.mu.Lock()
+	for _, target := range []*access.PermissionDataV2Import{item.PermissionV2.Repo, item.PermissionV2.Build} {
+		if target == nil {
+			continue
+		}
+		for _, repo := range target.Repositories {
+			if !f.repos[repo] && !strings.HasPrefix(repo, "ANY") {
+				f.calls = append(f.calls, "PUT "+item.Key())
+				f.mu.Unlock()
+				return []byte(`{"errors":[{"status":400,"message":"Permission target contains a reference to a non-existing repository '` + repo + `'"}]}`), 400, nil
+			}
+		}
+		for user := range target.Actions.Users {
+			if _, ok := f.entities["user/"+user]; !ok {
+				f.calls = append(f.calls, "PUT "+item.Key())
+				f.mu.Unlock()
+				return []byte(`{"errors":[{"status":400,"message":"Permission target contains a reference to a non-existing user '` + user + `'"}]}`), 400, nil
+			}
+		}
+	}
+	f.mu.Unlock()
+	return f.write("PUT", item, 200)
+}
+
+func (f *fakeTarget) PutProject(item access.ListTypes, exists bool) ([]byte, int, error) {
+	_, _, code := item.Write(exists)
+	return f.write("PUT", item, code)
+}
+
+func (f *fakeTarget) AttachRepository(item access.ListTypes) ([]byte, int, error) {
+	_, _, code := item.Write(false)
+	return f.write("PUT", item, code)
+}
+
+func (f *fakeTarget) RepoExists(key string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.repos[key], nil
+}
+
+func (f *fakeTarget) CreateRepo(key string, config []byte) ([]byte, int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "PUT repository/"+key)
+	f.repos[key] = true
+	return nil, 200, nil
+}
+
+func group(name, description string) access.ListTypes {
+	return access.ListTypes{AccessType: "group", Name: name, Group: access.GroupImport{Name: name, Description: description}}
+}
+
+func user(name, email string, groups ...string) access.ListTypes {
+	return access.ListTypes{AccessType: "user", Name: name, User: access.UserImport{Name: name, Email: email, Password: "secret", Groups: groups}}
+}
+
+//permission a v2 repo permission target giving each user read on repos
+func permission(name string, repos []string, users ...string) access.ListTypes {
+	actions := access.PermissionV2ActionsImport{Users: make(map[string][]string)}
+	for _, u := range users {
+		actions.Users[u] = []string{"read"}
+	}
+	return access.ListTypes{AccessType: "permissionV2", Name: name, PermissionV2: access.PermissionV2Import{Name: name, Repo: &access.PermissionDataV2Import{Repositories: repos, Actions: actions}}}
+}
+
+//newImporter importer into target with the default flags and the given policy for every type
+func newImporter(t *testing.T, target Target, p string) *Importer {
+	t.Helper()
+	flags := helpers.DefaultFlags()
+	if p != "" {
+		flags.GroupPolicyVar, flags.UserPolicyVar, flags.PermissionPolicyVar = p, p, p
+	}
+	imp, err := New(target, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return imp
+}
+
+func TestNewRejectsNoWorkers(t *testing.T) {
+	flags := helpers.DefaultFlags()
+	flags.WorkersVar = 0
+	if _, err := New(newFakeTarget(), flags); err == nil {
+		t.Error("New() with no workers = nil error, want one")
+	}
+	flags = helpers.DefaultFlags()
+	flags.UserPolicyVar = ""
+	if _, err := New(newFakeTarget(), flags); err == nil {
+		t.Error("New() with an empty policy = nil error, want one")
+	}
+}
+
+func TestProcess(t *testing.T) {
+	target := newFakeTarget()
+	imp := newImporter(t, target, "")
+	var started []string
+	imp.OnStart = func(job scheduler.Job) {
+		started = append(started, job.Key)
+	}
+	tests := []struct {
+		item  access.ListTypes
+		state scheduler.State
+		call  string
+	}{
+		{group("devs", ""), scheduler.Succeeded, "PUT group/devs"},
+		{user("bob", "bob@example.com", "devs"), scheduler.Succeeded, "PUT user/bob"},
+		{permission("p", []string{"ANY"}, "bob"), scheduler.Succeeded, "PUT permissionV2/p"},
+		{access.ListTypes{AccessType: "nonsense", Name: "x"}, scheduler.Failed, ""},
+	}
+	for _, tt := range tests {
+		target.calls = nil
+		result := imp.process(0, &scheduler.Job{Key: tt.item.Key(), Item: tt.item, Attempts: 1})
+		if result.State != tt.state {
+			t.Errorf("process(%s) = %s, want %s", tt.item.Key(), result.State, tt.state)
+		}
+		if tt.call != "" && !reflect.DeepEqual(target.calls, []string{tt.call}) {
+			t.Errorf("process(%s) sent %v, want %s", tt.item.Key(), target.calls, tt.call)
+		}
+	}
+	if len(started) != len(tests) {
+		t.Errorf("OnStart called for %v, want every job", started)
+	}
+}
+
+func TestImportGroup(t *testing.T) {
+	existing := group("devs", "on the target")
+	tests := []struct {
+		name        string
+		policy      string
+		have        bool
+		item        access.ListTypes
+		skipIndex   int
+		state       scheduler.State
+		description string
+	}{
+		{"create", policy.Overwrite, false, group("devs", "imported"), -1, scheduler.Succeeded, "imported"},
+		{"skip-existing creates", policy.SkipExisting, false, group("devs", "imported"), -1, scheduler.Succeeded, "imported"},
+		{"skip-existing leaves it", policy.SkipExisting, true, group("devs", "imported"), -1, scheduler.Skipped, "on the target"},
+		{"overwrite replaces it", policy.Overwrite, true, group("devs", "imported"), -1, scheduler.Succeeded, "imported"},
+		{"overwrite with an empty description", policy.Overwrite, true, group("devs", ""), -1, scheduler.Succeeded, ""},
+		{"merge keeps the description if the import has none", policy.Merge, true, group("devs", ""), -1, scheduler.Succeeded, "on the target"},
+		{"merge takes the imported description", policy.Merge, true, group("devs", "imported"), -1, scheduler.Succeeded, "imported"},
+		{"below -skipGroupIndex", policy.Overwrite, false, group("devs", "imported"), 1, scheduler.Skipped, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newFakeTarget()
+			if tt.have {
+				target.have(existing)
+			}
+			imp := newImporter(t, target, tt.policy)
+			imp.Flags.SkipGroupIndexVar = tt.skipIndex
+			result := imp.importGroup(tt.item, 0)
+			if result.State != tt.state {
+				t.Fatalf("importGroup() = %s, want %s", result.State, tt.state)
+			}
+			got := target.decoded(t, tt.item)
+			if got == nil {
+				if tt.description != "" || tt.state != scheduler.Skipped {
+					t.Fatal("group not on the target")
+				}
+				return
+			}
+			if got.Group.Description != tt.description {
+				t.Errorf("description = %q, want %q", got.Group.Description, tt.description)
+			}
+		})
+	}
+}
+
+func TestImportGroupFailure(t *testing.T) {
+	target := newFakeTarget()
+	target.status["group/devs"] = 500
+	result := newImporter(t, target, "").importGroup(group("devs", ""), 0)
+	if result.State != scheduler.Failed || result.StatusCode != 500 {
+		t.Errorf("importGroup() = %s HTTP %d, want failed with 500", result.State, result.StatusCode)
+	}
+}
+
+func TestImportUser(t *testing.T) {
+	existing := user("bob", "old@example.com", "ops")
+	existing.User.Password = ""
+	tests := []struct {
+		name   string
+		policy string
+		have   bool
+		item   access.ListTypes
+		state  scheduler.State
+		call   string
+		want   access.UserImport
+	}{
+		{"create", policy.Merge, false, user("bob", "bob@example.com", "devs"), scheduler.Succeeded, "PUT user/bob",
+			access.UserImport{Name: "bob", Email: "bob@example.com", Password: "secret", Groups: []string{"devs"}}},
+		{"skip-existing leaves it", policy.SkipExisting, true, user("bob", "bob@example.com", "devs"), scheduler.Skipped, "",
+			access.UserImport{Name: "bob", Email: "old@example.com", Groups: []string{"ops"}}},
+		{"overwrite replaces it", policy.Overwrite, true, user("bob", "bob@example.com", "devs"), scheduler.Succeeded, "PUT user/bob",
+			access.UserImport{Name: "bob", Email: "bob@example.com", Password: "secret", Groups: []string{"devs"}}},
+		{"merge updates in place keeping groups and password", policy.Merge, true, user("bob", "", "devs"), scheduler.Succeeded, "POST user/bob",
+			access.UserImport{Name: "bob", Email: "old@example.com", Groups: []string{"ops", "devs"}}},
+		{"internal users are never imported", policy.Overwrite, false, user("admin", "a@example.com"), scheduler.Skipped, "", access.UserImport{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newFakeTarget()
+			if tt.have {
+				target.have(existing)
+			}
+			imp := newImporter(t, target, tt.policy)
+			result := imp.importUser(tt.item, 0)
+			if result.State != tt.state {
+				t.Fatalf("importUser() = %s, want %s", result.State, tt.state)
+			}
+			var calls []string
+			if tt.call != "" {
+				calls = []string{tt.call}
+			}
+			if !reflect.DeepEqual(target.calls, calls) {
+				t.Errorf("sent %v, want %v", target.calls, calls)
+			}
+			got := target.decoded(t, tt.item)
+			if got == nil {
+				if tt.want.Name != "" {
+					t.Fatal("user not on the target")
+				}
+				return
+			}
+			if !reflect.DeepEqual(got.User, tt.want) {
+				t.Errorf("target has %+v, want %+v", got.User, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportUserOncePerGroup(t *testing.T) {
+	//-usersFromGroups reads a user once per group, under every policy the user ends up in all of them
+	for _, p := range []string{policy.Overwrite, policy.Merge, policy.SkipExisting} {
+		t.Run(p, func(t *testing.T) {
+			target := newFakeTarget()
+			imp := newImporter(t, target, p)
+			for _, g := range []string{"devs", "ops", "qa"} {
+				if result := imp.importUser(user("bob", "bob@example.com", g), 0); result.State != scheduler.Succeeded {
+					t.Fatalf("importUser(%s) = %s, want succeeded", g, result.State)
+				}
+			}
+			got := target.decoded(t, user("bob", ""))
+			if !reflect.DeepEqual(got.User.Groups, []string{"devs", "ops", "qa"}) {
+				t.Errorf("groups = %v, want all three", got.User.Groups)
+			}
+		})
+	}
+}
+
+func TestImportPermissionV2(t *testing.T) {
+	existing := permission("p", []string{"libs"}, "alice")
+	tests := []struct {
+		name   string
+		policy string
+		have   bool
+		item   access.ListTypes
+		state  scheduler.State
+		repos  []string
+		users  []string
+	}{
+		{"create", policy.Overwrite, false, permission("p", []string{"libs"}, "bob"), scheduler.Succeeded, []string{"libs"}, []string{"bob"}},
+		{"skip-existing leaves it", policy.SkipExisting, true, permission("p", []string{"docker"}, "bob"), scheduler.Skipped, []string{"libs"}, []string{"alice"}},
+		{"overwrite replaces it", policy.Overwrite, true, permission("p", []string{"docker"}, "bob"), scheduler.Succeeded, []string{"docker"}, []string{"bob"}},
+		{"merge unions repositories and principals", policy.Merge, true, permission("p", []string{"docker"}, "bob"), scheduler.Succeeded, []string{"libs", "docker"}, []string{"alice", "bob"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newFakeTarget()
+			target.repos["libs"], target.repos["docker"] = true, true
+			target.have(user("alice", "")).have(user("bob", ""))
+			if tt.have {
+				target.have(existing)
+			}
+			imp := newImporter(t, target, tt.policy)
+			result := imp.importPermissionV2(&scheduler.Job{Item: tt.item, Attempts: 1}, 0)
+			if result.State != tt.state {
+				t.Fatalf("importPermissionV2() = %s, want %s", result.State, tt.state)
+			}
+			got := target.decoded(t, tt.item).PermissionV2.Repo
+			if !reflect.DeepEqual(got.Repositories, tt.repos) {
+				t.Errorf("repositories = %v, want %v", got.Repositories, tt.repos)
+			}
+			var users []string
+			for _, u := range []string{"alice", "bob"} {
+				if _, ok := got.Actions.Users[u]; ok {
+					users = append(users, u)
+				}
+			}
+			if !reflect.DeepEqual(users, tt.users) {
+				t.Errorf("users = %v, want %v", users, tt.users)
+			}
+		})
+	}
+}
+
+func TestImportPermissionV2Repositories(t *testing.T) {
+	config := &repository.Config{Definitions: map[string]repository.Definition{
+		"libs-local": {Key: "libs-local", RClass: "local", PackageType: "maven"},
+	}}
+	tests := []struct {
+		name    string
+		config  *repository.Config
+		item    access.ListTypes
+		state   scheduler.State
+		repos   []string
+		created []string
+	}{
+		{"missing repository without config xml is dropped", nil, permission("p", []string{"libs", "libs-local"}), scheduler.Succeeded, []string{"libs"}, nil},
+		{"missing repository is created from config xml", config, permission("p", []string{"libs", "libs-local"}), scheduler.Succeeded, []string{"libs", "libs-local"}, []string{"PUT repository/libs-local"}},
+		{"missing repository not in config xml is dropped", config, permission("p", []string{"libs", "gone"}), scheduler.Succeeded, []string{"libs"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newFakeTarget()
+			target.repos["libs"] = true
+			imp := newImporter(t, target, "")
+			imp.Repositories = repository.NewResolver(tt.config)
+			result := imp.importPermissionV2(&scheduler.Job{Item: tt.item, Attempts: 1}, 0)
+			if result.State != tt.state {
+				t.Fatalf("importPermissionV2() = %s, want %s", result.State, tt.state)
+			}
+			if got := target.decoded(t, tt.item).PermissionV2.Repo.Repositories; !reflect.DeepEqual(got, tt.repos) {
+				t.Errorf("repositories = %v, want %v", got, tt.repos)
+			}
+			var created []string
+			for _, call := range target.calls {
+				if strings.HasPrefix(call, "PUT repository/") {
+					created = append(created, call)
+				}
+			}
+			if !reflect.DeepEqual(created, tt.created) {
+				t.Errorf("created %v, want %v", created, tt.created)
+			}
+		})
+	}
+
+	//a build permission target has no repositories to fix
+	target := newFakeTarget()
+	build := permission("b", []string{"gone"})
+	build.PermissionV2.Build, build.PermissionV2.Repo = build.PermissionV2.Repo, nil
+	if result := newImporter(t, target, "").importPermissionV2(&scheduler.Job{Item: build, Attempts: 1}, 0); result.State != scheduler.Failed {
+		t.Errorf("importPermissionV2(build) = %s, want failed", result.State)
+	}
+}
+
+func TestImportPermissionV2MissingUser(t *testing.T) {
+	target := newFakeTarget()
+	imp := newImporter(t, target, "")
+	item := permission("p", []string{"ANY"}, "ghost")
+	job := &scheduler.Job{Item: item, Attempts: 1}
+	result := imp.importPermissionV2(job, 0)
+	if result.State != scheduler.Pending {
+		t.Fatalf("importPermissionV2() = %s, want pending until the created user is in", result.State)
+	}
+	ghost, found, _ := target.GetUser("ghost")
+	if !found || !ghost.InternalPasswordDisabled || ghost.Password != "" {
+		t.Fatalf("created %+v, want ghost without a password", ghost)
+	}
+	job.Attempts++
+	if result := imp.importPermissionV2(job, 0); result.State != scheduler.Succeeded {
+		t.Fatalf("second importPermissionV2() = %s, want succeeded", result.State)
+	}
+
+	//a user that cannot be created fails the permission target
+	target = newFakeTarget()
+	target.status["user/ghost"] = 400
+	imp = newImporter(t, target, "")
+	if result := imp.importPermissionV2(&scheduler.Job{Item: item, Attempts: 1}, 0); result.State != scheduler.Failed {
+		t.Errorf("importPermissionV2() = %s, want failed when the user cannot be created", result.State)
+	}
+
+	//not knowing whether the user exists, it is not created over one that might
+	target = newFakeTarget()
+	target.lookup = func(name string) error { return errors.New("HTTP 503") }
+	imp = newImporter(t, target, "")
+	if result := imp.importPermissionV2(&scheduler.Job{Item: item, Attempts: 1}, 0); result.State != scheduler.Failed {
+		t.Errorf("importPermissionV2() = %s, want failed when the user lookup fails", result.State)
+	}
+	if !reflect.DeepEqual(target.calls, []string{"PUT permissionV2/p"}) {
+		t.Errorf("sent %v after a failed user lookup, want only the permission target", target.calls)
+	}
+	target.lookup = nil
+	if result := imp.importPermissionV2(&scheduler.Job{Item: item, Attempts: 1}, 0); result.State != scheduler.Pending {
+		t.Errorf("importPermissionV2() = %s after the lookup works again, want pending", result.State)
+	}
+
+	//still refused after the retries, or refused for a user the import is bringing, fails without creating anything
+	target = newFakeTarget()
+	imp = newImporter(t, target, "")
+	imp.Add(user("ghost", ""))
+	result = imp.importPermissionV2(&scheduler.Job{Item: item, Attempts: 3}, 0)
+	if result.State != scheduler.Failed {
+		t.Errorf("importPermissionV2() = %s, want failed", result.State)
+	}
+	if _, found, _ := target.GetUser("ghost"); found {
+		t.Error("created a user the import is bringing itself")
+	}
+}
+
+func TestCreateMissingUserDoesNotWaitForOthers(t *testing.T) {
+	target := newFakeTarget()
+	release := make(chan struct{})
+	target.lookup = func(name string) error {
+		if name == "slow" {
+			<-release
+		}
+		return nil
+	}
+	imp := newImporter(t, target, "")
+	slow := make(chan scheduler.Result)
+	go func() {
+		slow <- imp.createMissingUser("slow", "", 0)
+	}()
+	//while the lookup of slow hangs, other users are still created, and slow only once
+	for _, name := range []string{"fast", "fast"} {
+		if result := imp.createMissingUser(name, "", 1); result.State == scheduler.Failed {
+			t.Fatalf("createMissingUser(%s) = %s", name, result.State)
+		}
+	}
+	close(release)
+	if result := <-slow; result.State != scheduler.Succeeded {
+		t.Errorf("createMissingUser(slow) = %s, want succeeded", result.State)
+	}
+	if result := imp.createMissingUser("slow", "", 0); result.State != scheduler.Skipped {
+		t.Errorf("createMissingUser(slow) again = %s, want skipped", result.State)
+	}
+	if !reflect.DeepEqual(target.calls, []string{"PUT user/fast", "PUT user/slow"}) {
+		t.Errorf("sent %v, want each user created once", target.calls)
+	}
+}
+
+func TestImport(t *testing.T) {
+	target := newFakeTarget()
+	target.repos["libs"] = true
+	target.have(group("ops", "on the target"))
+	imp := newImporter(t, target, policy.SkipExisting)
+	var mu sync.Mutex
+	completed := make(map[string]scheduler.State)
+	imp.OnComplete = func(job scheduler.Job) {
+		mu.Lock()
+		completed[job.Item.ID()] = job.State
+		mu.Unlock()
+	}
+	//out of order, the scheduler puts groups and users first. ghost is in neither the source nor the target
+	stats := imp.Import([]access.ListTypes{
+		permission("p", []string{"libs"}, "bob", "ghost"),
+		user("bob", "bob@example.com", "devs"),
+		user("bob", "bob@example.com", "ops"),
+		group("devs", ""),
+		group("ops", "imported"),
+	})
+	want := map[string]scheduler.State{"permissionV2/p": scheduler.Succeeded, "user/bob#devs": scheduler.Succeeded, "user/bob#ops": scheduler.Succeeded,
+		"group/devs": scheduler.Succeeded, "group/ops": scheduler.Skipped}
+	if !reflect.DeepEqual(completed, want) {
+		t.Errorf("completed %v, want %v", completed, want)
+	}
+	if stats.Total != 5 || stats.States[scheduler.Succeeded] != 4 || stats.States[scheduler.Skipped] != 1 {
+		t.Errorf("Stats() = %+v, want 4 succeeded and 1 skipped", stats)
+	}
+	if got := target.decoded(t, user("bob", "")).User.Groups; !reflect.DeepEqual(got, []string{"devs", "ops"}) && !reflect.DeepEqual(got, []string{"ops", "devs"}) {
+		t.Errorf("bob is in %v, want devs and ops", got)
+	}
+	if _, found, _ := target.GetUser("ghost"); !found {
+		t.Error("ghost was not created")
+	}
+}
@@ -0,0 +1,182 @@
+package journal
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"security-json-import/helpers"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Record one line of the journal: a run header, the state of an entity before it was changed, or the outcome of one entity
+type Record struct {
+	Time     time.Time         `json:"time"`
+	Kind     string            `json:"kind"`
+	Inputs   map[string]string `json:"inputs,omitempty"`
+	ID       string            `json:"id,omitempty"`
+	Type     string            `json:"type,omitempty"`
+	Name     string            `json:"name,omitempty"`
+	State    string            `json:"state,omitempty"`
+	Status   int               `json:"status,omitempty"`
+	Attempts int               `json:"attempts,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	//before records, Previous is what the target returned for Endpoint, or Absent if it did not exist
+	Endpoint string          `json:"endpoint,omitempty"`
+	Previous json.RawMessage `json:"previous,omitempty"`
+	Absent   bool            `json:"absent,omitempty"`
+}
+
+const (
+	HeaderKind  = "header"
+	OutcomeKind = "outcome"
+	BeforeKind  = "before"
+)
+
+//Writer appends records to the journal, one JSON object per line, flushed as they come
+type Writer struct {
+	mu   sync.Mutex
+	Path string
+	file *os.File
+	buf  *bufio.Writer
+}
+
+//Open journal for appending, creating it if needed
+func Open(path string) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.New("Error opening journal: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	return &Writer{Path: path, file: file, buf: bufio.NewWriter(file)}, nil
+}
+
+//Write append a record, stamping the time if unset
+func (w *Writer) Write(record Record) error {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(data)
+	w.buf.WriteByte('\n')
+	return w.buf.Flush()
+}
+
+//Close flush and close the journal
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Flush()
+	return w.file.Close()
+}
+
+//Checkpoint state of a journal, the last outcome wins
+type Checkpoint struct {
+	Inputs   map[string]string
+	Outcomes map[string]Record
+	//Before the first before record of every endpoint, in journal order, so the state from before the first run
+	Before []Record
+}
+
+//Completed true if the entity succeeded or was skipped in an earlier run
+func (c *Checkpoint) Completed(id string) bool {
+	if c == nil {
+		return false
+	}
+	record, ok := c.Outcomes[id]
+	return ok && (record.State == "succeeded" || record.State == "skipped")
+}
+
+//Succeeded true if the entity was imported by a run, rather than skipped
+func (c *Checkpoint) Succeeded(id string) bool {
+	if c == nil {
+		return false
+	}
+	record, ok := c.Outcomes[id]
+	return ok && record.State == "succeeded"
+}
+
+//Load read a journal back, streaming it line by line
+func Load(path string) (*Checkpoint, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New("Error reading journal: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	defer file.Close()
+	checkpoint := &Checkpoint{Outcomes: make(map[string]Record)}
+	captured := make(map[string]bool)
+	dec := json.NewDecoder(bufio.NewReader(file))
+	for {
+		var record Record
+		err := dec.Decode(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			//a crash can leave a torn last line, everything before it still counts
+			if err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, errors.New("Error parsing journal: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		switch record.Kind {
+		case HeaderKind:
+			checkpoint.Inputs = record.Inputs
+		case OutcomeKind:
+			checkpoint.Outcomes[record.ID] = record
+		case BeforeKind:
+			if !captured[record.Endpoint] {
+				captured[record.Endpoint] = true
+				checkpoint.Before = append(checkpoint.Before, record)
+			}
+		}
+	}
+	return checkpoint, nil
+}
+
+//HashInputs sha256 of every input file with a non empty path, keyed by the flag it came from
+func HashInputs(inputs map[string]string) (map[string]string, error) {
+	hashes := make(map[string]string)
+	for name, path := range inputs {
+		if path == "" {
+			continue
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, errors.New("Error hashing " + name + ": " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		hash := sha256.New()
+		_, err = io.Copy(hash, file)
+		file.Close()
+		if err != nil {
+			return nil, errors.New("Error hashing " + name + ": " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		hashes[name] = hex.EncodeToString(hash.Sum(nil))
+	}
+	return hashes, nil
+}
+
+//ChangedInputs inputs whose hash differs from the journal, including ones that were added or dropped
+func ChangedInputs(journaled, current map[string]string) []string {
+	var changed []string
+	for name, hash := range current {
+		if journaled[name] != hash {
+			changed = append(changed, name)
+		}
+	}
+	for name := range journaled {
+		if _, ok := current[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,156 @@
+package journal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.journal")
+	w, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []Record{
+		{Kind: HeaderKind, Inputs: map[string]string{"securityJSONFile": "aa"}},
+		{Kind: BeforeKind, ID: "group/devs", Type: "group", Name: "devs", Endpoint: "/api/security/groups/devs", Absent: true},
+		{Kind: OutcomeKind, ID: "group/devs", State: "failed", Status: 500},
+		{Kind: BeforeKind, ID: "user/bob", Type: "user", Name: "bob", Endpoint: "/api/security/users/bob", Previous: []byte(`{"name":"bob"}`)},
+		{Kind: OutcomeKind, ID: "user/bob", State: "succeeded", Status: 201},
+		//a later run changed devs again, the state from before the first run is the one to go back to
+		{Kind: HeaderKind, Inputs: map[string]string{"securityJSONFile": "bb"}},
+		{Kind: BeforeKind, ID: "group/devs", Type: "group", Name: "devs", Endpoint: "/api/security/groups/devs", Previous: []byte(`{"name":"devs"}`)},
+		{Kind: OutcomeKind, ID: "group/devs", State: "succeeded", Status: 201},
+		{Kind: OutcomeKind, ID: "permissionV2/p", State: "skipped"},
+		{Kind: OutcomeKind, ID: "user/alice", State: "blocked"},
+	}
+	for _, record := range records {
+		if err := w.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(checkpoint.Inputs, map[string]string{"securityJSONFile": "bb"}) {
+		t.Errorf("Inputs = %v, want the ones of the last header", checkpoint.Inputs)
+	}
+	var before []string
+	for _, record := range checkpoint.Before {
+		before = append(before, record.ID+" "+string(record.Previous))
+	}
+	if want := []string{"group/devs ", `user/bob {"name":"bob"}`}; !reflect.DeepEqual(before, want) {
+		t.Errorf("Before = %q, want %q", before, want)
+	}
+	if !checkpoint.Before[0].Absent {
+		t.Error("Before lost that devs was absent")
+	}
+	tests := []struct {
+		id                   string
+		completed, succeeded bool
+	}{
+		{"group/devs", true, true},
+		{"user/bob", true, true},
+		{"permissionV2/p", true, false},
+		{"user/alice", false, false},
+		{"user/nobody", false, false},
+	}
+	for _, tt := range tests {
+		if got := checkpoint.Completed(tt.id); got != tt.completed {
+			t.Errorf("Completed(%s) = %v, want %v", tt.id, got, tt.completed)
+		}
+		if got := checkpoint.Succeeded(tt.id); got != tt.succeeded {
+			t.Errorf("Succeeded(%s) = %v, want %v", tt.id, got, tt.succeeded)
+		}
+	}
+	var nothing *Checkpoint
+	if nothing.Completed("group/devs") || nothing.Succeeded("group/devs") {
+		t.Error("a nil checkpoint has nothing completed")
+	}
+}
+
+func TestLoadDamaged(t *testing.T) {
+	header := `{"kind":"header","inputs":{"securityJSONFile":"aa"}}` + "\n"
+	outcome := `{"kind":"outcome","id":"group/devs","state":"succeeded"}` + "\n"
+	tests := []struct {
+		name      string
+		data      string
+		completed bool
+		wantErr   bool
+	}{
+		{"empty", "", false, false},
+		{"torn last line after a crash", header + outcome + `{"kind":"outcome","id":"user/b`, true, false},
+		{"no header", outcome, true, false},
+		{"garbage in the middle", header + "not json\n" + outcome, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "run.journal")
+			if err := os.WriteFile(path, []byte(tt.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			checkpoint, err := Load(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && checkpoint.Completed("group/devs") != tt.completed {
+				t.Errorf("Completed(group/devs) = %v, want %v", !tt.completed, tt.completed)
+			}
+		})
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Load() of a missing journal = nil error, want one")
+	}
+}
+
+func TestChangedInputs(t *testing.T) {
+	tests := []struct {
+		name      string
+		journaled map[string]string
+		current   map[string]string
+		want      []string
+	}{
+		{"same", map[string]string{"a": "1", "b": "2"}, map[string]string{"a": "1", "b": "2"}, nil},
+		{"changed", map[string]string{"a": "1", "b": "2"}, map[string]string{"a": "1", "b": "3"}, []string{"b"}},
+		{"added", map[string]string{"a": "1"}, map[string]string{"a": "1", "b": "2"}, []string{"b"}},
+		{"dropped", map[string]string{"a": "1", "b": "2"}, map[string]string{"a": "1"}, []string{"b"}},
+		{"journal without a header", nil, map[string]string{"a": "1"}, []string{"a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ChangedInputs(tt.journaled, tt.current)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ChangedInputs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashInputs(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.json")
+	if err := os.WriteFile(a, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := HashInputs(map[string]string{"securityJSONFile": a, "configXMLFile": ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//sha256 of {}
+	want := map[string]string{"securityJSONFile": "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("HashInputs() = %v, want %v", got, want)
+	}
+	if _, err := HashInputs(map[string]string{"securityJSONFile": filepath.Join(dir, "missing")}); err == nil {
+		t.Error("HashInputs() of a missing file = nil error, want one")
+	}
+}
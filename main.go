@@ -2,19 +2,25 @@ package main
 
 import (
 	"bufio"
-	"container/list"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math/rand"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"security-json-import/access"
 	"security-json-import/auth"
+	"security-json-import/export"
 	"security-json-import/helpers"
-	"strconv"
+	"security-json-import/importer"
+	"security-json-import/journal"
+	"security-json-import/plan"
+	"security-json-import/prune"
+	"security-json-import/report"
+	"security-json-import/rollback"
+	"security-json-import/scheduler"
+	"security-json-import/verify"
 	"strings"
-	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -25,8 +31,139 @@ func main() {
 
 	flags := helpers.SetFlags()
 	helpers.SetLogger(flags.LogLevelVar)
+	if err := auth.ConfigureRetry(flags); err != nil {
+		log.Error(err)
+		os.Exit(helpers.ExitConfigError)
+	}
+	if err := auth.ConfigureClient(flags); err != nil {
+		log.Error(err)
+		os.Exit(helpers.ExitConfigError)
+	}
+	if err := access.CheckBackend(flags.BackendVar); err != nil {
+		log.Error(err)
+		os.Exit(helpers.ExitConfigError)
+	}
+	if err := auth.CheckAuthMode(flags); err != nil {
+		log.Error(err)
+		os.Exit(helpers.ExitConfigError)
+	}
+	targets, err := auth.ReadTargets(flags)
+	if err != nil {
+		log.Error(err)
+		os.Exit(helpers.ExitConfigError)
+	}
+	switch len(targets) {
+	case 0:
+		//-url missing, reported with the other missing flags
+		err = auth.ResolveCreds(&flags)
+	case 1:
+		flags, err = auth.TargetFlags(flags, targets[0])
+	default:
+		err = auth.ResolveSharedCreds(&flags)
+	}
+	if err != nil {
+		log.Error(err)
+		os.Exit(helpers.ExitConfigError)
+	}
+	if len(targets) > 1 && ((flags.Command != "" && flags.Command != "apply") || flags.DryRunVar) {
+		log.Error("Only the import and apply go to several targets at once, export, plan, verify, rollback and -dryRun take a single -url")
+		os.Exit(helpers.ExitConfigError)
+	}
+
+	switch flags.Command {
+	case "":
+	case "export":
+		exportUserGroupAssociation(flags)
+		return
+	case "plan":
+		planImport(flags)
+		return
+	case "verify":
+		verifyImport(flags)
+		return
+	case "rollback":
+		rollbackImport(flags)
+		return
+	case "bundle":
+		bundleSecurityJSON(flags, startTime)
+		return
+	case "apply":
+		if len(flags.Args) != 1 {
+			log.Error("apply needs the bundle to import, e.g. apply security.bundle.tgz")
+			os.Exit(helpers.ExitConfigError)
+		}
+		if flags.DryRunVar || flags.ReplayFailuresVar != "" {
+			log.Error("apply imports the bundle, it does not take -dryRun or -replayFailures")
+			os.Exit(helpers.ExitConfigError)
+		}
+	default:
+		log.Error("Unknown command ", flags.Command, ", expected export, plan, verify, rollback, bundle, apply or no command to import")
+		os.Exit(helpers.ExitConfigError)
+	}
 
-	stringFlags := map[string]string{"-user": flags.UsernameVar, "-apikey": flags.ApikeyVar, "-url": flags.URLVar, "-securityJSONFile": flags.SecurityJSONFileVar}
+	//every target gets its own -url, credentials and creds file
+	targetFlags := []helpers.Flags{flags}
+	if len(targets) > 1 {
+		targetFlags = nil
+		for _, target := range targets {
+			tf, err := auth.TargetFlags(flags, target)
+			if err != nil {
+				log.Error(target.Name, ": ", err)
+				os.Exit(helpers.ExitConfigError)
+			}
+			//one target waiting for an answer would hold up the others
+			tf.YesVar = true
+			targetFlags = append(targetFlags, tf)
+		}
+	} else if len(targets) == 0 {
+		targets = []auth.Target{{URL: flags.URLVar}}
+	}
+	for i, tf := range targetFlags {
+		missing := missingImportFlags(tf)
+		if missing {
+			if len(targets) > 1 {
+				log.Error("for target ", targets[i].Name)
+			}
+			os.Exit(helpers.ExitConfigError)
+		}
+		//if user name is admin, this can be problematic as it will likely exist in the import.
+		if tf.UsernameVar == "admin" || tf.UsernameVar == "access-admin" || tf.UsernameVar == "system" {
+			log.Warn("Your username ", tf.UsernameVar, " is a common user that may get overwritten. We recommend recreating a unique admin level user for this program to work correctly.")
+			os.Exit(helpers.ExitConfigError)
+		}
+	}
+
+	if flags.DryRunVar {
+		var creds auth.Creds
+		creds.Username = flags.UsernameVar
+		creds.Apikey = flags.ApikeyVar
+		creds.URL = flags.URLVar
+		dryRun(creds, flags)
+		return
+	}
+
+	//debug port
+	go func() {
+		http.ListenAndServe("0.0.0.0:8080", nil)
+	}()
+	os.Exit(importTargets(flags, targets, targetFlags, startTime))
+}
+
+//missingImportFlags log every required import flag that was not given, true if there were any
+func missingImportFlags(flags helpers.Flags) bool {
+	//replaying a failure report or applying a bundle needs neither security json nor the user group association file
+	replay := flags.ReplayFailuresVar != "" || flags.Command == "apply"
+	stringFlags := map[string]string{"-user": flags.UsernameVar, "-apikey": flags.ApikeyVar, "-url": flags.URLVar}
+	if !auth.NeedsUser(flags) {
+		delete(stringFlags, "-user")
+	}
+	if flags.Command == "bundle" {
+		//nothing is sent, the version to adapt to is given instead
+		stringFlags = map[string]string{"-targetVersion": flags.TargetVersionVar}
+	}
+	if !replay {
+		stringFlags["-securityJSONFile"] = flags.SecurityJSONFileVar
+	}
 
 	var missing bool = false
 	for i := range stringFlags {
@@ -35,7 +172,12 @@ func main() {
 			missing = true
 		}
 	}
-	if !flags.SkipUserImportVar {
+	if flags.PruneVar && replay {
+		//only part of the source is queued, everything else would look like it is not in the source
+		log.Error("-prune compares the target with the whole source, it cannot be used with -replayFailures or apply")
+		missing = true
+	}
+	if !flags.SkipUserImportVar && !replay {
 		if (flags.UsersWithGroupsVar == false && flags.UsersFromGroupsVar == false) || (flags.UsersWithGroupsVar == true && flags.UsersFromGroupsVar == true) {
 			log.Error("When selecting user import source, please only pick one: -usersWithGroups or -usersFromGroups")
 			missing = true
@@ -45,475 +187,376 @@ func main() {
 			missing = true
 		}
 	}
-	if missing {
-		os.Exit(2)
+	return missing
+}
+
+//resumeQueue marks items an earlier run completed as done instead of importing them again
+type resumeQueue struct {
+	imp        *importer.Importer
+	checkpoint *journal.Checkpoint
+}
+
+func (q *resumeQueue) Add(item access.ListTypes) {
+	if q.checkpoint.Completed(item.ID()) {
+		log.Debug("skipping ", item.ID(), " as it completed in an earlier run")
+		q.imp.AddDone(item, scheduler.Result{State: scheduler.Skipped, Err: errors.New("completed in an earlier run")})
+		return
 	}
-	//if user name is admin, this can be problematic as it will likely exist in the import.
-	if flags.UsernameVar == "admin" || flags.UsernameVar == "access-admin" || flags.UsernameVar == "system" {
-		log.Warn("Your username ", flags.UsernameVar, " is a common user that may get overwritten. We recommend recreating a unique admin level user for this program to work correctly.")
-		os.Exit(2)
+	q.imp.Add(item)
+}
+
+//monitor log progress until stop is closed, offering a manual break once only a few requests are left hanging
+func monitor(sched *scheduler.Scheduler, flags helpers.Flags, prefix string, stop chan struct{}) {
+	var draining time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Duration(flags.WorkerSleepVar) * time.Second):
+		}
+		stats := sched.Stats()
+		for _, line := range auth.ThrottleStatus() {
+			log.Info("throttle ", line)
+		}
+		if !stats.Closed || stats.Ready > 0 {
+			log.Debug(prefix, "work queue size ", stats.Ready, ", running ", stats.Running, " of ", stats.Total, " jobs")
+			draining = time.Time{}
+			continue
+		}
+		if draining.IsZero() {
+			draining = time.Now()
+		}
+		log.Info(prefix, "End detected, waiting for last few requests to go through. Request queue size ", stats.Running)
+		waited := time.Now().Sub(draining)
+		if !flags.YesVar && helpers.Interactive() {
+			timeout := flags.DrainTimeoutVar
+			if timeout == 0 {
+				timeout = time.Duration(60) * time.Second
+			}
+			if waited > timeout {
+				fmt.Println("Do you want to break manually? (y/n)")
+				if askForConfirmation() {
+					sched.Abort()
+					return
+				}
+				draining = time.Now()
+			}
+		} else if flags.DrainTimeoutVar > 0 && waited > flags.DrainTimeoutVar {
+			log.Warn(prefix, "Gave up waiting on ", stats.Running, " requests after -drainTimeout ", flags.DrainTimeoutVar)
+			sched.Abort()
+			return
+		}
 	}
+}
 
+//exportUserGroupAssociation write the -userGroupAssocationFile from the source at -url
+func exportUserGroupAssociation(flags helpers.Flags) {
+	stringFlags := map[string]string{"-user": flags.UsernameVar, "-apikey": flags.ApikeyVar, "-url": flags.URLVar, "-userGroupAssocationFile": flags.UserGroupAssocationFileVar}
+	if !auth.NeedsUser(flags) {
+		delete(stringFlags, "-user")
+	}
+	var missing bool = false
+	for i := range stringFlags {
+		if stringFlags[i] == "" {
+			log.Error(i + " cannot be empty")
+			missing = true
+		}
+	}
+	if missing {
+		os.Exit(helpers.ExitConfigError)
+	}
+	credCheck, err := auth.VerifyAPIKey(flags.URLVar, flags.UsernameVar, flags.ApikeyVar, flags)
+	if !credCheck || err != nil {
+		log.Error("Looks like there's an issue with checking your credentials. Exiting due to:", err)
+		os.Exit(helpers.ExitConfigError)
+	}
 	var creds auth.Creds
 	creds.Username = flags.UsernameVar
 	creds.Apikey = flags.ApikeyVar
 	creds.URL = flags.URLVar
+	err = export.Run(creds, flags)
+	if err != nil {
+		log.Error("Export failed: ", err)
+		os.Exit(helpers.ExitError)
+	}
+}
 
-	//use different users to create things
-	credsFilelength := 0
-	credsFileHash := make(map[int][]string)
-	if flags.CredsFileVar != "" {
-		credsFile, err := os.Open(flags.CredsFileVar)
-		if err != nil {
-			log.Error("Invalid creds file:", err)
-			os.Exit(1)
-		}
-		defer credsFile.Close()
-		scanner := bufio.NewScanner(credsFile)
-
-		for scanner.Scan() {
-			credsFileCreds := strings.Split(scanner.Text(), " ")
-			credsFileHash[credsFilelength] = credsFileCreds
-			credsFilelength = credsFilelength + 1
-		}
+//planImport compare what an import would send with the target at -url, without changing it
+func planImport(flags helpers.Flags) {
+	if missingImportFlags(flags) {
+		os.Exit(helpers.ExitConfigError)
+	}
+	if flags.PlanFormatVar != "text" && flags.PlanFormatVar != "json" {
+		log.Error("-planFormat must be text or json, not ", flags.PlanFormatVar)
+		os.Exit(helpers.ExitConfigError)
+	}
+	credCheck, err := auth.VerifyAPIKey(flags.URLVar, flags.UsernameVar, flags.ApikeyVar, flags)
+	if !credCheck || err != nil {
+		log.Error("Looks like there's an issue with checking your credentials. Exiting due to:", err)
+		os.Exit(helpers.ExitConfigError)
+	}
+	var creds auth.Creds
+	creds.Username = flags.UsernameVar
+	creds.Apikey = flags.ApikeyVar
+	creds.URL = flags.URLVar
+	entries, err := plan.Run(creds, flags)
+	if err != nil {
+		log.Error("Plan failed: ", err)
+		os.Exit(helpers.ExitError)
+	}
 
-		flags.UsernameVar = credsFileHash[0][0]
-		flags.ApikeyVar = credsFileHash[0][1]
-		log.Info("Number of creds in file:", credsFilelength)
-		log.Info("choose first one first:", flags.UsernameVar)
+	counts := make(map[string]int)
+	for _, entry := range entries {
+		counts[entry.Action]++
+	}
+	symbols := map[string]string{plan.Create: "+", plan.Update: "~", plan.Unchanged: "=", plan.Skip: "-", plan.Error: "!"}
+	summary := fmt.Sprint("Plan: ", counts[plan.Create], " to create, ", counts[plan.Update], " to update, ", counts[plan.Unchanged], " unchanged, ", counts[plan.Skip], " existing to skip, ", counts[plan.Error], " could not be read")
+	err = writeEntries(flags, entries, symbols, summary)
+	if err != nil {
+		log.Error("Could not write plan: ", err)
+		os.Exit(helpers.ExitError)
 	}
+	if counts[plan.Error] > 0 {
+		os.Exit(helpers.ExitPartialFailure)
+	}
+}
 
+//verifyImport read back what an import sent to -url and report any drift, limited to what -journal recorded as imported if given
+func verifyImport(flags helpers.Flags) {
+	if missingImportFlags(flags) {
+		os.Exit(helpers.ExitConfigError)
+	}
+	if flags.PlanFormatVar != "text" && flags.PlanFormatVar != "json" {
+		log.Error("-planFormat must be text or json, not ", flags.PlanFormatVar)
+		os.Exit(helpers.ExitConfigError)
+	}
 	credCheck, err := auth.VerifyAPIKey(flags.URLVar, flags.UsernameVar, flags.ApikeyVar, flags)
 	if !credCheck || err != nil {
 		log.Error("Looks like there's an issue with checking your credentials. Exiting due to:", err)
-		os.Exit(1)
+		os.Exit(helpers.ExitConfigError)
 	}
+	var creds auth.Creds
+	creds.Username = flags.UsernameVar
+	creds.Apikey = flags.ApikeyVar
+	creds.URL = flags.URLVar
 
-	//case switch for different access types
-	workQueue := list.New()
-	requestQueue := list.New()
-	failureQueue := list.New()
-
-	//hardcode for now
-	go func() {
-		err := access.ReadSecurityJSON(workQueue, flags)
+	var checkpoint *journal.Checkpoint
+	if flags.JournalVar != "" {
+		checkpoint, err = journal.Load(flags.JournalVar)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			log.Error(err)
+			os.Exit(helpers.ExitConfigError)
 		}
-	}()
-
-	//work queue
-	var ch = make(chan interface{}, flags.WorkersVar+1)
-	var wg sync.WaitGroup
-	for i := 0; i < flags.WorkersVar; i++ {
-		go func(i int) {
-			for {
-
-				s, ok := <-ch
-				if !ok {
-					log.Info("Worker being returned to queue", i)
-					wg.Done()
-				}
-
-				log.Debug("worker ", i, " starting job")
-
-				if flags.CredsFileVar != "" {
-					//pick random user and password from list
-					numCreds := len(credsFileHash)
-					rand.Seed(time.Now().UnixNano())
-					randCredIndex := rand.Intn(numCreds)
-					creds.Username = credsFileHash[randCredIndex][0]
-					creds.Apikey = credsFileHash[randCredIndex][1]
-				}
-
-				//get data
-				requestData := s.(access.ListTypes)
-				switch requestData.AccessType {
-				case "group":
-					requestQueue.PushBack(s)
-					md := requestData.Group
-					log.Debug("worker ", i, " starting group index:", requestData.GroupIndex, " name:", md.Name)
-					if requestData.GroupIndex < flags.SkipGroupIndexVar {
-						log.Info("worker ", i, " skipping group index:", requestData.GroupIndex, " name:", md.Name)
-
-					} else {
-
-						groupData, err := json.Marshal(md)
-						if err != nil {
-							log.Error("Error marshaling group, adding to failure queue: " + md.Name + " " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-							if requestQueue.Len() > 0 {
-								requestQueue.Remove(requestQueue.Front())
-							}
-							failureQueue.PushBack(requestData)
-							continue
-						}
-						log.Debug("worker ", i, " group JSON:", string(groupData), " index ", requestData.GroupIndex)
-						data, respGroupCode, _, getErr := auth.GetRestAPI("PUT", true, creds.URL+"/api/security/groups/"+md.Name, creds.Username, creds.Apikey, "", groupData, map[string]string{"Content-Type": "application/json"}, 0, flags, nil)
-						if getErr != nil {
-							failureQueue.PushBack(requestData)
-							if requestQueue.Len() > 0 {
-								requestQueue.Remove(requestQueue.Front())
-							}
-							log.Warn("adding to failure queue, group: " + md.Name + " " + getErr.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-							continue
-						}
-						log.Info("worker ", i, " finished creating group index:", requestData.GroupIndex, " name:", md.Name, " HTTP ", respGroupCode)
-						//201 created
-						if respGroupCode != 201 {
-							log.Warn("some error occured on group index ", requestData.GroupIndex, ":", string(data))
-							log.Warn("adding to failure queue, group: " + md.Name + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-							failureQueue.PushBack(requestData)
-						}
-					}
-					if requestQueue.Len() > 0 {
-						requestQueue.Remove(requestQueue.Front())
-					}
-
-				case "permission":
-					md := requestData.Permission
-					log.Debug("worker ", i, " starting permission index:", requestData.PermissionIndex, " name:", md.Name)
-					if requestData.PermissionIndex < flags.SkipPermissionIndexVar {
-						log.Info("worker ", i, " skipping permission index:", requestData.PermissionIndex, " name:", md.Name)
-					} else {
-						requestQueue.PushBack(s)
-						permissionData, err := json.Marshal(md)
-						if err != nil {
-							log.Error("Error marshaling permission, adding to failure queue: " + md.Name + " " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-							if requestQueue.Len() > 0 {
-								requestQueue.Remove(requestQueue.Front())
-							}
-							failureQueue.PushBack(requestData)
-							continue
-						}
-						log.Debug("worker ", i, " permission JSON:", string(permissionData), "index ", requestData.PermissionIndex)
-						data, respPermCode, _, getErr := auth.GetRestAPI("PUT", true, creds.URL+"/api/security/permissions/"+md.Name, creds.Username, creds.Apikey, "", permissionData, map[string]string{"Content-Type": "application/json"}, 0, flags, nil)
-						if getErr != nil {
-							log.Warn("adding to failure queue, permission: " + md.Name + " " + getErr.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-							failureQueue.PushBack(requestData)
-							if requestQueue.Len() > 0 {
-								requestQueue.Remove(requestQueue.Front())
-							}
-							continue
-						}
-						log.Info("worker ", i, " finished creating permission index:", requestData.PermissionIndex, " name:", md.Name, " HTTP ", respPermCode)
-						if respPermCode != 200 {
-							log.Warn("worker ", i, " some error occured on permission index ", requestData.PermissionIndex, ":", string(data))
-							log.Warn("worker ", i, " index ", requestData.PermissionIndex, ":", string(permissionData))
-							if strings.Contains(string(data), "Permission target contains a reference to a non-existing repository") {
-								//repo does not exist, do not push back into workqueue unless we want to handle this logic
-							} else {
-								log.Warn("adding to failure queue, user: " + md.Name + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-								failureQueue.PushBack(requestData)
-							}
-						}
-						if requestQueue.Len() > 0 {
-							requestQueue.Remove(requestQueue.Front())
-						}
-					}
-
-				case "permissionV2":
-
-					md := requestData.PermissionV2
-					log.Debug("worker ", i, " starting permission v2 index:", requestData.PermissionIndex, " name:", md.Name)
-					if requestData.PermissionIndex < flags.SkipPermissionIndexVar {
-						log.Info("worker ", i, " skipping permission v2 index:", requestData.PermissionIndex, " name:", md.Name)
-					} else {
-						requestQueue.PushBack(s)
-						permissionData, err := json.Marshal(md)
-						if err != nil {
-							log.Error("Error marshaling permission v2, adding to failure queue: " + md.Name + " " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-							if requestQueue.Len() > 0 {
-								requestQueue.Remove(requestQueue.Front())
-							}
-							failureQueue.PushBack(requestData)
-							continue
-						}
-						log.Debug("worker ", i, " permission v2 JSON:", string(permissionData), "index ", requestData.PermissionIndex)
-						data, respPermCode, _, getErr := auth.GetRestAPI("PUT", true, creds.URL+"/api/v2/security/permissions/"+md.Name, creds.Username, creds.Apikey, "", permissionData, map[string]string{"Content-Type": "application/json"}, 0, flags, nil)
-						if getErr != nil {
-							log.Warn("adding to failure queue, permission: " + md.Name + " " + getErr.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-							failureQueue.PushBack(requestData)
-							if requestQueue.Len() > 0 {
-								requestQueue.Remove(requestQueue.Front())
-							}
-							continue
-						}
-						log.Info("worker ", i, " finished creating permission v2 index:", requestData.PermissionIndex, " name:", md.Name, " HTTP ", respPermCode)
-						if respPermCode != 200 {
-							log.Warn("worker ", i, " some error occured on permission v2 index ", requestData.PermissionIndex, ":", string(data))
-							log.Warn("worker ", i, " index ", requestData.PermissionIndex, ":", string(permissionData))
-							if strings.Contains(string(data), "Permission target request missing repositories") {
-								permissionRepoVerification(creds, flags, md, failureQueue, requestQueue, requestData, i)
-							} else if strings.Contains(string(data), "reference to a non-existing user") {
-
-								var ArtError access.ArtifactoryError
-								err := json.Unmarshal(data, &ArtError)
-								if err != nil {
-									if requestQueue.Len() > 0 {
-										requestQueue.Remove(requestQueue.Front())
-									}
-									continue
-								}
-								if md.Repo != nil {
-									for y := range md.Repo.Actions.Users {
-										user := y
-										log.Warn("missing user:", user, "creating without context")
-										var data access.ListTypes
-										data.AccessType = "user"
-										var userData access.UserImport
-										userData.Name = user
-										userData.Email = user + flags.UserEmailDomainVar
-										userData.Password = "password"
-										userData.ProfileUpdatable = true
-										data.UserIndex = workQueue.Len() + 1
-										data.Name = user
-										data.User = userData
-										workQueue.PushBack(data)
-									}
-								} else {
-									for y := range md.Build.Actions.Users {
-										user := y
-										log.Warn("missing build user:", user, "creating without context")
-										var data access.ListTypes
-										data.AccessType = "user"
-										var userData access.UserImport
-										userData.Name = user
-										userData.Email = user + flags.UserEmailDomainVar
-										userData.Password = "password"
-										userData.ProfileUpdatable = true
-										data.UserIndex = workQueue.Len() + 1
-										data.Name = user
-										data.User = userData
-										workQueue.PushBack(data)
-									}
-
-								}
-								//push back permissions again
-								failureQueue.PushBack(requestData)
-
-							} else if strings.Contains(string(data), "Permission target contains a reference to a non-existing repository") {
-								//repo does not exist, do not push back into workqueue unless we want to handle this logic
-							} else {
-								log.Warn("adding to failure queue, permission v2: " + md.Name + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-								failureQueue.PushBack(requestData)
-							}
-						}
-						if requestQueue.Len() > 0 {
-							requestQueue.Remove(requestQueue.Front())
-						}
-					}
-				case "user":
-					requestQueue.PushBack(s)
-					md := requestData.User
-					log.Debug("worker ", i, " starting user index:", requestData.UserIndex, " name:", md.Name)
-					if requestData.UserIndex < flags.SkipUserIndexVar {
-						log.Info("worker ", i, " skipping user index:", requestData.UserIndex, " name:", md.Name)
-					} else {
-						forbiddenNames := map[string]string{"access-admin": "bad", "admin": "bad", "xray": "bad", "_internal": "bad", "anonymous": "bad"}
-						if forbiddenNames[md.Name] == "bad" {
-							log.Info("worker ", i, " skipping user index:", requestData.UserIndex, " name:", md.Name, " as it is internal")
-							if requestQueue.Len() > 0 {
-								requestQueue.Remove(requestQueue.Front())
-							}
-							continue
-						}
+	}
+	c := plan.NewCollector()
+	queue := &journalFilter{queue: c, checkpoint: checkpoint}
+	if flags.ReplayFailuresVar != "" {
+		_, err = report.Read(flags.ReplayFailuresVar, queue)
+	} else {
+		err = access.ReadSecurityJSON(queue, flags)
+	}
+	if err != nil {
+		log.Error("Verify failed: ", err)
+		os.Exit(helpers.ExitError)
+	}
+	entries, err := verify.Check(creds, flags, c.Items())
+	if err != nil {
+		log.Error("Verify failed: ", err)
+		os.Exit(helpers.ExitConfigError)
+	}
+	counts := make(map[string]int)
+	for _, entry := range entries {
+		counts[entry.Action]++
+	}
+	symbols := map[string]string{verify.OK: "=", verify.Missing: "-", verify.Drift: "~", verify.Error: "!"}
+	summary := fmt.Sprint("Verify: ", counts[verify.OK], " ok, ", counts[verify.Missing], " missing, ", counts[verify.Drift], " drifted, ", counts[verify.Error], " could not be read")
+	err = writeEntries(flags, entries, symbols, summary)
+	if err != nil {
+		log.Error("Could not write verify report: ", err)
+		os.Exit(helpers.ExitError)
+	}
+	if len(verify.Drifted(entries)) > 0 {
+		os.Exit(helpers.ExitPartialFailure)
+	}
+}
 
-						//check if user exists
-						data, respUserCode, _, getErr := auth.GetRestAPI("GET", true, creds.URL+"/api/security/users/"+md.Name, creds.Username, creds.Apikey, "", nil, nil, 0, flags, nil)
-						if getErr != nil {
-							failureQueue.PushBack(requestData)
-							log.Warn("adding to failure queue, user: " + md.Name + " " + getErr.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-							if requestQueue.Len() > 0 {
-								requestQueue.Remove(requestQueue.Front())
-							}
-							continue
-						}
-						if respUserCode == 404 {
-							log.Info("worker ", i, " did not find user ", md.Name, " creating now")
-							userData, err := json.Marshal(md)
-							if err != nil {
-								log.Error("Error marshaling user: " + md.Name + " " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-								log.Warn("adding to failure queue, user: " + md.Name + " " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-								failureQueue.PushBack(requestData)
-								if requestQueue.Len() > 0 {
-									requestQueue.Remove(requestQueue.Front())
-								}
-								continue
-							}
-							log.Debug("worker ", i, " user JSON index ", requestData.UserIndex, ":", string(userData))
-							data, respUserCode, _, getErr := auth.GetRestAPI("PUT", true, creds.URL+"/api/security/users/"+md.Name, creds.Username, creds.Apikey, "", userData, map[string]string{"Content-Type": "application/json"}, 0, flags, nil)
-							if getErr != nil {
-								log.Warn("adding to failure queue, user: " + md.Name + " " + getErr.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-								failureQueue.PushBack(requestData)
-								if requestQueue.Len() > 0 {
-									requestQueue.Remove(requestQueue.Front())
-								}
-								continue
-							}
-							log.Info("worker ", i, " finished creating user index:", requestData.UserIndex, " name:", md.Name, " HTTP ", respUserCode)
-							if respUserCode != 201 {
-								log.Warn("some error occured on user index ", requestData.UserIndex, ":", string(data))
-								log.Warn("adding to failure queue, user: " + md.Name + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-								failureQueue.PushBack(requestData)
-							}
-						} else if respUserCode == 200 {
-							//user exists
-							var existingUserData access.UserImport
-							err := json.Unmarshal(data, &existingUserData)
-							if err != nil {
-								log.Error("Error unmarshaling existing user, adding to failure queue: " + md.Name + " " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-								failureQueue.PushBack(requestData)
-								if requestQueue.Len() > 0 {
-									requestQueue.Remove(requestQueue.Front())
-								}
-								continue
-							}
-							combinedGroups := append(existingUserData.Groups, md.Groups...)
-							md.Groups = combinedGroups
-							userData, err := json.Marshal(md)
-							if err != nil {
-								log.Error("Error marshaling user, adding to failure queue: " + md.Name + " " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-								if requestQueue.Len() > 0 {
-									requestQueue.Remove(requestQueue.Front())
-								}
-								failureQueue.PushBack(requestData)
-								continue
-							}
-							log.Debug("worker ", i, " user JSON index ", requestData.UserIndex, ":", string(userData))
-							data2, respUserCode, _, getErr := auth.GetRestAPI("PUT", true, creds.URL+"/api/security/users/"+md.Name, creds.Username, creds.Apikey, "", userData, map[string]string{"Content-Type": "application/json"}, 0, flags, nil)
-							if getErr != nil {
-								log.Warn("adding to failure queue, user: " + md.Name + " " + getErr.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-								failureQueue.PushBack(requestData)
-								if requestQueue.Len() > 0 {
-									requestQueue.Remove(requestQueue.Front())
-								}
-								continue
-							}
-							log.Info("worker ", i, " finished updating user index:", requestData.UserIndex, " name:", md.Name, " HTTP ", respUserCode)
-							if respUserCode != 201 {
-								log.Warn("some error occured on user index ", requestData.UserIndex, ":", string(data2))
-								log.Warn("adding to failure queue, user: " + md.Name + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-								failureQueue.PushBack(requestData)
-							}
-						} else {
-							log.Warn("some error occured on user index ", requestData.UserIndex, ":", string(data))
-							log.Warn("adding to failure queue, user: " + md.Name + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-							failureQueue.PushBack(requestData)
-						}
-					}
-					if requestQueue.Len() > 0 {
-						requestQueue.Remove(requestQueue.Front())
-					}
+//pruneTarget delete what the target has on top of the source, only listing it without -confirmPrune. False if some of it failed.
+//The source is read again in full rather than taken from the jobs of this run, which may only be part of it
+func pruneTarget(creds auth.Creds, flags helpers.Flags, version string, credsFileHash map[int][]string, journalWriter *journal.Writer) bool {
+	//never lock ourselves out
+	protected := map[string]bool{flags.UsernameVar: true}
+	for _, cred := range credsFileHash {
+		protected[cred[0]] = true
+	}
+	for name := range importer.ForbiddenNames {
+		protected[name] = true
+	}
+	for _, name := range strings.Split(flags.PruneProtectVar, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			protected[name] = true
+		}
+	}
+	source := plan.NewCollector()
+	err := access.ReadSecurityJSONTargets([]access.TargetQueue{{Queue: source, Version: version}}, flags)
+	if err != nil {
+		log.Error("Prune failed reading the source: ", err)
+		return false
+	}
+	steps, err := prune.Plan(creds, flags, source.Items(), protected)
+	if err != nil {
+		log.Error("Prune failed: ", err)
+		return false
+	}
+	count := 0
+	for _, phase := range steps {
+		for _, step := range phase {
+			log.Info("prune: ", step)
+			count++
+		}
+	}
+	if count == 0 {
+		log.Info("Nothing to prune")
+		return true
+	}
+	if !flags.ConfirmPruneVar {
+		log.Warn("Not pruning these ", count, " entities, run again with -confirmPrune to go ahead")
+		return true
+	}
+	failures := prune.Run(creds, flags, steps, journalWriter)
+	log.Info("Pruned ", count-len(failures), " of ", count, " entities")
+	return len(failures) == 0
+}
 
-				case "end":
-					_, _, _, getErr := auth.GetRestAPI("GET", true, creds.URL+"/api/system/ping", creds.Username, creds.Apikey, "", nil, nil, 0, flags, nil)
-					if getErr != nil {
-						//well this is awkward
-						log.Error("Something has gone wrong at the very end")
-						os.Exit(1)
-					}
-					waiting := time.Now()
-					for requestQueue.Len() > 0 {
-						log.Info("End detected, waiting for last few requests to go through. Request queue size ", requestQueue.Len())
-						time.Sleep(time.Duration(flags.WorkerSleepVar) * time.Second)
+//journalFilter only passes on items the journal recorded as imported, everything without a journal
+type journalFilter struct {
+	queue      access.Queue
+	checkpoint *journal.Checkpoint
+}
 
-						waitingSub := time.Now().Sub(waiting)
-						if waitingSub > time.Duration(60)*time.Second {
-							fmt.Println("Do you want to break manually? (y/n)")
-							if askForConfirmation() {
-								for requestQueue.Len() > 0 {
-									requestQueue.Remove(requestQueue.Front())
-								}
-							}
-						}
+func (f *journalFilter) Add(item access.ListTypes) {
+	if f.checkpoint == nil || f.checkpoint.Succeeded(item.ID()) {
+		f.queue.Add(item)
+	}
+}
 
-					}
-					endTime := time.Now()
-					log.Info("Completed import in ", endTime.Sub(startTime), "")
-					if failureQueue.Len() > 0 {
-						log.Warn("There were ", failureQueue.Len(), " failures. The following imports failed:")
-						for e := failureQueue.Front(); e != nil; e = e.Next() {
-							value := e.Value.(access.ListTypes)
-							switch value.AccessType {
-							case "group":
-								md := value.Group
-								data, err := json.Marshal(md)
-								if err != nil {
-									log.Error("Error marshaling ", value.AccessType+": "+md.Name+" "+err.Error()+" "+helpers.Trace().Fn+":"+strconv.Itoa(helpers.Trace().Line))
-									continue
-								} else {
-									fmt.Println(value.AccessType, md.Name, "data:", string(data))
-								}
-							case "permissionV2":
-								md := value.PermissionV2
-								data, err := json.Marshal(md)
-								if err != nil {
-									log.Error("Error marshaling ", value.AccessType+": "+md.Name+" "+err.Error()+" "+helpers.Trace().Fn+":"+strconv.Itoa(helpers.Trace().Line))
-									continue
-								} else {
-									fmt.Println(value.AccessType, md.Name, "data:", string(data))
-								}
-							case "user":
-								md := value.User
-								data, err := json.Marshal(md)
-								if err != nil {
-									log.Error("Error marshaling ", value.AccessType+": "+md.Name+" "+err.Error()+" "+helpers.Trace().Fn+":"+strconv.Itoa(helpers.Trace().Line))
-									continue
-								} else {
-									fmt.Println(value.AccessType, md.Name, "data:", string(data))
-								}
-							}
-						}
-						fmt.Println("Do you want to retry these? (y/n)")
-						if askForConfirmation() {
-							for failureQueue.Len() > 0 {
-								value := failureQueue.Front().Value.(access.ListTypes)
-								log.Info("Re-queuing ", value.AccessType, " ", value.Name)
+//verifyJobs read back everything this run imported and log any drift, false if there was some
+func verifyJobs(creds auth.Creds, flags helpers.Flags, sched *scheduler.Scheduler) bool {
+	var items []access.ListTypes
+	for _, job := range sched.Jobs(scheduler.Succeeded) {
+		items = append(items, job.Item)
+	}
+	entries, err := verify.Check(creds, flags, items)
+	if err != nil {
+		log.Error("Verify failed: ", err)
+		return false
+	}
+	drifted := verify.Drifted(entries)
+	for _, entry := range drifted {
+		var changes []string
+		for _, change := range entry.Changes {
+			changes = append(changes, change.String())
+		}
+		if entry.Error != "" {
+			changes = append(changes, entry.Error)
+		}
+		log.Warn("verify: ", entry.Type, " ", entry.Name, " ", entry.Action, " ", strings.Join(changes, "; "))
+	}
+	log.Info("Verified ", len(entries), " imported entities, ", len(drifted), " drifted")
+	return len(drifted) == 0
+}
 
-								workQueue.PushBack(value)
-								failureQueue.Remove(failureQueue.Front())
-							}
-							var endTask access.ListTypes
-							endTask.AccessType = "end"
-							workQueue.PushBack(endTask)
-						} else {
-							log.Info("Completed import in ", endTime.Sub(startTime), "")
-							os.Exit(0)
-						}
-					} else {
-						os.Exit(0)
-					}
+//writeEntries write plan or verify entries to -planOutput as -planFormat, text ends with the summary line
+func writeEntries(flags helpers.Flags, entries []plan.Entry, symbols map[string]string, summary string) error {
+	out := os.Stdout
+	if flags.PlanOutputVar != "" {
+		file, err := os.Create(flags.PlanOutputVar)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	if flags.PlanFormatVar == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+	w := bufio.NewWriter(out)
+	for _, entry := range entries {
+		fmt.Fprintln(w, symbols[entry.Action], entry.Action, entry.Type, entry.Name)
+		for _, change := range entry.Changes {
+			fmt.Fprintln(w, "     ", change)
+		}
+		if entry.Error != "" {
+			fmt.Fprintln(w, "     ", entry.Error)
+		}
+	}
+	fmt.Fprintln(w, summary)
+	return w.Flush()
+}
 
-				}
-				log.Debug("worker ", i, " finished job")
-			}
-		}(i)
+//rollbackImport undo everything the journal given as argument changed on -url
+func rollbackImport(flags helpers.Flags) {
+	stringFlags := map[string]string{"-user": flags.UsernameVar, "-apikey": flags.ApikeyVar, "-url": flags.URLVar}
+	if !auth.NeedsUser(flags) {
+		delete(stringFlags, "-user")
+	}
+	var missing bool = false
+	for i := range stringFlags {
+		if stringFlags[i] == "" {
+			log.Error(i + " cannot be empty")
+			missing = true
+		}
+	}
+	if len(flags.Args) != 1 {
+		log.Error("rollback needs exactly one journal, e.g. security-json-import rollback -url ... security-json-import-20200101-120000.journal")
+		missing = true
+	}
+	if missing {
+		os.Exit(helpers.ExitConfigError)
+	}
+	checkpoint, err := journal.Load(flags.Args[0])
+	if err != nil {
+		log.Error(err)
+		os.Exit(helpers.ExitConfigError)
+	}
+	credCheck, err := auth.VerifyAPIKey(flags.URLVar, flags.UsernameVar, flags.ApikeyVar, flags)
+	if !credCheck || err != nil {
+		log.Error("Looks like there's an issue with checking your credentials. Exiting due to:", err)
+		os.Exit(helpers.ExitConfigError)
 	}
+	var creds auth.Creds
+	creds.Username = flags.UsernameVar
+	creds.Apikey = flags.ApikeyVar
+	creds.URL = flags.URLVar
 
-	//debug port
-	go func() {
-		http.ListenAndServe("0.0.0.0:8080", nil)
-	}()
-	for {
-		var count0 = 0
-		for workQueue.Len() == 0 {
-			log.Debug(" work queue is empty, sleeping for ", flags.WorkerSleepVar, " seconds...")
-			time.Sleep(time.Duration(flags.WorkerSleepVar) * time.Second)
-			count0++
-			if count0 > 10 {
-				log.Debug("Looks like nothing's getting put into the workqueue. You might want to enable -debug and take a look")
-			}
-			if workQueue.Len() > 0 {
-				count0 = 0
-			}
+	plan := rollback.Plan(checkpoint)
+	count := 0
+	for _, steps := range plan {
+		for _, step := range steps {
+			fmt.Println(step)
+			count++
+		}
+	}
+	if count == 0 {
+		log.Info("Nothing to roll back in ", flags.Args[0])
+		return
+	}
+	if !flags.YesVar {
+		if !helpers.Interactive() {
+			log.Error("Not rolling back ", count, " entities without confirmation, pass -yes")
+			os.Exit(helpers.ExitConfigError)
+		}
+		fmt.Println("Do you want to roll back these", count, "entities? (y/n)")
+		if !askForConfirmation() {
+			os.Exit(helpers.ExitAborted)
 		}
-		s := workQueue.Front().Value
-		workQueue.Remove(workQueue.Front())
-		ch <- s
 	}
-	close(ch)
-	wg.Wait()
+	failures := rollback.Run(creds, flags, plan)
+	log.Info("Rolled back ", count-len(failures), " of ", count, " entities")
+	if len(failures) > 0 {
+		os.Exit(helpers.ExitPartialFailure)
+	}
 }
 
 //Test if remote repository exists and is a remote
@@ -539,63 +582,14 @@ func main() {
 // 	return result["packageType"].(string), result["url"].(string), "", ""
 // }
 
-func permissionRepoVerification(creds auth.Creds, flags helpers.Flags, md access.PermissionV2Import, failureQueue *list.List, requestQueue *list.List, requestData access.ListTypes, i int) {
-
-	//one or more repo's dont exist, attempt to fix
-	var newRepos = make([]string, 0)
-	for i := range md.Repo.Repositories {
-		_, respCheckCode, _, getErr := auth.GetRestAPI("HEAD", true, creds.URL+"/api/repositories/"+md.Repo.Repositories[i], creds.Username, creds.Apikey, "", nil, nil, 0, flags, nil)
-		if getErr != nil {
-			log.Warn("adding to failure queue, permission: " + md.Name + " " + getErr.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-			failureQueue.PushBack(requestData)
-			requestQueue.Remove(requestQueue.Front())
-			continue
-		}
-		if respCheckCode != 200 && strings.Contains(md.Repo.Repositories[i], "-cache") {
-			log.Info("worker ", i, " attempting -cache removal index:", requestData.PermissionIndex, " name:", md.Name)
-			// -cache could be issues
-			newRepos = append(newRepos, strings.TrimSuffix(md.Repo.Repositories[i], "-cache"))
-		}
-		if respCheckCode == 200 {
-			newRepos = append(newRepos, md.Repo.Repositories[i])
-		}
-		log.Info("worker ", i, " new repo list index:", requestData.PermissionIndex, " name:", md.Name, " ", newRepos)
-
-	}
-	md.Repo.Repositories = newRepos
-	requestData.PermissionV2.Repo.Repositories = newRepos
-	permissionData, err := json.Marshal(md)
-	if err != nil {
-		log.Error("worker ", i, " Error marshaling permission v2, adding to failure queue: "+md.Name+" "+err.Error()+" "+helpers.Trace().Fn+":"+strconv.Itoa(helpers.Trace().Line))
-		requestQueue.Remove(requestQueue.Front())
-		failureQueue.PushBack(requestData)
-		return
-	}
-	log.Debug("worker ", i, " permission v2 JSON:", string(permissionData), "index ", requestData.PermissionIndex)
-	data, respPermCode, _, getErr := auth.GetRestAPI("PUT", true, creds.URL+"/api/v2/security/permissions/"+md.Name, creds.Username, creds.Apikey, "", permissionData, map[string]string{"Content-Type": "application/json"}, 0, flags, nil)
-	if getErr != nil {
-		log.Warn("adding to failure queue, permission: " + md.Name + " " + getErr.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-		failureQueue.PushBack(requestData)
-		requestQueue.Remove(requestQueue.Front())
-		return
-	}
-	if respPermCode != 200 {
-		log.Warn("worker ", i, " some error occured on 2nd attempt permission v2 index ", requestData.PermissionIndex, ":", string(data))
-		log.Warn("worker ", i, " index ", requestData.PermissionIndex, ":", string(permissionData))
-		log.Warn("adding to failure queue, permission: " + md.Name + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
-		failureQueue.PushBack(requestData)
-	} else if respPermCode == 200 {
-		log.Info("worker ", i, " succeeded on 2nd attempt permission v2 index ", requestData.PermissionIndex, ":", string(data))
-	}
-
-}
-
 //https://gist.github.com/albrow/5882501
 func askForConfirmation() bool {
 	var response string
 	_, err := fmt.Scanln(&response)
 	if err != nil {
-		log.Fatal(err)
+		//nobody to answer, e.g. stdin closed
+		log.Warn("Could not read answer, assuming no: ", err)
+		return false
 	}
 	okayResponses := []string{"y", "Y", "yes", "Yes", "YES"}
 	nokayResponses := []string{"n", "N", "no", "No", "NO"}
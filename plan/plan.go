@@ -0,0 +1,183 @@
+package plan
+
+import (
+	"security-json-import/access"
+	"security-json-import/auth"
+	"security-json-import/diff"
+	"security-json-import/helpers"
+	"security-json-import/policy"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Actions an entry can take
+const (
+	Create    = "create"
+	Update    = "update"
+	Unchanged = "unchanged"
+	Skip      = "skip"
+	Error     = "error"
+)
+
+//Entry what importing one entity would do to the target
+type Entry struct {
+	ID      string        `json:"id"`
+	Type    string        `json:"type"`
+	Name    string        `json:"name"`
+	Action  string        `json:"action"`
+	Changes []diff.Change `json:"changes,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+//internalUsers never imported, so never planned
+var internalUsers = map[string]bool{"access-admin": true, "admin": true, "xray": true, "_internal": true, "anonymous": true}
+
+//Collector gathers the items read from security json. Users listed under several groups are folded into one,
+//as are the roles a member gets in a project from several permission targets
+type Collector struct {
+	mu      sync.Mutex
+	items   []access.ListTypes
+	users   map[string]int
+	members map[string]int
+}
+
+//NewCollector empty collector, satisfies access.Queue
+func NewCollector() *Collector {
+	return &Collector{users: make(map[string]int), members: make(map[string]int)}
+}
+
+//Add collect an item, folding users into the ones already collected
+func (c *Collector) Add(item access.ListTypes) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if item.AccessType == "user" {
+		if internalUsers[item.User.Name] {
+			return
+		}
+		if i, ok := c.users[item.User.Name]; ok {
+			c.items[i].User.Groups = policy.Union(c.items[i].User.Groups, item.User.Groups)
+			return
+		}
+		c.users[item.User.Name] = len(c.items)
+	}
+	if item.AccessType == "projectMember" {
+		if i, ok := c.members[item.Key()]; ok {
+			c.items[i].Project.Roles = policy.Union(c.items[i].Project.Roles, item.Project.Roles)
+			return
+		}
+		c.members[item.Key()] = len(c.items)
+	}
+	c.items = append(c.items, item)
+}
+
+//Items everything collected, in the order it was added
+func (c *Collector) Items() []access.ListTypes {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]access.ListTypes(nil), c.items...)
+}
+
+//Run compare everything security json would import with the target at creds.URL
+func Run(creds auth.Creds, flags helpers.Flags) ([]Entry, error) {
+	policies, err := policy.FromFlags(flags)
+	if err != nil {
+		return nil, err
+	}
+	c := NewCollector()
+	err = access.ReadSecurityJSON(c, flags)
+	if err != nil {
+		return nil, err
+	}
+	return CompareAll(creds, flags, policies, c.Items()), nil
+}
+
+//CompareAll Compare every item with a pool of workers, entries are in item order
+func CompareAll(creds auth.Creds, flags helpers.Flags, policies policy.Policies, items []access.ListTypes) []Entry {
+	log.Info("Comparing ", len(items), " entities with ", creds.URL)
+	entries := make([]Entry, len(items))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < flags.WorkersVar; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				entries[i] = Compare(creds, flags, policies, items[i])
+			}
+		}()
+	}
+	for i := range items {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return entries
+}
+
+//Compare fetch the counterpart of item from the target and diff it with what the import sends
+func Compare(creds auth.Creds, flags helpers.Flags, policies policy.Policies, item access.ListTypes) Entry {
+	entry := Entry{ID: item.ID(), Type: item.AccessType, Name: item.EntityName()}
+	have, found, err := access.Fetch(creds, flags, item)
+	if err != nil {
+		entry.Action = Error
+		entry.Error = err.Error()
+		return entry
+	}
+	if !found {
+		entry.Action = Create
+		return entry
+	}
+	sent, ok := policies.Apply(have, item)
+	if !ok {
+		entry.Action = Skip
+		return entry
+	}
+	entry.Changes, err = diff.Compare(comparable(have, item), comparable(sent, item))
+	if err != nil {
+		entry.Action = Error
+		entry.Error = err.Error()
+		return entry
+	}
+	entry.Action = Unchanged
+	if len(entry.Changes) > 0 {
+		entry.Action = Update
+	}
+	return entry
+}
+
+//comparable the payload of l, minus what the target never returns or what item does not touch
+func comparable(l, item access.ListTypes) interface{} {
+	switch l.AccessType {
+	case "user":
+		user := l.User
+		user.Password = ""
+		user.Groups = append([]string(nil), user.Groups...)
+		sort.Strings(user.Groups)
+		return user
+	case "permission":
+		//the v1 API includes everything when no include pattern is given
+		permission := l.Permission
+		if len(permission.IncludePatterns) == 0 {
+			permission.IncludePatterns = []string{"**"}
+		}
+		return permission
+	case "permissionV2":
+		//repo and build halves of a permission target are imported separately
+		permission := l.PermissionV2
+		if item.PermissionV2.Repo == nil {
+			permission.Repo = nil
+		}
+		if item.PermissionV2.Build == nil {
+			permission.Build = nil
+		}
+		return permission
+	case "projectMember":
+		member := l.Project
+		member.Roles = append([]string(nil), member.Roles...)
+		sort.Strings(member.Roles)
+		return member
+	}
+	return l.Payload()
+}
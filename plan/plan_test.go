@@ -0,0 +1,61 @@
+package plan
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"security-json-import/access"
+	"security-json-import/auth"
+	"security-json-import/helpers"
+	"security-json-import/policy"
+	"testing"
+)
+
+func TestComparePermissionV1(t *testing.T) {
+	permission := func(includes, excludes []string, users map[string][]string) access.ListTypes {
+		return access.ListTypes{AccessType: "permission", Name: "p", Permission: access.PermissionImport{
+			Name: "p", IncludePatterns: includes, ExcludePatterns: excludes, Repositories: []string{"libs"},
+			Principals: access.PermissionPrincipalsImport{Users: users, Groups: map[string][]string{"devs": {"r"}}},
+		}}
+	}
+	bob := map[string][]string{"bob": {"r", "w"}}
+	tests := []struct {
+		name string
+		item access.ListTypes
+		//have what the v1 API returns for the permission target
+		have string
+		want string
+	}{
+		{"round trip without patterns", permission(nil, nil, bob),
+			`{"name":"p","includesPattern":"**","excludesPattern":"","repositories":["libs"],"principals":{"users":{"bob":["w","r"]},"groups":{"devs":["r"]}}}`, Unchanged},
+		{"round trip with patterns", permission([]string{"a/**", "b/**"}, []string{"c/**"}, bob),
+			`{"name":"p","includesPattern":"b/**,a/**","excludesPattern":"c/**","repositories":["libs"],"principals":{"users":{"bob":["r","w"]},"groups":{"devs":["r"]}}}`, Unchanged},
+		{"patterns in the import shape", permission([]string{"a/**"}, nil, bob),
+			`{"name":"p","include-patterns":["a/**"],"repositories":["libs"],"principals":{"users":{"bob":["r","w"]},"groups":{"devs":["r"]}}}`, Unchanged},
+		{"different include pattern", permission([]string{"a/**"}, nil, bob),
+			`{"name":"p","includesPattern":"**","excludesPattern":"","repositories":["libs"],"principals":{"users":{"bob":["r","w"]},"groups":{"devs":["r"]}}}`, Update},
+		{"action missing", permission(nil, nil, bob),
+			`{"name":"p","includesPattern":"**","excludesPattern":"","repositories":["libs"],"principals":{"users":{"bob":["r"]},"groups":{"devs":["r"]}}}`, Update},
+	}
+	flags := helpers.DefaultFlags()
+	flags.PermissionPolicyVar = policy.Overwrite
+	policies, err := policy.FromFlags(flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/security/permissions/p" {
+					http.NotFound(w, r)
+					return
+				}
+				w.Write([]byte(tt.have))
+			}))
+			defer srv.Close()
+			entry := Compare(auth.Creds{URL: srv.URL, Username: "me", Apikey: "x"}, flags, policies, tt.item)
+			if entry.Action != tt.want {
+				t.Errorf("Compare() = %s %v %s, want %s", entry.Action, entry.Changes, entry.Error, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package policy
+
+import (
+	"errors"
+	"security-json-import/access"
+	"security-json-import/helpers"
+	"sort"
+)
+
+//What to do with an entity that already exists on the target
+const (
+	SkipExisting = "skip-existing"
+	Overwrite    = "overwrite"
+	Merge        = "merge"
+)
+
+//Policies policy per access type, permission and permissionV2 share one
+type Policies map[string]string
+
+//FromFlags read -groupPolicy, -userPolicy and -permissionPolicy. Existing projects are left alone, and
+//project members keep the roles they have on top of the imported ones
+func FromFlags(flags helpers.Flags) (Policies, error) {
+	p := Policies{"group": flags.GroupPolicyVar, "user": flags.UserPolicyVar, "permission": flags.PermissionPolicyVar, "permissionV2": flags.PermissionPolicyVar,
+		"project": SkipExisting, "projectRepository": Overwrite, "projectMember": Merge}
+	for _, name := range []string{flags.GroupPolicyVar, flags.UserPolicyVar, flags.PermissionPolicyVar} {
+		if name != SkipExisting && name != Overwrite && name != Merge {
+			return nil, errors.New("Unknown policy " + name + ", expected " + SkipExisting + ", " + Overwrite + " or " + Merge)
+		}
+	}
+	return p, nil
+}
+
+//For the policy of an access type
+func (p Policies) For(accessType string) string {
+	return p[accessType]
+}
+
+//Apply what to send for want when have already exists on the target, false if it should be left alone
+func (p Policies) Apply(have, want access.ListTypes) (access.ListTypes, bool) {
+	switch p.For(want.AccessType) {
+	case SkipExisting:
+		return have, false
+	case Merge:
+		return MergeItems(have, want), true
+	}
+	return want, true
+}
+
+//MergeItems combine the target's version of an entity with the imported one. Lists are unioned,
+//principals only on the target are kept, and for everything else the import wins unless it is empty
+func MergeItems(have, want access.ListTypes) access.ListTypes {
+	merged := want
+	switch want.AccessType {
+	case "group":
+		if merged.Group.Description == "" {
+			merged.Group.Description = have.Group.Description
+		}
+	case "user":
+		if merged.User.Email == "" {
+			merged.User.Email = have.User.Email
+		}
+		merged.User.Groups = Union(have.User.Groups, want.User.Groups)
+		//existing users keep their password
+		merged.User.Password = ""
+	case "permission":
+		merged.Permission.IncludePatterns = Union(have.Permission.IncludePatterns, want.Permission.IncludePatterns)
+		merged.Permission.ExcludePatterns = Union(have.Permission.ExcludePatterns, want.Permission.ExcludePatterns)
+		merged.Permission.Repositories = Union(have.Permission.Repositories, want.Permission.Repositories)
+		merged.Permission.Principals.Users = mergeActions(have.Permission.Principals.Users, want.Permission.Principals.Users)
+		merged.Permission.Principals.Groups = mergeActions(have.Permission.Principals.Groups, want.Permission.Principals.Groups)
+	case "permissionV2":
+		merged.PermissionV2.Repo = mergeTarget(have.PermissionV2.Repo, want.PermissionV2.Repo)
+		merged.PermissionV2.Build = mergeTarget(have.PermissionV2.Build, want.PermissionV2.Build)
+	case "projectMember":
+		merged.Project.Roles = Union(have.Project.Roles, want.Project.Roles)
+	}
+	return merged
+}
+
+//mergeTarget merge the repo or build half of a v2 permission target
+func mergeTarget(have, want *access.PermissionDataV2Import) *access.PermissionDataV2Import {
+	if have == nil {
+		return want
+	}
+	if want == nil {
+		return have
+	}
+	merged := *want
+	merged.IncludePatterns = Union(have.IncludePatterns, want.IncludePatterns)
+	merged.ExcludePatterns = Union(have.ExcludePatterns, want.ExcludePatterns)
+	merged.Repositories = Union(have.Repositories, want.Repositories)
+	merged.Actions.Users = mergeActions(have.Actions.Users, want.Actions.Users)
+	merged.Actions.Groups = mergeActions(have.Actions.Groups, want.Actions.Groups)
+	return &merged
+}
+
+//mergeActions union of actions per principal
+func mergeActions(have, want map[string][]string) map[string][]string {
+	if have == nil && want == nil {
+		return nil
+	}
+	merged := make(map[string][]string)
+	for principal, actions := range have {
+		merged[principal] = Union(nil, actions)
+	}
+	for principal, actions := range want {
+		merged[principal] = Union(merged[principal], actions)
+	}
+	for principal := range merged {
+		sort.Strings(merged[principal])
+	}
+	return merged
+}
+
+//Union of a and b, in order, without duplicates
+func Union(a, b []string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, list := range [][]string{a, b} {
+		for _, v := range list {
+			if !seen[v] {
+				seen[v] = true
+				out = append(out, v)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,144 @@
+package policy
+
+import (
+	"reflect"
+	"security-json-import/access"
+	"security-json-import/helpers"
+	"testing"
+)
+
+func TestFromFlags(t *testing.T) {
+	tests := []struct {
+		group, user, permission string
+		wantErr                 bool
+	}{
+		{SkipExisting, Overwrite, Merge, false},
+		{Merge, Merge, Merge, false},
+		{"", Overwrite, Overwrite, true},
+		{Overwrite, "replace", Overwrite, true},
+		{Overwrite, Overwrite, "Merge", true},
+	}
+	for _, tt := range tests {
+		flags := helpers.DefaultFlags()
+		flags.GroupPolicyVar, flags.UserPolicyVar, flags.PermissionPolicyVar = tt.group, tt.user, tt.permission
+		p, err := FromFlags(flags)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("FromFlags(%s, %s, %s) error = %v, want error %v", tt.group, tt.user, tt.permission, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		want := Policies{"group": tt.group, "user": tt.user, "permission": tt.permission, "permissionV2": tt.permission,
+			"project": SkipExisting, "projectRepository": Overwrite, "projectMember": Merge}
+		if !reflect.DeepEqual(p, want) {
+			t.Errorf("FromFlags() = %v, want %v", p, want)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	have := access.ListTypes{AccessType: "group", Group: access.GroupImport{Name: "devs", Description: "on the target"}}
+	want := access.ListTypes{AccessType: "group", Group: access.GroupImport{Name: "devs"}}
+	tests := []struct {
+		policy string
+		sent   string
+		ok     bool
+	}{
+		{SkipExisting, "on the target", false},
+		{Overwrite, "", true},
+		{Merge, "on the target", true},
+	}
+	for _, tt := range tests {
+		sent, ok := Policies{"group": tt.policy}.Apply(have, want)
+		if ok != tt.ok || sent.Group.Description != tt.sent {
+			t.Errorf("Apply() with %s = %q, %v, want %q, %v", tt.policy, sent.Group.Description, ok, tt.sent, tt.ok)
+		}
+	}
+}
+
+func TestMergeItems(t *testing.T) {
+	v2 := func(target *access.PermissionDataV2Import) access.ListTypes {
+		return access.ListTypes{AccessType: "permissionV2", PermissionV2: access.PermissionV2Import{Name: "p", Repo: target}}
+	}
+	tests := []struct {
+		name string
+		have access.ListTypes
+		want access.ListTypes
+		out  access.ListTypes
+	}{
+		{"group keeps its description if the import has none",
+			access.ListTypes{AccessType: "group", Group: access.GroupImport{Name: "devs", Description: "old", AutoJoin: true}},
+			access.ListTypes{AccessType: "group", Group: access.GroupImport{Name: "devs"}},
+			access.ListTypes{AccessType: "group", Group: access.GroupImport{Name: "devs", Description: "old"}}},
+		{"group description from the import wins",
+			access.ListTypes{AccessType: "group", Group: access.GroupImport{Name: "devs", Description: "old"}},
+			access.ListTypes{AccessType: "group", Group: access.GroupImport{Name: "devs", Description: "new"}},
+			access.ListTypes{AccessType: "group", Group: access.GroupImport{Name: "devs", Description: "new"}}},
+		{"user groups are unioned and the password kept",
+			access.ListTypes{AccessType: "user", User: access.UserImport{Name: "bob", Email: "bob@old", Groups: []string{"ops", "devs"}}},
+			access.ListTypes{AccessType: "user", User: access.UserImport{Name: "bob", Password: "password", Groups: []string{"devs", "qa"}}},
+			access.ListTypes{AccessType: "user", User: access.UserImport{Name: "bob", Email: "bob@old", Groups: []string{"ops", "devs", "qa"}}}},
+		{"user email from the import wins",
+			access.ListTypes{AccessType: "user", User: access.UserImport{Name: "bob", Email: "bob@old"}},
+			access.ListTypes{AccessType: "user", User: access.UserImport{Name: "bob", Email: "bob@new"}},
+			access.ListTypes{AccessType: "user", User: access.UserImport{Name: "bob", Email: "bob@new"}}},
+		{"v1 permission target",
+			access.ListTypes{AccessType: "permission", Permission: access.PermissionImport{Name: "p", IncludePatterns: []string{"a/**"}, Repositories: []string{"libs"},
+				Principals: access.PermissionPrincipalsImport{Users: map[string][]string{"bob": {"w", "r"}, "alice": {"r"}}}}},
+			access.ListTypes{AccessType: "permission", Permission: access.PermissionImport{Name: "p", IncludePatterns: []string{"b/**"}, ExcludePatterns: []string{"c/**"}, Repositories: []string{"libs", "apps"},
+				Principals: access.PermissionPrincipalsImport{Users: map[string][]string{"bob": {"d"}}, Groups: map[string][]string{"devs": {"r"}}}}},
+			access.ListTypes{AccessType: "permission", Permission: access.PermissionImport{Name: "p", IncludePatterns: []string{"a/**", "b/**"}, ExcludePatterns: []string{"c/**"}, Repositories: []string{"libs", "apps"},
+				Principals: access.PermissionPrincipalsImport{Users: map[string][]string{"bob": {"d", "r", "w"}, "alice": {"r"}}, Groups: map[string][]string{"devs": {"r"}}}}}},
+		{"v2 permission target",
+			v2(&access.PermissionDataV2Import{Repositories: []string{"libs"}, Actions: access.PermissionV2ActionsImport{Users: map[string][]string{"alice": {"read"}}}}),
+			v2(&access.PermissionDataV2Import{Repositories: []string{"apps"}, Actions: access.PermissionV2ActionsImport{Users: map[string][]string{"bob": {"write", "read"}}}}),
+			v2(&access.PermissionDataV2Import{Repositories: []string{"libs", "apps"}, Actions: access.PermissionV2ActionsImport{Users: map[string][]string{"alice": {"read"}, "bob": {"read", "write"}}}})},
+		{"v2 half only on the target is kept",
+			access.ListTypes{AccessType: "permissionV2", PermissionV2: access.PermissionV2Import{Name: "p", Build: &access.PermissionDataV2Import{Repositories: []string{"artifactory-build-info"}}}},
+			v2(&access.PermissionDataV2Import{Repositories: []string{"libs"}}),
+			access.ListTypes{AccessType: "permissionV2", PermissionV2: access.PermissionV2Import{Name: "p", Repo: &access.PermissionDataV2Import{Repositories: []string{"libs"}},
+				Build: &access.PermissionDataV2Import{Repositories: []string{"artifactory-build-info"}}}}},
+		{"project member roles are unioned",
+			access.ListTypes{AccessType: "projectMember", Project: access.ProjectImport{Key: "k", Name: "bob", Roles: []string{"Viewer"}}},
+			access.ListTypes{AccessType: "projectMember", Project: access.ProjectImport{Key: "k", Name: "bob", Roles: []string{"Developer", "Viewer"}}},
+			access.ListTypes{AccessType: "projectMember", Project: access.ProjectImport{Key: "k", Name: "bob", Roles: []string{"Viewer", "Developer"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MergeItems(tt.have, tt.want); !reflect.DeepEqual(got, tt.out) {
+				t.Errorf("MergeItems() = %+v, want %+v", got, tt.out)
+			}
+		})
+	}
+}
+
+func TestMergeItemsLeavesInputsAlone(t *testing.T) {
+	have := access.ListTypes{AccessType: "permissionV2", PermissionV2: access.PermissionV2Import{Name: "p", Repo: &access.PermissionDataV2Import{
+		Repositories: []string{"libs"}, Actions: access.PermissionV2ActionsImport{Users: map[string][]string{"bob": {"read"}}}}}}
+	want := access.ListTypes{AccessType: "permissionV2", PermissionV2: access.PermissionV2Import{Name: "p", Repo: &access.PermissionDataV2Import{
+		Repositories: []string{"apps"}, Actions: access.PermissionV2ActionsImport{Users: map[string][]string{"bob": {"write"}}}}}}
+	MergeItems(have, want)
+	if !reflect.DeepEqual(want.PermissionV2.Repo.Repositories, []string{"apps"}) || !reflect.DeepEqual(want.PermissionV2.Repo.Actions.Users, map[string][]string{"bob": {"write"}}) {
+		t.Errorf("MergeItems() changed the import to %+v", *want.PermissionV2.Repo)
+	}
+	if !reflect.DeepEqual(have.PermissionV2.Repo.Actions.Users, map[string][]string{"bob": {"read"}}) {
+		t.Errorf("MergeItems() changed the target's version to %+v", *have.PermissionV2.Repo)
+	}
+}
+
+func TestUnion(t *testing.T) {
+	tests := []struct {
+		a, b, want []string
+	}{
+		{nil, nil, nil},
+		{[]string{"a"}, nil, []string{"a"}},
+		{nil, []string{"b", "b"}, []string{"b"}},
+		{[]string{"b", "a"}, []string{"a", "c"}, []string{"b", "a", "c"}},
+	}
+	for _, tt := range tests {
+		if got := Union(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Union(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
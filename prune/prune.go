@@ -0,0 +1,253 @@
+package prune
+
+import (
+	"encoding/json"
+	"errors"
+	"security-json-import/access"
+	"security-json-import/auth"
+	"security-json-import/helpers"
+	"security-json-import/journal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Step one deletion, or one user losing groups it is not in on the source
+type Step struct {
+	Method   string
+	Type     string
+	Name     string
+	Endpoint string
+	//Body the user update for membership changes
+	Body []byte
+	//Removed groups taken away from the user
+	Removed []string
+}
+
+func (s Step) String() string {
+	if s.Method == "DELETE" {
+		return "delete " + s.Type + " " + s.Name
+	}
+	return "remove user " + s.Name + " from " + strings.Join(s.Removed, ", ")
+}
+
+//listEntry entry of the group, user and permission list endpoints
+type listEntry struct {
+	Name string `json:"name"`
+}
+
+//Plan everything on the target that is not in items, per phase: permission targets, memberships, users, groups.
+//Names in protected are never touched, and types that were not imported are not pruned
+func Plan(creds auth.Creds, flags helpers.Flags, items []access.ListTypes, protected map[string]bool) ([][]Step, error) {
+	source := make(map[string]bool)
+	groupsOf := make(map[string]map[string]bool)
+	permissionType := ""
+	for _, item := range items {
+		source[item.Key()] = true
+		//e.g. users a permission target references that were created without context on an earlier run
+		for _, dep := range item.Dependencies() {
+			source[dep] = true
+		}
+		switch item.AccessType {
+		case "user":
+			if groupsOf[item.User.Name] == nil {
+				groupsOf[item.User.Name] = make(map[string]bool)
+			}
+			for _, group := range item.User.Groups {
+				groupsOf[item.User.Name][group] = true
+			}
+		case "permission", "permissionV2":
+			permissionType = item.AccessType
+		case "projectMember":
+			//moved into a project, but the source still has it, so a global one on the target stays
+			source["permission/"+item.Project.Source] = true
+			source["permissionV2/"+item.Project.Source] = true
+		}
+	}
+
+	plan := make([][]Step, 4)
+	if !flags.SkipPermissionImportVar {
+		switch permissionType {
+		case "":
+			log.Warn("No permission targets in the source, not pruning permission targets")
+		default:
+			item := access.ListTypes{AccessType: permissionType}
+			listPath := "/api/v2/security/permissions"
+			if permissionType == "permission" {
+				listPath = "/api/security/permissions"
+			}
+			names, err := list(creds, flags, listPath)
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range names {
+				item.Permission.Name, item.PermissionV2.Name = name, name
+				if !protected[name] && !source[permissionType+"/"+name] {
+					plan[0] = append(plan[0], Step{Method: "DELETE", Type: permissionType, Name: name, Endpoint: item.Endpoint()})
+				}
+			}
+		}
+	}
+	if !flags.SkipUserImportVar {
+		names, err := list(creds, flags, "/api/security/users")
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if protected[name] {
+				continue
+			}
+			item := access.ListTypes{AccessType: "user", User: access.UserImport{Name: name}}
+			if !source[item.Key()] {
+				plan[2] = append(plan[2], Step{Method: "DELETE", Type: "user", Name: name, Endpoint: item.Endpoint()})
+				continue
+			}
+			groups, ok := groupsOf[name]
+			if !ok {
+				//only referenced by a permission target, the source says nothing about its groups
+				continue
+			}
+			step, err := membership(creds, flags, item, groups)
+			if err != nil {
+				return nil, err
+			}
+			if step != nil {
+				plan[1] = append(plan[1], *step)
+			}
+		}
+	}
+	if !flags.SkipGroupImportVar {
+		names, err := list(creds, flags, "/api/security/groups")
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			item := access.ListTypes{AccessType: "group", Group: access.GroupImport{Name: name}}
+			if !protected[name] && !source[item.Key()] {
+				plan[3] = append(plan[3], Step{Method: "DELETE", Type: "group", Name: name, Endpoint: item.Endpoint()})
+			}
+		}
+	}
+	return plan, nil
+}
+
+//membership the update taking a user out of groups it is not in on the source, nil if there are none
+func membership(creds auth.Creds, flags helpers.Flags, item access.ListTypes, groups map[string]bool) (*Step, error) {
+	have, found, err := access.Fetch(creds, flags, item)
+	if err != nil || !found {
+		return nil, err
+	}
+	var kept, removed []string
+	for _, group := range have.User.Groups {
+		if groups[group] {
+			kept = append(kept, group)
+		} else {
+			removed = append(removed, group)
+		}
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	if kept == nil {
+		kept = make([]string, 0)
+	}
+	body, err := json.Marshal(map[string]interface{}{"name": item.User.Name, "groups": kept})
+	if err != nil {
+		return nil, err
+	}
+	return &Step{Method: "POST", Type: "user", Name: item.User.Name, Endpoint: item.Endpoint(), Body: body, Removed: removed}, nil
+}
+
+//list names from a list endpoint, v2 permission targets come wrapped in an object
+func list(creds auth.Creds, flags helpers.Flags, path string) ([]string, error) {
+	data, respCode, _, getErr := auth.GetRestAPI("GET", true, creds.URL+path, creds.Username, creds.Apikey, "", nil, nil, 0, flags, nil)
+	if getErr != nil {
+		return nil, getErr
+	}
+	if respCode != 200 {
+		return nil, errors.New("Error listing " + path + ", HTTP " + strconv.Itoa(respCode) + ": " + string(data) + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	var entries []listEntry
+	err := json.Unmarshal(data, &entries)
+	if err != nil {
+		var wrapped struct {
+			Permissions []listEntry `json:"permissions"`
+		}
+		if json.Unmarshal(data, &wrapped) != nil {
+			return nil, errors.New("Error reading " + path + ": " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		entries = wrapped.Permissions
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+//Run carry out the plan phase by phase, journaling each entity first so it can be rolled back. Returns the steps that failed
+func Run(creds auth.Creds, flags helpers.Flags, plan [][]Step, journalWriter *journal.Writer) []Step {
+	var failed []Step
+	var mu sync.Mutex
+	for _, steps := range plan {
+		queue := make(chan Step)
+		var wg sync.WaitGroup
+		for w := 0; w < flags.WorkersVar; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for step := range queue {
+					err := apply(creds, flags, step, journalWriter)
+					if err != nil {
+						log.Warn("prune failed to ", step, ": ", err)
+						mu.Lock()
+						failed = append(failed, step)
+						mu.Unlock()
+						continue
+					}
+					log.Info("pruned: ", step)
+				}
+			}()
+		}
+		for _, step := range steps {
+			queue <- step
+		}
+		close(queue)
+		wg.Wait()
+	}
+	return failed
+}
+
+func apply(creds auth.Creds, flags helpers.Flags, step Step, journalWriter *journal.Writer) error {
+	previous, respCode, _, getErr := auth.GetRestAPI("GET", true, creds.URL+step.Endpoint, creds.Username, creds.Apikey, "", nil, nil, 0, flags, nil)
+	if getErr != nil {
+		return getErr
+	}
+	if respCode == 404 {
+		//gone already
+		return nil
+	}
+	if respCode != 200 {
+		return errors.New("Error reading " + step.Endpoint + ", HTTP " + strconv.Itoa(respCode) + ": " + string(previous))
+	}
+	err := journalWriter.Write(journal.Record{Kind: journal.BeforeKind, ID: step.Type + "/" + step.Name, Type: step.Type, Name: step.Name, Endpoint: step.Endpoint, Previous: previous})
+	if err != nil {
+		return err
+	}
+	var header map[string]string
+	if step.Body != nil {
+		header = map[string]string{"Content-Type": "application/json"}
+	}
+	data, respCode, _, getErr := auth.GetRestAPI(step.Method, true, creds.URL+step.Endpoint, creds.Username, creds.Apikey, "", step.Body, header, 0, flags, nil)
+	if getErr != nil {
+		return getErr
+	}
+	if respCode/100 != 2 {
+		return errors.New("HTTP " + strconv.Itoa(respCode) + ": " + string(data))
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package prune
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"security-json-import/access"
+	"security-json-import/auth"
+	"security-json-import/helpers"
+	"strings"
+	"testing"
+)
+
+//fakeTarget answers the list endpoints and user lookups from users, a map of user name to its groups
+func fakeTarget(t *testing.T, users map[string][]string, groups, permissions []string) *httptest.Server {
+	t.Helper()
+	names := func(list []string) []map[string]string {
+		entries := make([]map[string]string, 0, len(list))
+		for _, name := range list {
+			entries = append(entries, map[string]string{"name": name})
+		}
+		return entries
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var userNames []string
+		for name := range users {
+			userNames = append(userNames, name)
+		}
+		switch {
+		case r.URL.Path == "/api/security/users":
+			json.NewEncoder(w).Encode(names(userNames))
+		case strings.HasPrefix(r.URL.Path, "/api/security/users/"):
+			name := strings.TrimPrefix(r.URL.Path, "/api/security/users/")
+			groups, ok := users[name]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "groups": groups})
+		case r.URL.Path == "/api/security/groups":
+			json.NewEncoder(w).Encode(names(groups))
+		case r.URL.Path == "/api/v2/security/permissions":
+			json.NewEncoder(w).Encode(names(permissions))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPlan(t *testing.T) {
+	srv := fakeTarget(t, map[string][]string{
+		"bob":   {"devs", "ops"},
+		"carol": {"devs", "ops"},
+		"dave":  {"ops"},
+		"me":    {"ops"},
+	}, []string{"devs", "ops"}, []string{"old", "p"})
+	creds := auth.Creds{URL: srv.URL, Username: "me", Apikey: "x"}
+	flags := helpers.DefaultFlags()
+	flags.HTTPRetryMaxVar = 0
+
+	items := []access.ListTypes{
+		{AccessType: "group", Name: "devs", Group: access.GroupImport{Name: "devs"}},
+		{AccessType: "user", Name: "bob", User: access.UserImport{Name: "bob", Groups: []string{"devs"}}},
+		//carol is only referenced, so the groups carol is in are left alone
+		{AccessType: "permissionV2", Name: "p", PermissionV2: access.PermissionV2Import{Name: "p", Repo: &access.PermissionDataV2Import{
+			Repositories: []string{"ANY"},
+			Actions:      access.PermissionV2ActionsImport{Users: map[string][]string{"carol": {"read"}}, Groups: map[string][]string{"devs": {"read"}}},
+		}}},
+	}
+	plan, err := Plan(creds, flags, items, map[string]bool{"me": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]string
+	for _, phase := range plan {
+		var steps []string
+		for _, step := range phase {
+			steps = append(steps, step.String())
+		}
+		got = append(got, steps)
+	}
+	want := [][]string{
+		{"delete permissionV2 old"},
+		{"remove user bob from ops"},
+		{"delete user dave"},
+		{"delete group ops"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Plan() = %q, want %q", got, want)
+	}
+	if body := string(plan[1][0].Body); body != `{"groups":["devs"],"name":"bob"}` {
+		t.Errorf("membership update = %s, want bob in devs only", body)
+	}
+}
@@ -0,0 +1,127 @@
+package report
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"security-json-import/access"
+	"security-json-import/helpers"
+	"security-json-import/scheduler"
+	"strconv"
+	"time"
+)
+
+//Failure one entity that did not make it, with enough detail to import it again
+type Failure struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Name       string          `json:"name"`
+	State      string          `json:"state"`
+	Payload    json.RawMessage `json:"payload"`
+	Backend    string          `json:"backend,omitempty"`
+	HTTPStatus int             `json:"httpStatus,omitempty"`
+	Errors     []string        `json:"errors,omitempty"`
+	Attempts   int             `json:"attempts"`
+	Timestamp  time.Time       `json:"timestamp"`
+}
+
+//FromJob build the report entry for a failed or blocked job
+func FromJob(job scheduler.Job) (Failure, error) {
+	payload, err := json.Marshal(job.Item.Payload())
+	if err != nil {
+		return Failure{}, err
+	}
+	failure := Failure{
+		ID:         job.Item.ID(),
+		Type:       job.Item.AccessType,
+		Name:       job.Item.EntityName(),
+		State:      job.State.String(),
+		Payload:    payload,
+		Backend:    job.Item.Backend,
+		HTTPStatus: job.Result.StatusCode,
+		Errors:     Messages(job.Result),
+		Attempts:   job.Attempts,
+		Timestamp:  time.Now(),
+	}
+	return failure, nil
+}
+
+//Messages error messages Artifactory sent back, falling back to the raw body, plus any transport error
+func Messages(result scheduler.Result) []string {
+	var messages []string
+	if len(result.Body) > 0 {
+		var artError access.ArtifactoryError
+		if json.Unmarshal(result.Body, &artError) == nil && len(artError.Errors) > 0 {
+			for _, detail := range artError.Errors {
+				messages = append(messages, detail.Message)
+			}
+		} else {
+			messages = append(messages, string(result.Body))
+		}
+	}
+	if result.Err != nil {
+		messages = append(messages, result.Err.Error())
+	}
+	return messages
+}
+
+//Write the report as JSON lines, replacing the file in one go
+func Write(path string, failures []Failure) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return errors.New("Error writing failure report: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	buf := bufio.NewWriter(file)
+	enc := json.NewEncoder(buf)
+	for _, failure := range failures {
+		err = enc.Encode(failure)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return errors.New("Error writing failure report: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	return nil
+}
+
+//Read stream a failure report back into the queue, returns the number of entities queued
+func Read(path string, workQueue access.Queue) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, errors.New("Error reading failure report: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	defer file.Close()
+	dec := json.NewDecoder(bufio.NewReader(file))
+	count := 0
+	for {
+		var failure Failure
+		err := dec.Decode(&failure)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, errors.New("Error parsing failure report: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		item, err := access.ItemFromPayload(failure.Type, failure.Payload)
+		if err != nil {
+			return count, errors.New("Error parsing failure report entry " + failure.ID + ": " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		item.Backend = failure.Backend
+		workQueue.Add(item)
+		count++
+	}
+}
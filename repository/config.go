@@ -0,0 +1,126 @@
+package repository
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"os"
+	"security-json-import/helpers"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Definition repository definition as found in artifactory.config.xml
+type Definition struct {
+	Key          string   `xml:"key" json:"key"`
+	RClass       string   `xml:"-" json:"rclass"`
+	PackageType  string   `xml:"type" json:"packageType"`
+	Description  string   `xml:"description" json:"description,omitempty"`
+	URL          string   `xml:"url" json:"url,omitempty"`
+	Repositories []string `xml:"repositories>repositoryRef" json:"repositories,omitempty"`
+}
+
+//Config repository definitions keyed by repo key
+type Config struct {
+	Definitions map[string]Definition
+}
+
+//rclass per config.xml element name
+var repoElements = map[string]string{
+	"localRepository":   "local",
+	"remoteRepository":  "remote",
+	"virtualRepository": "virtual",
+}
+
+//ReadConfigXML stream the local, remote and virtual repository definitions out of artifactory.config.xml
+func ReadConfigXML(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Error("Error reading config xml: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		return nil, errors.New("Error reading config xml: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	defer file.Close()
+
+	config := &Config{Definitions: make(map[string]Definition)}
+	counts := make(map[string]int)
+	dec := xml.NewDecoder(file)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, errors.New("Error parsing config xml: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		rclass, ok := repoElements[start.Name.Local]
+		if !ok {
+			continue
+		}
+		var def Definition
+		if err := dec.DecodeElement(&def, &start); err != nil {
+			return nil, errors.New("Error parsing config xml repository: " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		def.RClass = rclass
+		def.PackageType = strings.ToLower(def.PackageType)
+		if def.PackageType == "" {
+			//older configs omit the type for maven repositories
+			def.PackageType = "maven"
+		}
+		if rclass != "remote" {
+			def.URL = ""
+		}
+		config.Definitions[def.Key] = def
+		counts[rclass]++
+	}
+	log.Info("Number of repositories in config xml: local ", counts["local"], " remote ", counts["remote"], " virtual ", counts["virtual"])
+	return config, nil
+}
+
+//Lookup repository definition by key
+func (c *Config) Lookup(key string) (Definition, bool) {
+	if c == nil {
+		return Definition{}, false
+	}
+	def, ok := c.Definitions[key]
+	return def, ok
+}
+
+//Cycle virtual repositories from key on that include each other, e.g. [a b a], nil if there are none. Only the
+//definitions in config xml are followed, the ones a placeholder would be created from
+func (c *Config) Cycle(key string) []string {
+	inProgress := make(map[string]bool)
+	done := make(map[string]bool)
+	var path []string
+	var visit func(key string) []string
+	visit = func(key string) []string {
+		def, ok := c.Lookup(key)
+		if !ok || def.RClass != "virtual" || done[key] {
+			return nil
+		}
+		if inProgress[key] {
+			for i, k := range path {
+				if k == key {
+					return append(append([]string(nil), path[i:]...), key)
+				}
+			}
+		}
+		inProgress[key] = true
+		path = append(path, key)
+		for _, member := range def.Repositories {
+			if cycle := visit(member); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		inProgress[key] = false
+		done[key] = true
+		return nil
+	}
+	return visit(key)
+}
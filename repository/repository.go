@@ -0,0 +1,159 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"security-json-import/helpers"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//pseudo repositories a permission target can reference that never exist as real repos
+var pseudoRepos = map[string]bool{"ANY": true, "ANY LOCAL": true, "ANY REMOTE": true, "ANY DISTRIBUTION": true}
+
+//Repos the calls the resolver makes to the target
+type Repos interface {
+	//RepoExists true if the repository is on the target
+	RepoExists(key string) (bool, error)
+	//CreateRepo create the repository from its JSON configuration, returns the body and HTTP status
+	CreateRepo(key string, config []byte) ([]byte, int, error)
+}
+
+//Resolver makes sure repositories referenced by permission targets exist on the target
+type Resolver struct {
+	Config *Config
+	//OnCreate called before a placeholder is created, an error leaves the repository missing
+	OnCreate func(key string) error
+	mu       sync.Mutex
+	repos    map[string]*repoState
+}
+
+//repoState what is known about one repository. Only answers the target gave are kept, a check that failed is tried again
+type repoState struct {
+	mu      sync.Mutex
+	checked bool
+	exists  bool
+}
+
+//NewResolver config may be nil, in which case missing repositories are only dropped
+func NewResolver(config *Config) *Resolver {
+	return &Resolver{Config: config, repos: make(map[string]*repoState)}
+}
+
+//Resolve returns the repository list to use, creating placeholders from config xml where possible
+func (r *Resolver) Resolve(repos Repos, keys []string) ([]string, error) {
+	var newRepos = make([]string, 0)
+	for _, key := range keys {
+		if pseudoRepos[key] {
+			newRepos = append(newRepos, key)
+			continue
+		}
+		exists, err := r.ensure(repos, key)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			newRepos = append(newRepos, key)
+			continue
+		}
+		if strings.HasSuffix(key, "-cache") {
+			//the cache of a remote comes with it, otherwise fall back to the remote itself
+			remoteKey := strings.TrimSuffix(key, "-cache")
+			remoteExists, err := r.ensure(repos, remoteKey)
+			if err != nil {
+				return nil, err
+			}
+			if remoteExists {
+				if def, ok := r.Config.Lookup(remoteKey); ok && def.RClass == "remote" {
+					newRepos = append(newRepos, key)
+				} else {
+					log.Info("attempting -cache removal for ", key)
+					newRepos = append(newRepos, remoteKey)
+				}
+				continue
+			}
+		}
+		log.Warn("repository ", key, " does not exist on target and has no definition in config xml, dropping it")
+	}
+	return newRepos, nil
+}
+
+//ensure checks the repo once per run and creates it from its definition if missing. Errors are not remembered, the next
+//permission target needing the repo checks it again
+func (r *Resolver) ensure(repos Repos, key string) (bool, error) {
+	r.mu.Lock()
+	state, ok := r.repos[key]
+	if !ok {
+		state = &repoState{}
+		r.repos[key] = state
+	}
+	r.mu.Unlock()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.checked {
+		return state.exists, nil
+	}
+	exists, err := repos.RepoExists(key)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		if def, ok := r.Config.Lookup(key); ok {
+			exists, err = r.create(repos, def)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	state.checked, state.exists = true, exists
+	return exists, nil
+}
+
+//create placeholder repository of the same class and package type as the source
+func (r *Resolver) create(repos Repos, def Definition) (bool, error) {
+	placeholder := def
+	if def.RClass == "virtual" {
+		//creating the members first would never end, or wait on itself
+		if cycle := r.Config.Cycle(def.Key); cycle != nil {
+			return false, errors.New("Virtual repositories in config xml include each other: " + strings.Join(cycle, " -> ") + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+		}
+		//a virtual can only aggregate repositories that exist
+		placeholder.Repositories = make([]string, 0)
+		for _, member := range def.Repositories {
+			exists, err := r.ensure(repos, member)
+			if err != nil {
+				return false, err
+			}
+			if exists {
+				placeholder.Repositories = append(placeholder.Repositories, member)
+			}
+		}
+	}
+	if placeholder.Description == "" {
+		placeholder.Description = "placeholder created by security-json-import"
+	}
+	repoData, err := json.Marshal(placeholder)
+	if err != nil {
+		return false, errors.New("Error marshaling repository " + def.Key + ": " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	if r.OnCreate != nil {
+		err = r.OnCreate(def.Key)
+		if err != nil {
+			return false, err
+		}
+	}
+	log.Info("creating placeholder ", def.RClass, " ", def.PackageType, " repository ", def.Key)
+	data, respCode, getErr := repos.CreateRepo(def.Key, repoData)
+	if getErr != nil {
+		return false, getErr
+	}
+	if respCode != 200 {
+		log.Warn("failed to create placeholder repository ", def.Key, " HTTP ", respCode, ":", string(data))
+		return false, nil
+	}
+	return true, nil
+}
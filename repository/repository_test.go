@@ -0,0 +1,135 @@
+package repository
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//fakeRepos repositories in memory, failing RepoExists the first fail times
+type fakeRepos struct {
+	repos   map[string]bool
+	fail    int
+	checks  int
+	created []string
+}
+
+func (f *fakeRepos) RepoExists(key string) (bool, error) {
+	f.checks++
+	if f.fail > 0 {
+		f.fail--
+		return false, errors.New("HTTP 503")
+	}
+	return f.repos[key], nil
+}
+
+func (f *fakeRepos) CreateRepo(key string, config []byte) ([]byte, int, error) {
+	f.created = append(f.created, key)
+	f.repos[key] = true
+	return nil, 200, nil
+}
+
+func TestResolve(t *testing.T) {
+	config := &Config{Definitions: map[string]Definition{
+		"libs-local": {Key: "libs-local", RClass: "local", PackageType: "maven"},
+		"jcenter":    {Key: "jcenter", RClass: "remote", PackageType: "maven", URL: "https://jcenter.bintray.com"},
+		"all":        {Key: "all", RClass: "virtual", PackageType: "maven", Repositories: []string{"libs-local", "gone"}},
+	}}
+	tests := []struct {
+		name    string
+		config  *Config
+		have    []string
+		keys    []string
+		want    []string
+		created []string
+	}{
+		{"existing", nil, []string{"a"}, []string{"a"}, []string{"a"}, nil},
+		{"pseudo repositories are kept", nil, nil, []string{"ANY", "ANY REMOTE"}, []string{"ANY", "ANY REMOTE"}, nil},
+		{"missing without config is dropped", nil, nil, []string{"a"}, []string{}, nil},
+		{"missing is created from config", config, nil, []string{"libs-local"}, []string{"libs-local"}, []string{"libs-local"}},
+		{"cache of a remote comes with it", config, nil, []string{"jcenter-cache"}, []string{"jcenter-cache"}, []string{"jcenter"}},
+		{"cache of an existing non remote falls back to it", nil, []string{"x"}, []string{"x-cache"}, []string{"x"}, nil},
+		{"virtual only aggregates what exists", config, nil, []string{"all"}, []string{"all"}, []string{"libs-local", "all"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repos := &fakeRepos{repos: make(map[string]bool)}
+			for _, key := range tt.have {
+				repos.repos[key] = true
+			}
+			got, err := NewResolver(tt.config).Resolve(repos, tt.keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Resolve() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(repos.created, tt.created) {
+				t.Errorf("created %v, want %v", repos.created, tt.created)
+			}
+		})
+	}
+}
+
+func TestResolveRetriesFailedChecks(t *testing.T) {
+	repos := &fakeRepos{repos: map[string]bool{"a": true}, fail: 1}
+	r := NewResolver(nil)
+	if _, err := r.Resolve(repos, []string{"a"}); err == nil {
+		t.Fatal("expected the failed check to be returned")
+	}
+	got, err := r.Resolve(repos, []string{"a"})
+	if err != nil || !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("second Resolve() = %v, %v, want [a] after checking again", got, err)
+	}
+	r.Resolve(repos, []string{"a"})
+	if repos.checks != 2 {
+		t.Errorf("checked %d times, want 2 as the answer is kept once there is one", repos.checks)
+	}
+}
+
+func TestResolveVirtualCycle(t *testing.T) {
+	virtual := func(key string, members ...string) Definition {
+		return Definition{Key: key, RClass: "virtual", PackageType: "maven", Repositories: members}
+	}
+	config := &Config{Definitions: map[string]Definition{
+		"a":     virtual("a", "b"),
+		"b":     virtual("b", "local", "a"),
+		"c":     virtual("c", "d"),
+		"d":     virtual("d", "e"),
+		"e":     virtual("e", "d"),
+		"self":  virtual("self", "self"),
+		"ok":    virtual("ok", "local", "inner", "local"),
+		"inner": virtual("inner", "local"),
+		"local": {Key: "local", RClass: "local", PackageType: "maven"},
+	}}
+	tests := []struct {
+		key  string
+		want []string
+	}{
+		{"a", []string{"a", "b", "a"}},
+		{"b", []string{"b", "a", "b"}},
+		{"c", []string{"d", "e", "d"}},
+		{"self", []string{"self", "self"}},
+		{"ok", nil},
+		{"local", nil},
+		{"unknown", nil},
+	}
+	for _, tt := range tests {
+		if got := config.Cycle(tt.key); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Cycle(%s) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+
+	//both ends fail instead of waiting on each other
+	repos := &fakeRepos{repos: make(map[string]bool)}
+	r := NewResolver(config)
+	for _, key := range []string{"a", "b"} {
+		if _, err := r.Resolve(repos, []string{key}); err == nil || !strings.Contains(err.Error(), "include each other") {
+			t.Errorf("Resolve(%s) error = %v, want the cycle", key, err)
+		}
+	}
+	if got, err := r.Resolve(repos, []string{"ok"}); err != nil || !reflect.DeepEqual(got, []string{"ok"}) {
+		t.Errorf("Resolve(ok) = %v, %v, want [ok]", got, err)
+	}
+}
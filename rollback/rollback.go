@@ -0,0 +1,150 @@
+package rollback
+
+import (
+	"errors"
+	"path"
+	"security-json-import/access"
+	"security-json-import/auth"
+	"security-json-import/helpers"
+	"security-json-import/journal"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//deletePhases entities the import created are removed in the reverse of the import order: permission targets
+//let go of users, groups and repositories before those are removed, users let go of groups
+var deletePhases = [][]string{{"permission", "permissionV2", "projectMember"}, {"user"}, {"group"}, {"projectRepository"}, {"project"}, {"repository"}}
+
+//restorePhases entities the import changed or deleted are put back afterwards in import order, so whatever they reference is back first
+var restorePhases = [][]string{{"group"}, {"user"}, {"permission", "permissionV2", "projectMember"}}
+
+//Step one entity to put back the way it was
+type Step struct {
+	Method string
+	Before journal.Record
+}
+
+func (s Step) String() string {
+	return s.Method + " " + s.Before.Endpoint + " (" + s.Before.Type + " " + s.Before.Name + ")"
+}
+
+//Plan the steps undoing everything the journal records a previous state for, per phase.
+//Entities that were absent are deleted, the rest get their previous state back
+func Plan(checkpoint *journal.Checkpoint) [][]Step {
+	var plan [][]Step
+	for _, phase := range deletePhases {
+		plan = append(plan, steps(checkpoint, phase, true))
+	}
+	for _, phase := range restorePhases {
+		plan = append(plan, steps(checkpoint, phase, false))
+	}
+	return plan
+}
+
+//steps for the given types, newest first, e.g. a virtual repository goes before the members created for it
+func steps(checkpoint *journal.Checkpoint, types []string, absent bool) []Step {
+	var steps []Step
+	for i := len(checkpoint.Before) - 1; i >= 0; i-- {
+		before := checkpoint.Before[i]
+		if before.Absent != absent || !contains(types, before.Type) {
+			continue
+		}
+		step := Step{Method: "PUT", Before: before}
+		switch {
+		case before.Absent:
+			step.Method = "DELETE"
+		case strings.HasPrefix(before.Endpoint, "/access/api/v2/"):
+			//the Access API updates in place, and takes back what it returned minus the read only fields
+			step.Method = "PATCH"
+		case before.Type == "user":
+			//an update, a PUT would need the password which is never returned
+			step.Method = "POST"
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+//Run carry out the plan phase by phase, returns the steps that failed
+func Run(creds auth.Creds, flags helpers.Flags, plan [][]Step) []Step {
+	var failed []Step
+	var mu sync.Mutex
+	for _, steps := range plan {
+		queue := make(chan Step)
+		var wg sync.WaitGroup
+		for w := 0; w < flags.WorkersVar; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for step := range queue {
+					err := restore(creds, flags, step)
+					if err != nil {
+						log.Warn("rollback failed for ", step, ": ", err)
+						mu.Lock()
+						failed = append(failed, step)
+						mu.Unlock()
+						continue
+					}
+					log.Info("rolled back ", step)
+				}
+			}()
+		}
+		for _, step := range steps {
+			queue <- step
+		}
+		close(queue)
+		wg.Wait()
+	}
+	return failed
+}
+
+func restore(creds auth.Creds, flags helpers.Flags, step Step) error {
+	var body []byte
+	var header map[string]string
+	if step.Method != "DELETE" {
+		body = step.Before.Previous
+		header = map[string]string{"Content-Type": "application/json"}
+	}
+	if step.Method == "PATCH" {
+		var err error
+		body, err = access.AccessBody(step.Before.Type, body)
+		if err != nil {
+			return err
+		}
+	}
+	data, respCode, _, getErr := auth.GetRestAPI(step.Method, true, creds.URL+step.Before.Endpoint, creds.Username, creds.Apikey, "", body, header, 0, flags, nil)
+	if getErr != nil {
+		return getErr
+	}
+	if step.Method == "POST" && respCode == 404 {
+		//the user was deleted, e.g. by -prune, so it has to be created again. Internal users need a password for that
+		data, respCode, _, getErr = auth.GetRestAPI("PUT", true, creds.URL+step.Before.Endpoint, creds.Username, creds.Apikey, "", body, header, 0, flags, nil)
+		if getErr != nil {
+			return getErr
+		}
+	}
+	if step.Method == "PATCH" && respCode == 404 {
+		//deleted since, created again through the collection it belongs to
+		data, respCode, _, getErr = auth.GetRestAPI("POST", true, creds.URL+path.Dir(step.Before.Endpoint), creds.Username, creds.Apikey, "", body, header, 0, flags, nil)
+		if getErr != nil {
+			return getErr
+		}
+	}
+	//already gone is as good as deleted
+	if respCode/100 == 2 || (step.Method == "DELETE" && respCode == 404) {
+		return nil
+	}
+	return errors.New("HTTP " + strconv.Itoa(respCode) + ": " + string(data))
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package rollback
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"security-json-import/auth"
+	"security-json-import/helpers"
+	"security-json-import/journal"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	absent := func(typ, name, endpoint string) journal.Record {
+		return journal.Record{Kind: journal.BeforeKind, ID: typ + "/" + name, Type: typ, Name: name, Endpoint: endpoint, Absent: true}
+	}
+	previous := func(typ, name, endpoint string) journal.Record {
+		return journal.Record{Kind: journal.BeforeKind, ID: typ + "/" + name, Type: typ, Name: name, Endpoint: endpoint, Previous: []byte(`{"name":"` + name + `"}`)}
+	}
+	checkpoint := &journal.Checkpoint{Before: []journal.Record{
+		absent("group", "devs", "/api/security/groups/devs"),
+		previous("group", "ops", "/api/security/groups/ops"),
+		absent("repository", "libs", "/api/repositories/libs"),
+		absent("repository", "all", "/api/repositories/all"),
+		absent("user", "bob", "/api/security/users/bob"),
+		previous("user", "alice", "/api/security/users/alice"),
+		previous("group", "qa", "/access/api/v2/groups/qa"),
+		absent("permissionV2", "p", "/api/v2/security/permissions/p"),
+		previous("permission", "old", "/api/security/permissions/old"),
+		absent("projectMember", "k/bob", "/access/api/v1/projects/k/users/bob"),
+		absent("project", "k", "/access/api/v1/projects/k"),
+		absent("projectRepository", "k/libs", "/access/api/v1/projects/_/attach/repositories/libs/k"),
+	}}
+	want := [][]string{
+		{"DELETE /access/api/v1/projects/k/users/bob (projectMember k/bob)", "DELETE /api/v2/security/permissions/p (permissionV2 p)"},
+		{"DELETE /api/security/users/bob (user bob)"},
+		{"DELETE /api/security/groups/devs (group devs)"},
+		{"DELETE /access/api/v1/projects/_/attach/repositories/libs/k (projectRepository k/libs)"},
+		{"DELETE /access/api/v1/projects/k (project k)"},
+		//newest first, the virtual made for a permission target goes before the members made for it
+		{"DELETE /api/repositories/all (repository all)", "DELETE /api/repositories/libs (repository libs)"},
+		{"PATCH /access/api/v2/groups/qa (group qa)", "PUT /api/security/groups/ops (group ops)"},
+		{"POST /api/security/users/alice (user alice)"},
+		{"PUT /api/security/permissions/old (permission old)"},
+	}
+	var got [][]string
+	for _, phase := range Plan(checkpoint) {
+		var steps []string
+		for _, step := range phase {
+			steps = append(steps, step.String())
+		}
+		got = append(got, steps)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Plan() =\n%q\nwant\n%q", got, want)
+	}
+
+	for i, phase := range Plan(&journal.Checkpoint{}) {
+		if len(phase) != 0 {
+			t.Errorf("Plan() of an empty journal has %d steps in phase %d", len(phase), i)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	//deleted since the import: the user, the Access group and the permission target are gone
+	gone := map[string]bool{
+		"POST /api/security/users/alice":      true,
+		"PATCH /access/api/v2/groups/qa":      true,
+		"DELETE /api/security/groups/devs":    true,
+		"PUT /api/security/permissions/other": true,
+	}
+	var mu sync.Mutex
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := r.Method + " " + r.URL.Path
+		mu.Lock()
+		calls = append(calls, call)
+		mu.Unlock()
+		if gone[call] {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	creds := auth.Creds{URL: srv.URL, Username: "admin", Apikey: "x"}
+	flags := helpers.DefaultFlags()
+	flags.HTTPRetryMaxVar = 0
+
+	step := func(method, typ, name, endpoint string) Step {
+		return Step{Method: method, Before: journal.Record{Type: typ, Name: name, Endpoint: endpoint, Previous: []byte(`{"name":"` + name + `"}`)}}
+	}
+	plan := [][]Step{
+		{step("DELETE", "group", "devs", "/api/security/groups/devs")},
+		{step("POST", "user", "alice", "/api/security/users/alice"), step("PATCH", "group", "qa", "/access/api/v2/groups/qa")},
+		{step("PUT", "permission", "other", "/api/security/permissions/other")},
+	}
+	failed := Run(creds, flags, plan)
+	if len(failed) != 1 || failed[0].Before.Name != "other" {
+		t.Errorf("Run() failed %v, want only the permission target", failed)
+	}
+	sort.Strings(calls)
+	want := []string{
+		"DELETE /api/security/groups/devs",
+		//gone from the Access API, created again through the collection
+		"PATCH /access/api/v2/groups/qa",
+		"POST /access/api/v2/groups",
+		//gone, created again with a PUT
+		"POST /api/security/users/alice",
+		"PUT /api/security/permissions/other",
+		"PUT /api/security/users/alice",
+	}
+	sort.Strings(want)
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("Run() called %q, want %q", calls, want)
+	}
+}
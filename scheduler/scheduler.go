@@ -0,0 +1,500 @@
+package scheduler
+
+import (
+	"errors"
+	"security-json-import/access"
+	"sync"
+)
+
+//State of a job
+type State int
+
+const (
+	Pending State = iota
+	Running
+	Succeeded
+	Failed
+	Skipped
+	Blocked
+)
+
+func (s State) String() string {
+	switch s {
+	case Pending:
+		return "pending"
+	case Running:
+		return "running"
+	case Succeeded:
+		return "succeeded"
+	case Failed:
+		return "failed"
+	case Skipped:
+		return "skipped"
+	case Blocked:
+		return "blocked"
+	}
+	return "unknown"
+}
+
+//Terminal true once a job will not be handed out again without a Retry
+func (s State) Terminal() bool {
+	return s == Succeeded || s == Failed || s == Skipped || s == Blocked
+}
+
+//Result outcome of processing a job. Returning Pending puts the job back to wait on its dependencies again
+type Result struct {
+	State      State
+	StatusCode int
+	Body       []byte
+	Err        error
+}
+
+//Job one group, user or permission target to import
+type Job struct {
+	ID       int
+	Key      string
+	Item     access.ListTypes
+	State    State
+	Attempts int
+	Result   Result
+
+	//unresolved prerequisites, the job is only ready at zero
+	waiting int
+	//bumped on every registration so stale waiter entries are ignored
+	epoch int
+	//dropped by Forget, only counted from then on
+	forgotten bool
+}
+
+//waiter a job waiting on an entity, valid while epoch matches the job
+type waiter struct {
+	job   *Job
+	epoch int
+}
+
+//entity all jobs importing the same key, plus the jobs waiting on it
+type entity struct {
+	jobs    []*Job
+	waiters []waiter
+	//forgotten jobs of the key, all of them succeeded or skipped
+	forgotten int
+}
+
+//entity resolution
+const (
+	unknown = iota
+	pending
+	satisfied
+	unsatisfied
+)
+
+//Scheduler hands out jobs to workers once their prerequisites succeeded, and knows when every job is terminal
+type Scheduler struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	jobs     []*Job
+	ready    []*Job
+	entities map[string]*entity
+	active   map[string]int
+	closed   bool
+	aborted  bool
+	running  int
+	//open jobs added or retried that are not terminal yet
+	open int
+	//added every job ever added, forgotten the jobs dropped from jobs by state
+	added     int
+	forgotten map[State]int
+	//finished jobs not yet handed to OnComplete
+	finished []Job
+
+	//OnComplete called with a snapshot of every job that reaches a terminal state, outside the lock
+	OnComplete func(job Job)
+	//Limit Add blocks while this many jobs are not terminal yet and some of them can run, so a producer reading faster
+	//than the workers import does not hold the whole source in memory. 0 for no limit. Only set it when Run goes on
+	//while items are added, or Add never returns
+	Limit int
+	//Forget drop succeeded and skipped jobs once they went to OnComplete, keeping only their count. Jobs then never
+	//returns them
+	Forget bool
+}
+
+//New empty scheduler, open for Add until Close
+func New() *Scheduler {
+	s := &Scheduler{entities: make(map[string]*entity), active: make(map[string]int), forgotten: make(map[State]int)}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+//Add queue an item, satisfies access.Queue. Workers may add while jobs are running. Blocks while Limit jobs are open
+func (s *Scheduler) Add(item access.ListTypes) {
+	s.mu.Lock()
+	for s.full() {
+		s.cond.Wait()
+	}
+	job := &Job{ID: s.added, Key: item.Key(), Item: item, State: Pending}
+	s.added++
+	s.open++
+	s.jobs = append(s.jobs, job)
+	e := s.entity(job.Key)
+	e.jobs = append(e.jobs, job)
+	s.register(job)
+	s.cond.Broadcast()
+	s.unlock()
+}
+
+//AddDone record an item that is already terminal, e.g. completed in an earlier run, without running it
+func (s *Scheduler) AddDone(item access.ListTypes, result Result) {
+	s.mu.Lock()
+	if !result.State.Terminal() {
+		result.State = Skipped
+	}
+	job := &Job{ID: s.added, Key: item.Key(), Item: item, State: result.State, Result: result}
+	s.added++
+	s.jobs = append(s.jobs, job)
+	e := s.entity(job.Key)
+	e.jobs = append(e.jobs, job)
+	if s.Forget && (job.State == Succeeded || job.State == Skipped) {
+		s.forget(job)
+	}
+	s.resolve(job.Key)
+	s.cond.Broadcast()
+	s.unlock()
+}
+
+//Known true if an item with this key was added
+func (s *Scheduler) Known(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entities[key]
+	return ok && (len(e.jobs) > 0 || e.forgotten > 0)
+}
+
+//Close no more items are coming from the producer. Prerequisites nobody added are assumed to exist on the target
+func (s *Scheduler) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for key, e := range s.entities {
+		if len(e.jobs) == 0 {
+			s.resolve(key)
+		}
+	}
+	s.settle()
+	s.cond.Broadcast()
+	s.unlock()
+}
+
+//Abort stop handing out jobs, jobs still running are left to finish on their own
+func (s *Scheduler) Abort() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aborted = true
+	s.cond.Broadcast()
+}
+
+//full true while Add has to wait for the workers. Jobs waiting on keys nobody added yet only run once those are added
+//or the scheduler is closed, so Add never waits when nothing can run. Must hold mu
+func (s *Scheduler) full() bool {
+	return s.Limit > 0 && s.open >= s.Limit && !s.aborted && (len(s.ready) > 0 || s.running > 0)
+}
+
+//done must hold mu
+func (s *Scheduler) done() bool {
+	return s.aborted || (s.closed && len(s.ready) == 0 && s.running == 0)
+}
+
+//Next blocks until a job is ready, false once every job is terminal or the run is aborted.
+//Jobs sharing a key never run at the same time, so updates to the same user do not race
+func (s *Scheduler) Next() (*Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if s.aborted {
+			return nil, false
+		}
+		for i, job := range s.ready {
+			if s.active[job.Key] > 0 {
+				continue
+			}
+			s.ready = append(s.ready[:i], s.ready[i+1:]...)
+			job.State = Running
+			job.Attempts++
+			s.running++
+			s.active[job.Key]++
+			return job, true
+		}
+		if s.done() {
+			return nil, false
+		}
+		s.cond.Wait()
+	}
+}
+
+//Complete record the result of a job handed out by Next
+func (s *Scheduler) Complete(job *Job, result Result) {
+	s.mu.Lock()
+	s.running--
+	s.active[job.Key]--
+	job.Result = result
+	switch result.State {
+	case Pending:
+		job.State = Pending
+		s.register(job)
+	case Succeeded, Failed, Skipped, Blocked:
+		job.State = result.State
+		s.finish(job)
+	default:
+		job.State = Failed
+		job.Result.State = Failed
+		s.finish(job)
+	}
+	s.resolve(job.Key)
+	s.settle()
+	s.cond.Broadcast()
+	s.unlock()
+}
+
+//Run process jobs with the given number of workers until every job is terminal or the run is aborted
+func (s *Scheduler) Run(workers int, process func(worker int, job *Job) Result) {
+	for i := 0; i < workers; i++ {
+		go func(i int) {
+			for {
+				job, ok := s.Next()
+				if !ok {
+					return
+				}
+				s.Complete(job, process(i, job))
+			}
+		}(i)
+	}
+	s.Wait()
+}
+
+//Wait blocks until every job is terminal or the run is aborted
+func (s *Scheduler) Wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.done() {
+		s.cond.Wait()
+	}
+}
+
+//Retry put terminal jobs back for another round, blocked jobs wait on their retried prerequisites again
+func (s *Scheduler) Retry(jobs []*Job) {
+	s.mu.Lock()
+	defer s.unlock()
+	var retried []*Job
+	for _, job := range jobs {
+		if !job.State.Terminal() || job.forgotten {
+			continue
+		}
+		job.State = Pending
+		job.Result = Result{}
+		s.open++
+		retried = append(retried, job)
+	}
+	for _, job := range retried {
+		s.register(job)
+	}
+	s.settle()
+	s.cond.Broadcast()
+}
+
+//entity must hold mu
+func (s *Scheduler) entity(key string) *entity {
+	e, ok := s.entities[key]
+	if !ok {
+		e = &entity{}
+		s.entities[key] = e
+	}
+	return e
+}
+
+//status must hold mu
+func (s *Scheduler) status(e *entity) int {
+	if len(e.jobs) == 0 && e.forgotten == 0 {
+		if s.closed {
+			return satisfied
+		}
+		return unknown
+	}
+	result := unsatisfied
+	if e.forgotten > 0 {
+		result = satisfied
+	}
+	for _, job := range e.jobs {
+		switch job.State {
+		case Pending, Running:
+			return pending
+		case Succeeded, Skipped:
+			result = satisfied
+		}
+	}
+	return result
+}
+
+//register wait on every unresolved prerequisite, ready straight away if there are none. Must hold mu
+func (s *Scheduler) register(job *Job) {
+	job.epoch++
+	job.waiting = 0
+	for _, dep := range job.Item.Dependencies() {
+		if dep == job.Key {
+			continue
+		}
+		e := s.entity(dep)
+		switch s.status(e) {
+		case satisfied:
+			continue
+		case unsatisfied:
+			s.block(job, dep)
+			return
+		}
+		e.waiters = append(e.waiters, waiter{job: job, epoch: job.epoch})
+		job.waiting++
+	}
+	if job.waiting == 0 {
+		s.ready = append(s.ready, job)
+	}
+}
+
+//block mark a job that can never run because a prerequisite failed. Must hold mu
+func (s *Scheduler) block(job *Job, dep string) {
+	job.State = Blocked
+	job.Result = Result{State: Blocked, Err: errors.New("blocked by failed prerequisite " + dep)}
+	s.finish(job)
+	s.resolve(job.Key)
+}
+
+//resolve release or block the waiters of a key once all of its jobs are terminal. Must hold mu
+func (s *Scheduler) resolve(key string) {
+	e, ok := s.entities[key]
+	if !ok {
+		return
+	}
+	status := s.status(e)
+	if status != satisfied && status != unsatisfied {
+		return
+	}
+	waiters := e.waiters
+	e.waiters = nil
+	for _, w := range waiters {
+		if w.epoch != w.job.epoch || w.job.State != Pending {
+			continue
+		}
+		if status == unsatisfied {
+			s.block(w.job, key)
+			continue
+		}
+		w.job.waiting--
+		if w.job.waiting == 0 {
+			s.ready = append(s.ready, w.job)
+		}
+	}
+}
+
+//settle once nothing is ready or running, jobs still waiting can never run. Must hold mu
+func (s *Scheduler) settle() {
+	if !s.closed || len(s.ready) > 0 || s.running > 0 {
+		return
+	}
+	for _, job := range s.jobs {
+		if job.State == Pending {
+			job.State = Blocked
+			job.Result = Result{State: Blocked, Err: errors.New("blocked by unresolved prerequisites")}
+			s.finish(job)
+		}
+	}
+}
+
+//finish queue a terminal job for OnComplete. Must hold mu
+func (s *Scheduler) finish(job *Job) {
+	s.open--
+	if s.OnComplete != nil {
+		s.finished = append(s.finished, *job)
+	}
+	if s.Forget && (job.State == Succeeded || job.State == Skipped) {
+		s.forget(job)
+	}
+}
+
+//forget drop a succeeded or skipped job, its key stays satisfied. The job list is compacted once half of it is
+//forgotten. Must hold mu
+func (s *Scheduler) forget(job *Job) {
+	e := s.entities[job.Key]
+	for i, j := range e.jobs {
+		if j == job {
+			e.jobs = append(e.jobs[:i], e.jobs[i+1:]...)
+			break
+		}
+	}
+	e.forgotten++
+	s.forgotten[job.State]++
+	job.forgotten = true
+	if 2*s.count() > len(s.jobs) {
+		return
+	}
+	jobs := s.jobs[:0]
+	for _, j := range s.jobs {
+		if !j.forgotten {
+			jobs = append(jobs, j)
+		}
+	}
+	for i := len(jobs); i < len(s.jobs); i++ {
+		s.jobs[i] = nil
+	}
+	s.jobs = jobs
+}
+
+//count jobs not forgotten. Must hold mu
+func (s *Scheduler) count() int {
+	forgotten := 0
+	for _, n := range s.forgotten {
+		forgotten += n
+	}
+	return s.added - forgotten
+}
+
+//unlock release mu, then hand finished jobs to OnComplete
+func (s *Scheduler) unlock() {
+	finished := s.finished
+	s.finished = nil
+	s.mu.Unlock()
+	for _, job := range finished {
+		s.OnComplete(job)
+	}
+}
+
+//Jobs in the given state, in the order they were added
+func (s *Scheduler) Jobs(state State) []*Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var jobs []*Job
+	for _, job := range s.jobs {
+		if job.State == state && !job.forgotten {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+//Stats snapshot of the queue
+type Stats struct {
+	Total, Ready, Running int
+	Closed, Aborted       bool
+	States                map[State]int
+}
+
+//Stats snapshot of the queue for progress logging
+func (s *Scheduler) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := Stats{Total: s.added, Ready: len(s.ready), Running: s.running, Closed: s.closed, Aborted: s.aborted, States: make(map[State]int)}
+	for _, job := range s.jobs {
+		if !job.forgotten {
+			stats.States[job.State]++
+		}
+	}
+	for state, n := range s.forgotten {
+		stats.States[state] += n
+	}
+	return stats
+}
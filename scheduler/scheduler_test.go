@@ -0,0 +1,496 @@
+package scheduler
+
+import (
+	"security-json-import/access"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func group(name string) access.ListTypes {
+	return access.ListTypes{AccessType: "group", Name: name, Group: access.GroupImport{Name: name}}
+}
+
+func user(name string, groups ...string) access.ListTypes {
+	return access.ListTypes{AccessType: "user", Name: name, User: access.UserImport{Name: name, Groups: groups}}
+}
+
+func permission(name string, users ...string) access.ListTypes {
+	actions := access.PermissionV2ActionsImport{Users: make(map[string][]string)}
+	for _, u := range users {
+		actions.Users[u] = []string{"read"}
+	}
+	return access.ListTypes{AccessType: "permissionV2", Name: name, PermissionV2: access.PermissionV2Import{Name: name, Repo: &access.PermissionDataV2Import{Actions: actions}}}
+}
+
+//next the job Next hands out, failing if none is ready within a second
+func next(t *testing.T, s *Scheduler) *Job {
+	t.Helper()
+	select {
+	case job := <-nextAsync(s):
+		if job == nil {
+			t.Fatal("Next() = false, want a job")
+		}
+		return job
+	case <-time.After(time.Second):
+		t.Fatal("no job ready")
+	}
+	return nil
+}
+
+//nextAsync Next in the background, nil once there is nothing left
+func nextAsync(s *Scheduler) chan *Job {
+	ch := make(chan *Job, 1)
+	go func() {
+		job, ok := s.Next()
+		if !ok {
+			job = nil
+		}
+		ch <- job
+	}()
+	return ch
+}
+
+//finished Next reports there is nothing left
+func finished(t *testing.T, s *Scheduler) {
+	t.Helper()
+	select {
+	case job := <-nextAsync(s):
+		if job != nil {
+			t.Fatalf("Next() = %s, want nothing left", job.Key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Next() still blocking, want nothing left")
+	}
+}
+
+func states(s *Scheduler) map[string]State {
+	got := make(map[string]State)
+	for _, state := range []State{Pending, Running, Succeeded, Failed, Skipped, Blocked} {
+		for _, job := range s.Jobs(state) {
+			got[job.Item.ID()] = state
+		}
+	}
+	return got
+}
+
+func wantStates(t *testing.T, s *Scheduler, want map[string]State) {
+	t.Helper()
+	got := states(s)
+	for id, state := range want {
+		if got[id] != state {
+			t.Errorf("%s is %s, want %s", id, got[id], state)
+		}
+	}
+}
+
+func TestRunsEverythingOnce(t *testing.T) {
+	s := New()
+	var completed []string
+	s.OnComplete = func(job Job) {
+		completed = append(completed, job.Key)
+	}
+	s.Add(group("a"))
+	s.Add(group("b"))
+	s.Close()
+	for i := 0; i < 2; i++ {
+		job := next(t, s)
+		s.Complete(job, Result{State: Succeeded})
+	}
+	finished(t, s)
+	if len(completed) != 2 {
+		t.Errorf("OnComplete called for %v, want both groups", completed)
+	}
+	stats := s.Stats()
+	if stats.Total != 2 || stats.States[Succeeded] != 2 {
+		t.Errorf("Stats() = %+v, want 2 succeeded", stats)
+	}
+}
+
+func TestSameKeyNeverRunsTwice(t *testing.T) {
+	s := New()
+	s.Add(user("bob", "devs"))
+	s.Add(user("bob", "ops"))
+	s.Close()
+	first := next(t, s)
+	waiting := nextAsync(s)
+	select {
+	case job := <-waiting:
+		t.Fatalf("Next() = %s while the first bob job is still running", job.Item.ID())
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.Complete(first, Result{State: Succeeded})
+	second := <-waiting
+	if second == nil || second.Item.ID() == first.Item.ID() {
+		t.Fatalf("Next() = %v, want the other bob job", second)
+	}
+	s.Complete(second, Result{State: Succeeded})
+	finished(t, s)
+}
+
+func TestPendingResultRunsAgain(t *testing.T) {
+	s := New()
+	s.Add(group("a"))
+	s.Close()
+	job := next(t, s)
+	s.Complete(job, Result{State: Pending})
+	job = next(t, s)
+	if job.Attempts != 2 {
+		t.Errorf("Attempts = %d, want 2", job.Attempts)
+	}
+	s.Complete(job, Result{State: Succeeded})
+	finished(t, s)
+}
+
+func TestUnknownResultFails(t *testing.T) {
+	s := New()
+	s.Add(group("a"))
+	s.Close()
+	s.Complete(next(t, s), Result{State: Running})
+	finished(t, s)
+	wantStates(t, s, map[string]State{"group/a": Failed})
+}
+
+func TestRetryFailed(t *testing.T) {
+	s := New()
+	s.Add(group("a"))
+	s.Add(group("b"))
+	s.Close()
+	for i := 0; i < 2; i++ {
+		job := next(t, s)
+		state := Succeeded
+		if job.Key == "group/a" {
+			state = Failed
+		}
+		s.Complete(job, Result{State: state})
+	}
+	finished(t, s)
+	failures := s.Jobs(Failed)
+	if len(failures) != 1 || failures[0].Key != "group/a" {
+		t.Fatalf("Jobs(Failed) = %v, want group/a", failures)
+	}
+	s.Retry(failures)
+	job := next(t, s)
+	if job.Key != "group/a" || job.Attempts != 2 {
+		t.Fatalf("Next() = %s attempt %d, want group/a attempt 2", job.Key, job.Attempts)
+	}
+	s.Complete(job, Result{State: Succeeded})
+	finished(t, s)
+	wantStates(t, s, map[string]State{"group/a": Succeeded, "group/b": Succeeded})
+}
+
+func TestAbort(t *testing.T) {
+	s := New()
+	s.Add(group("a"))
+	s.Add(group("b"))
+	job := next(t, s)
+	s.Abort()
+	finished(t, s)
+	s.Complete(job, Result{State: Succeeded})
+	if stats := s.Stats(); !stats.Aborted || stats.States[Pending] != 1 {
+		t.Errorf("Stats() = %+v, want aborted with one job pending", stats)
+	}
+}
+
+func TestDependenciesRunFirst(t *testing.T) {
+	s := New()
+	//added out of order, the permission target still waits for its user and the user for its group
+	s.Add(permission("p", "bob"))
+	s.Add(user("bob", "devs"))
+	s.Add(group("devs"))
+	s.Close()
+	for _, want := range []string{"group/devs", "user/bob", "permissionV2/p"} {
+		job := next(t, s)
+		if job.Key != want {
+			t.Fatalf("Next() = %s, want %s", job.Key, want)
+		}
+		if stats := s.Stats(); stats.Ready != 0 {
+			t.Fatalf("%d jobs ready while %s is running, want none", stats.Ready, want)
+		}
+		s.Complete(job, Result{State: Succeeded})
+	}
+	finished(t, s)
+}
+
+func TestFailedDependencyBlocksDependents(t *testing.T) {
+	s := New()
+	var blocked []string
+	s.OnComplete = func(job Job) {
+		if job.State == Blocked {
+			blocked = append(blocked, job.Key)
+		}
+	}
+	s.Add(group("devs"))
+	s.Add(user("bob", "devs"))
+	s.Add(permission("p", "bob"))
+	s.Add(group("ops"))
+	s.Close()
+	for i := 0; i < 2; i++ {
+		job := next(t, s)
+		state := Succeeded
+		if job.Key == "group/devs" {
+			state = Failed
+		}
+		s.Complete(job, Result{State: state})
+	}
+	finished(t, s)
+	wantStates(t, s, map[string]State{"group/devs": Failed, "user/bob#devs": Blocked, "permissionV2/p": Blocked, "group/ops": Succeeded})
+	if len(blocked) != 2 {
+		t.Errorf("OnComplete got blocked %v, want user/bob and permissionV2/p", blocked)
+	}
+}
+
+func TestSkippedDependencyIsSatisfied(t *testing.T) {
+	s := New()
+	s.Add(group("devs"))
+	s.Add(user("bob", "devs"))
+	s.Close()
+	s.Complete(next(t, s), Result{State: Skipped})
+	if job := next(t, s); job.Key != "user/bob" {
+		t.Fatalf("Next() = %s, want user/bob", job.Key)
+	}
+}
+
+func TestAddDoneIsSatisfied(t *testing.T) {
+	s := New()
+	s.AddDone(group("devs"), Result{State: Succeeded})
+	s.Add(user("bob", "devs"))
+	if job := next(t, s); job.Key != "user/bob" {
+		t.Fatalf("Next() = %s, want user/bob without waiting for Close", job.Key)
+	}
+}
+
+func TestMissingDependencyWaitsForClose(t *testing.T) {
+	s := New()
+	s.Add(user("bob", "devs"))
+	waiting := nextAsync(s)
+	select {
+	case job := <-waiting:
+		t.Fatalf("Next() = %v before Close, devs may still be added", job)
+	case <-time.After(50 * time.Millisecond):
+	}
+	//nobody added devs, so it is taken to exist on the target
+	s.Close()
+	job := <-waiting
+	if job == nil || job.Key != "user/bob" {
+		t.Fatalf("Next() = %v, want user/bob once closed", job)
+	}
+	s.Complete(job, Result{State: Succeeded})
+	finished(t, s)
+}
+
+func TestDependencyAddedLater(t *testing.T) {
+	s := New()
+	s.Add(user("bob", "devs"))
+	s.Add(group("devs"))
+	s.Close()
+	job := next(t, s)
+	if job.Key != "group/devs" {
+		t.Fatalf("Next() = %s, want group/devs", job.Key)
+	}
+	s.Complete(job, Result{State: Failed})
+	finished(t, s)
+	wantStates(t, s, map[string]State{"user/bob#devs": Blocked})
+}
+
+func TestDependencyWaitsForEveryJobOfTheKey(t *testing.T) {
+	s := New()
+	s.Add(user("bob", "devs"))
+	s.Add(user("bob", "ops"))
+	s.Add(permission("p", "bob"))
+	s.Close()
+	first := next(t, s)
+	s.Complete(first, Result{State: Succeeded})
+	second := next(t, s)
+	if second.Key != "user/bob" {
+		t.Fatalf("Next() = %s while a bob job is still pending, want the other bob job", second.Key)
+	}
+	s.Complete(second, Result{State: Failed})
+	//one of the bob jobs succeeded, so bob exists
+	if job := next(t, s); job.Key != "permissionV2/p" {
+		t.Fatalf("Next() = %s, want permissionV2/p", job.Key)
+	}
+}
+
+func TestRetryBlockedChain(t *testing.T) {
+	s := New()
+	s.Add(group("devs"))
+	s.Add(user("bob", "devs"))
+	s.Add(permission("p", "bob"))
+	s.Close()
+	s.Complete(next(t, s), Result{State: Failed})
+	finished(t, s)
+
+	s.Retry(append(s.Jobs(Failed), s.Jobs(Blocked)...))
+	wantStates(t, s, map[string]State{"group/devs": Pending, "user/bob#devs": Pending, "permissionV2/p": Pending})
+	for _, want := range []string{"group/devs", "user/bob", "permissionV2/p"} {
+		job := next(t, s)
+		if job.Key != want {
+			t.Fatalf("Next() = %s, want %s", job.Key, want)
+		}
+		s.Complete(job, Result{State: Succeeded})
+	}
+	finished(t, s)
+}
+
+func TestRetryBlockedChainFailingAgain(t *testing.T) {
+	s := New()
+	s.Add(group("devs"))
+	s.Add(user("bob", "devs"))
+	s.Close()
+	s.Complete(next(t, s), Result{State: Failed})
+	finished(t, s)
+	s.Retry(append(s.Jobs(Failed), s.Jobs(Blocked)...))
+	s.Complete(next(t, s), Result{State: Failed})
+	finished(t, s)
+	wantStates(t, s, map[string]State{"group/devs": Failed, "user/bob#devs": Blocked})
+}
+
+//addAsync Add in the background, closing the channel once it returned
+func addAsync(s *Scheduler, item access.ListTypes) chan struct{} {
+	added := make(chan struct{})
+	go func() {
+		s.Add(item)
+		close(added)
+	}()
+	return added
+}
+
+func TestLimitBlocksAdd(t *testing.T) {
+	s := New()
+	s.Limit = 2
+	s.Add(group("a"))
+	s.Add(group("b"))
+	added := addAsync(s, group("c"))
+	select {
+	case <-added:
+		t.Fatal("Add() returned with Limit jobs open")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.Complete(next(t, s), Result{State: Succeeded})
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("Add() still blocking after a job finished")
+	}
+}
+
+func TestLimitNeverBlocksWhenNothingCanRun(t *testing.T) {
+	s := New()
+	s.Limit = 2
+	//both wait on a group that is only read later, Add must not wait for them
+	s.Add(user("bob", "devs"))
+	s.Add(user("alice", "devs"))
+	select {
+	case <-addAsync(s, group("devs")):
+	case <-time.After(time.Second):
+		t.Fatal("Add() blocking while every open job waits on items not added yet")
+	}
+}
+
+func TestLimitReleasedByAbort(t *testing.T) {
+	s := New()
+	s.Limit = 1
+	s.Add(group("a"))
+	added := addAsync(s, group("b"))
+	s.Abort()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("Add() still blocking after Abort")
+	}
+}
+
+func TestLimitRun(t *testing.T) {
+	s := New()
+	s.Limit = 3
+	done := make(chan struct{})
+	go func() {
+		s.Run(2, func(i int, job *Job) Result {
+			return Result{State: Succeeded}
+		})
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		s.Add(group("g" + strconv.Itoa(i)))
+		s.Add(user("u"+strconv.Itoa(i), "g"+strconv.Itoa(i)))
+		s.Add(permission("p"+strconv.Itoa(i), "u"+strconv.Itoa(i)))
+	}
+	s.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not finish")
+	}
+	if stats := s.Stats(); stats.Total != 300 || stats.States[Succeeded] != 300 {
+		t.Errorf("Stats() = %+v, want 300 succeeded", stats)
+	}
+}
+
+func TestForget(t *testing.T) {
+	s := New()
+	s.Forget = true
+	var completed int
+	s.OnComplete = func(job Job) {
+		completed++
+	}
+	s.AddDone(group("old"), Result{State: Skipped})
+	s.Add(group("devs"))
+	s.Add(group("ops"))
+	for i := 0; i < 2; i++ {
+		job := next(t, s)
+		state := Succeeded
+		if job.Key == "group/ops" {
+			state = Failed
+		}
+		s.Complete(job, Result{State: state})
+	}
+	if completed != 2 {
+		t.Errorf("OnComplete called %d times, want 2", completed)
+	}
+	if jobs := s.Jobs(Succeeded); len(jobs) != 0 {
+		t.Errorf("Jobs(Succeeded) = %v, want them forgotten", jobs)
+	}
+	if jobs := s.Jobs(Failed); len(jobs) != 1 || jobs[0].Key != "group/ops" {
+		t.Errorf("Jobs(Failed) = %v, want group/ops kept", jobs)
+	}
+	stats := s.Stats()
+	if stats.Total != 3 || stats.States[Succeeded] != 1 || stats.States[Skipped] != 1 || stats.States[Failed] != 1 {
+		t.Errorf("Stats() = %+v, want forgotten jobs still counted", stats)
+	}
+	if !s.Known("group/devs") || !s.Known("group/old") {
+		t.Error("Known() = false for a forgotten key")
+	}
+	//a forgotten prerequisite is still satisfied, before Close too
+	s.Add(user("bob", "devs", "old"))
+	if job := next(t, s); job.Key != "user/bob" {
+		t.Fatalf("Next() = %s, want user/bob", job.Key)
+	}
+}
+
+func TestForgetCompacts(t *testing.T) {
+	s := New()
+	s.Forget = true
+	for i := 0; i < 100; i++ {
+		s.Add(group("g" + strconv.Itoa(i)))
+	}
+	s.Close()
+	for i := 0; i < 100; i++ {
+		job := next(t, s)
+		state := Succeeded
+		if i%10 == 0 {
+			state = Failed
+		}
+		s.Complete(job, Result{State: state})
+	}
+	finished(t, s)
+	if len(s.jobs) > 20 {
+		t.Errorf("%d jobs kept, want at most twice the 10 failures", len(s.jobs))
+	}
+	if jobs := s.Jobs(Failed); len(jobs) != 10 {
+		t.Errorf("Jobs(Failed) = %d jobs, want 10", len(jobs))
+	}
+	if stats := s.Stats(); stats.Total != 100 || stats.States[Succeeded] != 90 {
+		t.Errorf("Stats() = %+v, want 90 of 100 succeeded", stats)
+	}
+}
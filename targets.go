@@ -0,0 +1,506 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"security-json-import/access"
+	"security-json-import/auth"
+	"security-json-import/bundle"
+	"security-json-import/helpers"
+	"security-json-import/importer"
+	"security-json-import/journal"
+	"security-json-import/report"
+	"security-json-import/repository"
+	"security-json-import/scheduler"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//targetImport the import into one target instance, with its own worker pool, journal and failure report
+type targetImport struct {
+	name string
+	//prefix put before the progress lines, empty with a single target
+	prefix      string
+	flags       helpers.Flags
+	version     string
+	journalPath string
+	reportPath  string
+	creds       auth.Creds
+	credsFile   map[int][]string
+	journal     *journal.Writer
+	queue       *resumeQueue
+	feed        *sourceFeed
+	//bundleBackend the backend the requests of an applied bundle are written through
+	bundleBackend string
+	imp           *importer.Importer
+}
+
+//sourceFeed hands what is read from the source on to one target. With several targets it does so from a goroutine of
+//its own, buffering whatever the target is not ready for, so a target stuck backing off or timing out does not hold up
+//the reader and with it every other target. A single target is fed directly, so -queueSize bounds how far ahead it reads
+type sourceFeed struct {
+	queue  access.Queue
+	imp    *importer.Importer
+	direct bool
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  []access.ListTypes
+	closed bool
+	err    error
+}
+
+func newSourceFeed(queue access.Queue, imp *importer.Importer, direct bool) *sourceFeed {
+	f := &sourceFeed{queue: queue, imp: imp, direct: direct}
+	f.cond = sync.NewCond(&f.mu)
+	if !direct {
+		go f.run()
+	}
+	return f
+}
+
+//Add satisfies access.Queue, never blocks unless the target is fed directly
+func (f *sourceFeed) Add(item access.ListTypes) {
+	if f.direct {
+		f.queue.Add(item)
+		return
+	}
+	f.mu.Lock()
+	f.items = append(f.items, item)
+	f.cond.Signal()
+	f.mu.Unlock()
+}
+
+//Close the source is read, or reading it failed with err. The target gets everything buffered and is closed, or is
+//stopped straight away on an error, as the rest of the source is missing
+func (f *sourceFeed) Close(err error) {
+	f.mu.Lock()
+	f.closed = true
+	f.err = err
+	f.cond.Signal()
+	f.mu.Unlock()
+	if f.direct {
+		f.finish(err)
+	}
+}
+
+//Err why the source could not be read, nil if it was
+func (f *sourceFeed) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+func (f *sourceFeed) run() {
+	for {
+		f.mu.Lock()
+		for len(f.items) == 0 && !f.closed {
+			f.cond.Wait()
+		}
+		if f.err != nil || len(f.items) == 0 {
+			err := f.err
+			f.items = nil
+			f.mu.Unlock()
+			f.finish(err)
+			return
+		}
+		item := f.items[0]
+		f.items[0] = access.ListTypes{}
+		f.items = f.items[1:]
+		f.mu.Unlock()
+		f.queue.Add(item)
+	}
+}
+
+func (f *sourceFeed) finish(err error) {
+	if err != nil {
+		f.imp.Scheduler().Abort()
+		return
+	}
+	f.imp.Close()
+}
+
+//targetPath path with the target name added before the extension, so the journals and reports of several targets
+//do not overwrite each other
+func targetPath(path, name string) string {
+	dir, base := filepath.Split(path)
+	if i := strings.Index(base, "."); i > 0 {
+		return dir + base[:i] + "-" + name + base[i:]
+	}
+	return path + "-" + name
+}
+
+//newTargetImport check the credentials and version of the target, and that it takes the bundle if one is applied, then open its
+//journal. On error the exit status to report for it, nil without an error if there is nothing to do for it
+func newTargetImport(target auth.Target, flags helpers.Flags, multi bool, startTime time.Time, repoConfig *repository.Config, b *bundle.Bundle) (*targetImport, int, error) {
+	t := &targetImport{name: target.Name, flags: flags}
+	path := func(p string) string { return p }
+	if multi {
+		t.prefix = target.Name + ": "
+		path = func(p string) string { return targetPath(p, target.Name) }
+	}
+	replay := flags.ReplayFailuresVar != ""
+	if replay {
+		flags.ReplayFailuresVar = path(flags.ReplayFailuresVar)
+		t.flags = flags
+		if _, err := os.Stat(flags.ReplayFailuresVar); multi && os.IsNotExist(err) {
+			//no failures on this target last time
+			log.Info(t.prefix, "Nothing to replay, there is no ", flags.ReplayFailuresVar)
+			return nil, helpers.ExitSuccess, nil
+		}
+	}
+
+	//use different users to create things
+	credsFileHash := make(map[int][]string)
+	if flags.CredsFileVar != "" {
+		var err error
+		credsFileHash, err = auth.ReadCredsFile(flags.CredsFileVar, flags)
+		if err != nil {
+			return nil, helpers.ExitConfigError, errors.New("Invalid creds file: " + err.Error())
+		}
+		flags.UsernameVar = credsFileHash[0][0]
+		flags.ApikeyVar = credsFileHash[0][1]
+		t.flags = flags
+		log.Info(t.prefix, "Number of creds in file:", len(credsFileHash))
+		log.Info(t.prefix, "choose first one first:", flags.UsernameVar)
+	}
+
+	if flags.PruneVar && flags.UsernameVar == "" {
+		//a token does not tell us whose it is, and prune must not delete the account it runs as
+		return nil, helpers.ExitConfigError, errors.New("-prune needs -user with -authMode " + auth.BearerMode + " to know which user the token belongs to and never prune it " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	credCheck, err := auth.VerifyAPIKey(flags.URLVar, flags.UsernameVar, flags.ApikeyVar, flags)
+	if !credCheck || err != nil {
+		return nil, helpers.ExitConfigError, fmt.Errorf("Looks like there's an issue with checking your credentials. Exiting due to: %v", err)
+	}
+	var creds auth.Creds
+	creds.Username = flags.UsernameVar
+	creds.Apikey = flags.ApikeyVar
+	creds.URL = flags.URLVar
+	artVer, err := access.TargetVersion(creds, flags)
+	if err != nil {
+		return nil, helpers.ExitError, err
+	}
+	t.version = artVer.Version
+	if b != nil {
+		t.bundleBackend, err = b.Check(t.version, flags.BackendVar)
+		if err != nil {
+			return nil, helpers.ExitConfigError, err
+		}
+		if b.Manifest.Backend != "" && t.bundleBackend != b.Manifest.Backend {
+			log.Warn(t.prefix, "Bundle was made writing groups and users through the ", b.Manifest.Backend, " API, using the ", t.bundleBackend, " API of -backend instead")
+		}
+		if t.version != b.Manifest.TargetVersion {
+			log.Warn(t.prefix, "Bundle was made for ", b.Manifest.TargetVersion, ", applying it to ", t.version)
+		}
+	}
+	t.creds = creds
+	t.credsFile = credsFileHash
+	backend, err := access.BackendFor(flags.BackendVar, t.version)
+	if err != nil {
+		return nil, helpers.ExitConfigError, err
+	}
+	client := importer.NewClient(creds, flags)
+	client.CredsFile = credsFileHash
+	client.Backend = backend
+	t.imp, err = importer.New(client, flags)
+	if err != nil {
+		return nil, helpers.ExitConfigError, err
+	}
+	//the source is read while the workers import, only -queueSize entities ahead of them. Finished jobs are dropped unless
+	//-verify reads them back, failures are kept for the report and retries
+	t.imp.Scheduler().Limit = flags.QueueSizeVar
+	t.imp.Scheduler().Forget = !flags.VerifyVar
+
+	//checkpoint journal, resuming skips everything an earlier run completed
+	inputs := map[string]string{"securityJSONFile": flags.SecurityJSONFileVar, "configXMLFile": flags.ConfigXMLFileVar}
+	if !flags.SkipUserImportVar {
+		inputs["userGroupAssocationFile"] = flags.UserGroupAssocationFileVar
+	}
+	if replay {
+		inputs = map[string]string{"replayFailures": flags.ReplayFailuresVar, "configXMLFile": flags.ConfigXMLFileVar}
+	}
+	if flags.Command == "apply" {
+		inputs = map[string]string{"bundle": flags.Args[0], "configXMLFile": flags.ConfigXMLFileVar}
+	}
+	inputHashes, err := journal.HashInputs(inputs)
+	if err != nil {
+		return nil, helpers.ExitConfigError, err
+	}
+	var checkpoint *journal.Checkpoint
+	t.journalPath = flags.JournalVar
+	if flags.ResumeVar != "" {
+		resume := path(flags.ResumeVar)
+		checkpoint, err = journal.Load(resume)
+		if err != nil {
+			return nil, helpers.ExitConfigError, err
+		}
+		changed := journal.ChangedInputs(checkpoint.Inputs, inputHashes)
+		if len(changed) > 0 {
+			if !flags.ResumeIgnoreChangesVar {
+				return nil, helpers.ExitConfigError, errors.New("Input files changed since " + resume + " was written: " + strings.Join(changed, ", ") + ". Pass -resumeIgnoreChanges to resume anyway")
+			}
+			log.Warn(t.prefix, "Input files changed since ", resume, " was written: ", strings.Join(changed, ", "), ", resuming anyway")
+		}
+		if t.journalPath == "" {
+			t.journalPath = flags.ResumeVar
+		}
+		log.Info(t.prefix, "Resuming from ", resume, ", ", len(checkpoint.Outcomes), " entities journaled")
+	}
+	if t.journalPath == "" {
+		t.journalPath = "security-json-import-" + startTime.Format("20060102-150405") + ".journal"
+	}
+	t.journalPath = path(t.journalPath)
+	t.reportPath = flags.FailureReportVar
+	if t.reportPath == "" {
+		t.reportPath = "security-json-import-" + startTime.Format("20060102-150405") + ".failures.jsonl"
+	}
+	t.reportPath = path(t.reportPath)
+	t.journal, err = journal.Open(t.journalPath)
+	if err != nil {
+		return nil, helpers.ExitError, err
+	}
+	//without the header -resume could not tell whether the inputs changed
+	err = t.journal.Write(journal.Record{Kind: journal.HeaderKind, Inputs: inputHashes})
+	if err != nil {
+		t.journal.Close()
+		return nil, helpers.ExitError, errors.New("Error writing the header of journal " + t.journalPath + ": " + err.Error() + " " + helpers.Trace().Fn + ":" + strconv.Itoa(helpers.Trace().Line))
+	}
+	log.Info(t.prefix, "Writing checkpoint journal to ", t.journalPath)
+
+	//placeholder repositories are journaled as absent, so a rollback removes them again
+	t.imp.Journal = t.journal
+	t.imp.Repositories = repository.NewResolver(repoConfig)
+	t.imp.Repositories.OnCreate = func(key string) error {
+		return t.journal.Write(journal.Record{Kind: journal.BeforeKind, ID: "repository/" + key, Type: "repository", Name: key, Endpoint: "/api/repositories/" + key, Absent: true})
+	}
+
+	t.imp.OnComplete = func(job scheduler.Job) {
+		record := journal.Record{Kind: journal.OutcomeKind, ID: job.Item.ID(), Type: job.Item.AccessType, Name: job.Item.EntityName(), State: job.State.String(), Status: job.Result.StatusCode, Attempts: job.Attempts}
+		if job.Result.Err != nil {
+			record.Error = job.Result.Err.Error()
+		}
+		err := t.journal.Write(record)
+		if err != nil {
+			log.Warn(t.prefix, "Failed to journal ", record.ID, ": ", err)
+		}
+	}
+	t.queue = &resumeQueue{imp: t.imp, checkpoint: checkpoint}
+	t.feed = newSourceFeed(t.queue, t.imp, !multi)
+	return t, helpers.ExitSuccess, nil
+}
+
+//readSource queue the source into every target, reading security json once for all of them, and close them. A replay
+//reads the failure report of each target, apply the requests of the bundle. A target whose source could not be read is
+//stopped, the others go on where they each have their own
+func readSource(flags helpers.Flags, targets []*targetImport, b *bundle.Bundle) {
+	if b != nil {
+		for _, t := range targets {
+			count, err := b.Queue(t.feed, t.bundleBackend)
+			if err == nil {
+				log.Info(t.prefix, "Applying ", count, " requests from ", b.Path)
+			}
+			t.feed.Close(err)
+		}
+		return
+	}
+	if flags.ReplayFailuresVar != "" {
+		for _, t := range targets {
+			count, err := report.Read(t.flags.ReplayFailuresVar, t.feed)
+			if err == nil {
+				log.Info(t.prefix, "Replaying ", count, " entities from ", t.flags.ReplayFailuresVar)
+			}
+			t.feed.Close(err)
+		}
+		return
+	}
+	var queues []access.TargetQueue
+	for _, t := range targets {
+		queues = append(queues, access.TargetQueue{Queue: t.feed, Version: t.version})
+	}
+	err := access.ReadSecurityJSONTargets(queues, flags)
+	for _, t := range targets {
+		t.feed.Close(err)
+	}
+}
+
+//importTargets import into every target at once, each with its own worker pool. A target failing does not stop the
+//others. Returns the highest exit status of any target
+func importTargets(flags helpers.Flags, targets []auth.Target, targetFlags []helpers.Flags, startTime time.Time) int {
+	multi := len(targets) > 1
+	//repositories referenced by permission targets, recreated from config xml if provided
+	var repoConfig *repository.Config
+	if flags.ConfigXMLFileVar != "" {
+		var err error
+		repoConfig, err = repository.ReadConfigXML(flags.ConfigXMLFileVar)
+		if err != nil {
+			log.Error("Could not read config xml. Exiting due to:", err)
+			return helpers.ExitConfigError
+		}
+	}
+	//apply imports the requests of a bundle, recreating repositories from the definitions it carries unless given config xml
+	var b *bundle.Bundle
+	if flags.Command == "apply" {
+		var err error
+		b, err = bundle.Read(flags.Args[0])
+		if err != nil {
+			log.Error(err)
+			return helpers.ExitConfigError
+		}
+		log.Info("Bundle ", b.Path, " made ", b.Manifest.Created.Format(time.RFC3339), " for ", b.Manifest.TargetVersion, " with ", b.Manifest.Requests, " requests")
+		if repoConfig == nil {
+			repoConfig = b.Config
+		}
+	}
+
+	codes := make([]int, len(targets))
+	var imports []*targetImport
+	var running []int
+	for i, target := range targets {
+		t, code, err := newTargetImport(target, targetFlags[i], multi, startTime, repoConfig, b)
+		if t == nil && err == nil {
+			continue
+		}
+
+		if err != nil {
+			if multi {
+				log.Error(target.Name, ": ", err)
+			} else {
+				log.Error(err)
+			}
+			codes[i] = code
+			continue
+		}
+		imports = append(imports, t)
+		running = append(running, i)
+	}
+	if len(imports) > 0 {
+		go readSource(flags, imports, b)
+	}
+
+	var wg sync.WaitGroup
+	for n, t := range imports {
+		wg.Add(1)
+		go func(i int, t *targetImport) {
+			defer wg.Done()
+			codes[i] = t.run(startTime)
+		}(running[n], t)
+	}
+	wg.Wait()
+
+	worst := helpers.ExitSuccess
+	for i, code := range codes {
+		if multi {
+			log.Info("Target ", targets[i].Name, " (", targets[i].URL, ") finished with exit status ", code)
+		}
+		if code > worst {
+			worst = code
+		}
+	}
+	return worst
+}
+
+//run work through the queue of the target, retrying failures as -autoRetryFailures and the prompt allow, then prune and
+//verify. Returns the exit status of the target
+func (t *targetImport) run(startTime time.Time) int {
+	defer t.journal.Close()
+	flags := t.flags
+	sched := t.imp.Scheduler()
+	creds := t.creds
+	retryRound := 0
+	reportWritten := false
+	for {
+		stop := make(chan struct{})
+		go monitor(sched, flags, t.prefix, stop)
+		stats := t.imp.Run()
+		close(stop)
+
+		endTime := time.Now()
+		log.Info(t.prefix, "Completed import in ", endTime.Sub(startTime), "")
+		log.Info(t.prefix, "Jobs: ", stats.Total, " succeeded: ", stats.States[scheduler.Succeeded], " skipped: ", stats.States[scheduler.Skipped], " failed: ", stats.States[scheduler.Failed], " blocked: ", stats.States[scheduler.Blocked])
+		readErr := t.feed.Err()
+		if readErr != nil {
+			log.Error(t.prefix, "Stopped importing, could not read the source: ", readErr)
+		} else if stats.Aborted {
+			log.Warn(t.prefix, "Import was stopped manually with ", stats.States[scheduler.Running], " requests still running and ", stats.States[scheduler.Pending], " not started")
+		}
+		failures := sched.Jobs(scheduler.Failed)
+		blocked := sched.Jobs(scheduler.Blocked)
+		if len(failures) == 0 && len(blocked) == 0 && readErr == nil {
+			if reportWritten {
+				//an earlier round failed, everything went through since
+				os.Remove(t.reportPath)
+			}
+			if flags.PruneVar && !pruneTarget(creds, flags, t.version, t.credsFile, t.journal) {
+				return helpers.ExitPartialFailure
+			}
+			if flags.VerifyVar && !verifyJobs(creds, flags, sched) {
+				return helpers.ExitPartialFailure
+			}
+			return helpers.ExitSuccess
+		}
+		log.Info(t.prefix, "To pick up where this run left off later, run again with -resume ", t.journalPath)
+		if len(blocked) > 0 {
+			log.Warn(t.prefix, "There were ", len(blocked), " imports not attempted because a group or user they need failed")
+		}
+		if len(failures) > 0 {
+			log.Warn(t.prefix, "There were ", len(failures), " failures. The following imports failed:")
+		}
+		var failureReport []report.Failure
+		for _, job := range append(failures, blocked...) {
+			failure, err := report.FromJob(*job)
+			if err != nil {
+				log.Error(t.prefix, "Error marshaling ", job.Item.AccessType+": "+job.Item.EntityName()+" "+err.Error()+" "+helpers.Trace().Fn+":"+strconv.Itoa(helpers.Trace().Line))
+				continue
+			}
+			log.Warn(t.prefix, failure.Type, " ", failure.Name, " ", failure.State, " after ", failure.Attempts, " attempts, HTTP ", failure.HTTPStatus, ": ", strings.Join(failure.Errors, "; "))
+			failureReport = append(failureReport, failure)
+		}
+		if len(failureReport) > 0 {
+			err := report.Write(t.reportPath, failureReport)
+			if err != nil {
+				log.Error(t.prefix, err)
+			} else {
+				reportWritten = true
+				log.Info(t.prefix, "Wrote ", len(failureReport), " failures to ", t.reportPath, ", import just these again with -replayFailures ", t.reportPath)
+			}
+		}
+		if flags.PruneVar {
+			log.Warn(t.prefix, "Not pruning until everything is imported")
+		}
+		if readErr != nil {
+			return helpers.ExitError
+		}
+		if stats.Aborted {
+			return helpers.ExitAborted
+		}
+		retryRound++
+		if retryRound > flags.AutoRetryFailuresVar {
+			if flags.YesVar || !helpers.Interactive() {
+				log.Warn(t.prefix, "Not retrying, ", flags.AutoRetryFailuresVar, " automatic retries used up")
+				if flags.VerifyVar {
+					verifyJobs(creds, flags, sched)
+				}
+				return helpers.ExitPartialFailure
+			}
+			fmt.Println("Do you want to retry these? (y/n)")
+			if !askForConfirmation() {
+				if flags.VerifyVar {
+					verifyJobs(creds, flags, sched)
+				}
+				return helpers.ExitPartialFailure
+			}
+		} else {
+			log.Info(t.prefix, "Automatically retrying failures, round ", retryRound, " of ", flags.AutoRetryFailuresVar)
+		}
+		for _, job := range failures {
+			log.Info(t.prefix, "Re-queuing ", job.Item.AccessType, " ", job.Item.Name)
+		}
+		sched.Retry(append(failures, blocked...))
+	}
+}
@@ -0,0 +1,59 @@
+package verify
+
+import (
+	"security-json-import/access"
+	"security-json-import/auth"
+	"security-json-import/helpers"
+	"security-json-import/plan"
+	"security-json-import/policy"
+)
+
+//What was found for an imported entity
+const (
+	OK      = "ok"
+	Missing = "missing"
+	Drift   = "drift"
+	Error   = plan.Error
+)
+
+//Check read every item back from the target and compare it with the payload the import sent for it.
+//Missing entities, dropped repositories, principals or actions and differing flags are reported as drift
+func Check(creds auth.Creds, flags helpers.Flags, items []access.ListTypes) ([]plan.Entry, error) {
+	policies, err := policy.FromFlags(flags)
+	if err != nil {
+		return nil, err
+	}
+	for accessType, p := range policies {
+		//the import created these, so they should match in full
+		if p == policy.SkipExisting {
+			policies[accessType] = policy.Overwrite
+		}
+	}
+	c := plan.NewCollector()
+	for _, item := range items {
+		c.Add(item)
+	}
+	entries := plan.CompareAll(creds, flags, policies, c.Items())
+	for i := range entries {
+		switch entries[i].Action {
+		case plan.Create:
+			entries[i].Action = Missing
+		case plan.Update:
+			entries[i].Action = Drift
+		case plan.Unchanged, plan.Skip:
+			entries[i].Action = OK
+		}
+	}
+	return entries, nil
+}
+
+//Drifted entries that are not OK
+func Drifted(entries []plan.Entry) []plan.Entry {
+	var drifted []plan.Entry
+	for _, entry := range entries {
+		if entry.Action != OK {
+			drifted = append(drifted, entry)
+		}
+	}
+	return drifted
+}